@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/randomouscrap98/goldmonolith/webstream"
+)
+
+// One-off commands run from the command line instead of hosting the server
+
+// Copy every room in the webstream StreamFolder into the StreamDatabase. Existing
+// rooms in the database with the same name are overwritten
+func migrateStreams(config *Config) error {
+	from, err := webstream.NewFileBacker(config.Webstream.StreamFolder)
+	if err != nil {
+		return err
+	}
+	to, err := webstream.NewSqliteBacker(config.Webstream.StreamDatabase)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+	count, err := webstream.MigrateBacker(from, to)
+	log.Printf("Migrated %d room(s) from %s to %s", count, config.Webstream.StreamFolder, config.Webstream.StreamDatabase)
+	return err
+}
+
+// Open the webstream system on its own, for commands that work with rooms. The
+// monolith should NOT be running, it won't know about any changes
+func openStreams(config *Config) (*webstream.WebStreamSystem, error) {
+	backer, err := webstream.NewConfigBacker(config.Webstream)
+	if err != nil {
+		return nil, err
+	}
+	return webstream.NewWebStreamSystem(config.Webstream, backer)
+}
+
+// Write every webstream room (with metadata) to a tar file
+func exportStreamArchive(config *Config, filename string) error {
+	system, err := openStreams(config)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = system.ExportRooms(file, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d room(s) to %s", system.RoomCount(), filename)
+	return file.Sync()
+}
+
+// Restore webstream rooms from a tar file made with exportStreamArchive (or the
+// export endpoint). Existing rooms with the same name are overwritten
+func importStreamArchive(config *Config, filename string) error {
+	system, err := openStreams(config)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	imported, err := system.ImportRooms(file)
+	log.Printf("Imported %d room(s) from %s", len(imported), filename)
+	return err
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
@@ -94,9 +95,28 @@ func waitForShutdown() {
 }
 
 func main() {
+	migrate := flag.Bool("migratestreams", false, "Copy the webstream StreamFolder into the StreamDatabase, then exit")
+	exportStreams := flag.String("exportstreams", "", "Export every webstream room to the given tar file, then exit")
+	importStreams := flag.String("importstreams", "", "Import webstream rooms from the given tar file, then exit")
+	flag.Parse()
+
 	log.Printf("Gold monolith server started\n")
 	config := initConfig()
 
+	// --- One-off commands ---
+	if *migrate {
+		must(migrateStreams(config))
+		return
+	}
+	if *exportStreams != "" {
+		must(exportStreamArchive(config, *exportStreams))
+		return
+	}
+	if *importStreams != "" {
+		must(importStreamArchive(config, *importStreams))
+		return
+	}
+
 	// Context is something we'll cancel to cancel any and all background tasks
 	// when the server gets a shutdown signal
 	ctx, cancel := context.WithCancel(context.Background())
@@ -214,7 +214,7 @@ function slideshowShift(amount)
 {
    var ssi = slideshowImage();
    var ssii = Number(ssi.getAttribute("data-imageindex") || 0) + amount;
-   ssi.src = getImage(ssii).src;
+   ssi.src = getImage(ssii).getAttribute("data-full") || getImage(ssii).src;
    ssi.setAttribute("data-imageindex", ssii);
    slideshowNext().disabled = getImage(ssii + 1) ? false : true;
    slideshowBack().disabled = getImage(ssii - 1) ? false : true;
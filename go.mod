@@ -9,6 +9,7 @@ require (
 	github.com/go-chi/httprate v0.9.0
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/schema v1.3.0
+	github.com/gorilla/websocket v1.5.1
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/kataras/jwt v0.1.12
 	github.com/mattn/go-sqlite3 v1.14.22
@@ -16,4 +17,7 @@ require (
 	golang.org/x/crypto v0.23.0
 )
 
-require github.com/cespare/xxhash/v2 v2.1.2 // indirect
+require (
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	golang.org/x/net v0.21.0 // indirect
+)
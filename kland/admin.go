@@ -0,0 +1,266 @@
+package kland
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/randomouscrap98/goldmonolith/utils"
+)
+
+const (
+	DefaultAuditCount = 100
+)
+
+// Something went wrong with an admin action that's the admin's fault
+type adminError struct {
+	message string
+}
+
+func (e *adminError) Error() string {
+	return e.message
+}
+
+func parseAdminId(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(r.FormValue(name), 10, 64)
+	if err != nil {
+		return 0, &adminError{message: fmt.Sprintf("bad %s", name)}
+	}
+	return id, nil
+}
+
+// Whether the request has the admin id. Reads only take it from the cookie, so
+// it never shows up in urls (and so logs). Everything else has to have it in the
+// form body: other sites can make your browser send the cookie, but they don't
+// know the id to put in the form
+func (kctx *KlandContext) IsAdmin(r *http.Request) bool {
+	if kctx.config.AdminId == "" {
+		return false
+	}
+	adminid := ""
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		admincookie, err := r.Cookie(AdminIdKey)
+		if err == nil {
+			adminid = admincookie.Value
+		}
+	} else {
+		adminid = r.PostFormValue("adminid")
+	}
+	return subtle.ConstantTimeCompare([]byte(adminid), []byte(kctx.config.AdminId)) == 1
+}
+
+// Reject the request if it doesn't have the admin id. Returns whether it was
+// rejected (the error is already written)
+func (kctx *KlandContext) CheckNotAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !kctx.IsAdmin(r) {
+		http.Error(w, "Admin id required", http.StatusUnauthorized)
+		return true
+	}
+	return false
+}
+
+// Whether the redirect stays on this site (a plain path like /thread/1). Anything
+// else would let links to us send people anywhere
+func IsLocalRedirect(redirect string) bool {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return false
+	}
+	parsed, err := url.Parse(redirect)
+	return err == nil && parsed.Scheme == "" && parsed.Host == ""
+}
+
+// After an admin form is handled, go back where they were (if they said and it's
+// on this site) or just say it worked
+func (kctx *KlandContext) FinishAdminAction(w http.ResponseWriter, r *http.Request, message string) {
+	redirect := r.FormValue("redirect")
+	if IsLocalRedirect(redirect) {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+	} else {
+		w.Write([]byte(message))
+	}
+}
+
+// Look up a single post, NotFoundError if it's not there
+func getSinglePost(db utils.DbLike, pid int64) (*Post, error) {
+	post, err := utils.FirstErr(GetPostsById(db, []int64{pid}))
+	if err == nil && post == nil {
+		err = &utils.NotFoundError{Message: fmt.Sprintf("post %d", pid)}
+	}
+	return post, err
+}
+
+// Write the right response for an error from an admin action
+func reportAdminError(w http.ResponseWriter, action string, err error) {
+	switch err.(type) {
+	case *adminError:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case *utils.NotFoundError:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		log.Printf("ERROR RUNNING ADMIN ACTION %s: %s", action, err)
+		http.Error(w, "Error running admin action", http.StatusInternalServerError)
+	}
+}
+
+// Run the admin action given in the form 'action' and write it to the audit
+// table. The admin check must already be done. Actions are:
+//   - deletepost (pid): removes the post and its image file (if no other post uses it) forever
+//   - deletethread (tid): hides the thread from the thread list
+//   - moveimage (pid, bucket): puts the post in the bucket (empty is the main bucket)
+//   - rehashbucket (bucket): gives the bucket a new readonly link
+func (kctx *KlandContext) RunAdminAction(w http.ResponseWriter, r *http.Request) {
+	action := r.FormValue("action")
+	db, err := kctx.config.OpenDb()
+	if err != nil {
+		reportDbError(err, w)
+		return
+	}
+	defer db.Close()
+
+	// Buckets have to be created outside the transaction (it uses the db itself).
+	// Check the post first, a bad one shouldn't leave an empty bucket behind
+	var bucket Thread
+	if action == "moveimage" {
+		var pid int64
+		pid, err = parseAdminId(r, "pid")
+		if err == nil {
+			_, err = getSinglePost(db, pid)
+		}
+		if err != nil {
+			reportAdminError(w, action, err)
+			return
+		}
+		bucket, err = kctx.GetOrCreateBucketThread(db, strings.TrimSpace(r.FormValue("bucket")))
+		if err != nil {
+			log.Printf("Couldn't get bucket thread for move: %s", err)
+			http.Error(w, "Couldn't get bucket thread", http.StatusInternalServerError)
+			return
+		}
+	} else if action == "deletepost" {
+		// Uploads hold this until their post is saved, so nobody can start using
+		// the image between counting its posts and removing the file
+		kctx.pinsmu.Lock()
+		defer kctx.pinsmu.Unlock()
+	} else if action == "rehashbucket" {
+		// Hashes aren't generated under any lock of their own
+		kctx.tinsmu.Lock()
+		defer kctx.tinsmu.Unlock()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		reportDbError(err, w)
+		return
+	}
+	defer tx.Rollback()
+
+	detail, removeImage, err := kctx.runAdminActionTx(tx, action, r, bucket)
+	if err == nil {
+		err = InsertAudit(tx, action, kctx.GetIpAddress(r), detail)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		reportAdminError(w, action, err)
+		return
+	}
+	log.Printf("Admin action %s: %s", action, detail)
+
+	// Only get rid of the file once the post is definitely gone
+	if removeImage != "" {
+		err = os.Remove(filepath.Join(kctx.config.ImagePath(), removeImage))
+		if err != nil {
+			log.Printf("Couldn't remove image %s for deleted post: %s", removeImage, err)
+		}
+		kctx.RemoveThumbnail(removeImage)
+	}
+	kctx.FinishAdminAction(w, r, detail)
+}
+
+// The database part of RunAdminAction. Returns the audit detail and the image
+// which should be removed after it's committed (if any)
+func (kctx *KlandContext) runAdminActionTx(tx *sql.Tx, action string, r *http.Request, bucket Thread) (string, string, error) {
+	switch action {
+	case "deletepost":
+		pid, err := parseAdminId(r, "pid")
+		if err != nil {
+			return "", "", err
+		}
+		post, err := getSinglePost(tx, pid)
+		if err != nil {
+			return "", "", err
+		}
+		err = DeletePost(tx, pid)
+		if err != nil {
+			return "", "", err
+		}
+		detail := fmt.Sprintf("deleted post %d (thread %d, ip %s, image '%s')", pid, post.Tid, post.Ipaddress, post.Image)
+		if post.Image == "" {
+			return detail, "", nil
+		}
+		// Identical uploads share the file, it only goes once nobody uses it
+		count, err := CountImagePosts(tx, post.Image)
+		if err != nil {
+			return "", "", err
+		}
+		if count > 0 {
+			return fmt.Sprintf("%s, image kept for %d other posts", detail, count), "", nil
+		}
+		err = DeleteFileHash(tx, post.Image)
+		if err != nil {
+			return "", "", err
+		}
+		return detail, post.Image, nil
+	case "deletethread":
+		tid, err := parseAdminId(r, "tid")
+		if err != nil {
+			return "", "", err
+		}
+		found, err := DeleteThread(tx, tid)
+		if err != nil {
+			return "", "", err
+		}
+		if !found {
+			return "", "", &utils.NotFoundError{Message: fmt.Sprintf("thread %d", tid)}
+		}
+		return fmt.Sprintf("deleted thread %d", tid), "", nil
+	case "moveimage":
+		pid, err := parseAdminId(r, "pid")
+		if err != nil {
+			return "", "", err
+		}
+		post, err := getSinglePost(tx, pid)
+		if err != nil {
+			return "", "", err
+		}
+		err = MovePost(tx, pid, bucket.Tid)
+		if err != nil {
+			return "", "", err
+		}
+		return fmt.Sprintf("moved post %d from thread %d to %s (%d)", pid, post.Tid, bucket.Subject, bucket.Tid), "", nil
+	case "rehashbucket":
+		subject := BucketSubject(strings.TrimSpace(r.FormValue("bucket")))
+		thread, err := utils.FirstErr(GetThreadsByField(tx, "subject", subject))
+		if err != nil {
+			return "", "", err
+		}
+		if thread == nil {
+			return "", "", &utils.NotFoundError{Message: subject}
+		}
+		hash, err := UpdateThreadHash(tx, thread.Tid)
+		if err != nil {
+			return "", "", err
+		}
+		return fmt.Sprintf("rehashed %s (%d) from '%s' to '%s'", subject, thread.Tid, thread.Hash, hash), "", nil
+	default:
+		return "", "", &adminError{message: fmt.Sprintf("unknown admin action '%s'", action)}
+	}
+}
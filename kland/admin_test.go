@@ -0,0 +1,270 @@
+package kland
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/randomouscrap98/goldmonolith/utils"
+)
+
+// Send the form with just the admin cookie (what the browser sends by itself).
+// Redirects aren't followed
+func requestWithAdminCookie(t *testing.T, context *KlandContext, method string, url string, form url.Values) *http.Response {
+	request, err := http.NewRequest(method, url, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("Error creating request: %s", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.AddCookie(&http.Cookie{Name: AdminIdKey, Value: context.config.AdminId})
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("Error sending admin request: %s", err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+// Run an admin action the way the site does it: with the admin cookie and the
+// admin id in the form
+func postAdmin(t *testing.T, context *KlandContext, server string, fields map[string]string) int {
+	form := url.Values{}
+	for k, v := range fields {
+		form.Set(k, v)
+	}
+	form.Set("adminid", context.config.AdminId)
+	return requestWithAdminCookie(t, context, "POST", server+"/admin", form).StatusCode
+}
+
+func TestIsLocalRedirect(t *testing.T) {
+	for redirect, expected := range map[string]bool{
+		"/thread/1#p2":         true,
+		"/image?bucket=x":      true,
+		"":                     false,
+		"thread/1":             false,
+		"//evil.example/x":     false,
+		"/\\evil.example/x":    false,
+		"https://evil.example": false,
+		"javascript:alert(1)":  false,
+	} {
+		if IsLocalRedirect(redirect) != expected {
+			t.Errorf("Expected IsLocalRedirect(%q) to be %t", redirect, expected)
+		}
+	}
+}
+
+func TestDefaultDataAdmin(t *testing.T) {
+	context := newTestContext("defaultdataadmin")
+	request := httptest.NewRequest("GET", "/", nil)
+	if context.GetDefaultData(request)[IsAdminKey] != false {
+		t.Fatalf("No cookie shouldn't be admin")
+	}
+	request.AddCookie(&http.Cookie{Name: AdminIdKey, Value: context.config.AdminId})
+	if context.GetDefaultData(request)[IsAdminKey] != true {
+		t.Fatalf("Admin cookie should be admin")
+	}
+	// Without an admin id, nobody is admin (not even people without a cookie)
+	context.config.AdminId = ""
+	if context.GetDefaultData(httptest.NewRequest("GET", "/", nil))[IsAdminKey] != false {
+		t.Fatalf("Empty admin id shouldn't make everyone admin")
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	context, server := getTestServer(t, "adminactions")
+	db, err := context.config.OpenDb()
+	if err != nil {
+		t.Fatalf("Error opening db: %s", err)
+	}
+	defer db.Close()
+
+	// Set up a thread with an image post and a bucket with an image
+	response := postForm(t, server.URL+"/submitpost", map[string]string{"subject": "thread", "shitcontent": "abuse"},
+		map[string][]byte{"image": testPng(t)})
+	if response.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected redirect on new thread, got %d", response.StatusCode)
+	}
+	threads, err := GetAllThreads(db)
+	if err != nil || len(threads) != 1 {
+		t.Fatalf("Expected one thread: %v (%v)", threads, err)
+	}
+	tid := threads[0].Tid
+	response = postForm(t, server.URL+"/uploadimage", map[string]string{"bucket": "first"}, map[string][]byte{"image": testPngSize(t, 8)})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 on upload, got %d", response.StatusCode)
+	}
+	first, err := context.GetOrCreateBucketThread(db, "first")
+	if err != nil {
+		t.Fatalf("Error getting bucket: %s", err)
+	}
+	bucketPosts, err := GetPostsInThread(db, first.Tid)
+	if err != nil || len(bucketPosts) != 1 {
+		t.Fatalf("Expected one bucket post: %v (%v)", bucketPosts, err)
+	}
+
+	// Not admin, no go
+	response = postForm(t, server.URL+"/admin", map[string]string{"action": "deletethread", "tid": fmt.Sprint(tid)}, nil)
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without admin, got %d", response.StatusCode)
+	}
+	// The cookie alone isn't enough to post, other sites could make browsers send it
+	response = requestWithAdminCookie(t, context, "POST", server.URL+"/admin", url.Values{"action": {"deletethread"}, "tid": {fmt.Sprint(tid)}})
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with only the admin cookie, got %d", response.StatusCode)
+	}
+	if status := postAdmin(t, context, server.URL, map[string]string{"action": "nonsense"}); status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 on unknown action, got %d", status)
+	}
+	if status := postAdmin(t, context, server.URL, map[string]string{"action": "deletepost", "pid": "9999"}); status != http.StatusNotFound {
+		t.Fatalf("Expected 404 on missing post, got %d", status)
+	}
+
+	// Delete the post, the image file goes with it
+	posts, err := GetPostsInThread(db, tid)
+	if err != nil || len(posts) != 1 {
+		t.Fatalf("Expected one post: %v (%v)", posts, err)
+	}
+	imagePath := filepath.Join(context.config.ImagePath(), posts[0].Image)
+	if status := postAdmin(t, context, server.URL, map[string]string{"action": "deletepost", "pid": fmt.Sprint(posts[0].Pid)}); status != http.StatusOK {
+		t.Fatalf("Expected 200 deleting post, got %d", status)
+	}
+	posts, err = GetPostsInThread(db, tid)
+	if err != nil || len(posts) != 0 {
+		t.Fatalf("Expected post gone: %v (%v)", posts, err)
+	}
+	if _, err := os.Stat(imagePath); !os.IsNotExist(err) {
+		t.Fatalf("Expected image file gone, got %v", err)
+	}
+
+	// Soft delete the thread; it's still there, just hidden
+	if status := postAdmin(t, context, server.URL, map[string]string{"action": "deletethread", "tid": fmt.Sprint(tid)}); status != http.StatusOK {
+		t.Fatalf("Expected 200 deleting thread, got %d", status)
+	}
+	threads, err = GetAllThreads(db)
+	if err != nil || len(threads) != 0 {
+		t.Fatalf("Expected no visible threads: %v (%v)", threads, err)
+	}
+	thread, err := utils.FirstErr(GetThreadsById(db, []int64{tid}))
+	if err != nil || thread == nil || !thread.Deleted {
+		t.Fatalf("Expected deleted thread to remain: %v (%v)", thread, err)
+	}
+
+	// Moving a post that isn't there doesn't make the bucket
+	if status := postAdmin(t, context, server.URL, map[string]string{"action": "moveimage", "pid": "9999", "bucket": "nobucket"}); status != http.StatusNotFound {
+		t.Fatalf("Expected 404 moving missing post, got %d", status)
+	}
+	if status := postAdmin(t, context, server.URL, map[string]string{"action": "moveimage", "pid": "bad", "bucket": "nobucket"}); status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 moving bad pid, got %d", status)
+	}
+	nobucket, err := GetThreadsByField(db, "subject", BucketSubject("nobucket"))
+	if err != nil || len(nobucket) != 0 {
+		t.Fatalf("Expected no bucket from failed moves: %v (%v)", nobucket, err)
+	}
+
+	// Move the bucket image to a brand new bucket
+	if status := postAdmin(t, context, server.URL, map[string]string{"action": "moveimage", "pid": fmt.Sprint(bucketPosts[0].Pid), "bucket": "second"}); status != http.StatusOK {
+		t.Fatalf("Expected 200 moving post, got %d", status)
+	}
+	second, err := context.GetOrCreateBucketThread(db, "second")
+	if err != nil {
+		t.Fatalf("Error getting bucket: %s", err)
+	}
+	moved, err := GetPostsInThread(db, second.Tid)
+	if err != nil || len(moved) != 1 || moved[0].Pid != bucketPosts[0].Pid {
+		t.Fatalf("Expected post moved: %v (%v)", moved, err)
+	}
+
+	// New readonly link for the bucket
+	if status := postAdmin(t, context, server.URL, map[string]string{"action": "rehashbucket", "bucket": "second"}); status != http.StatusOK {
+		t.Fatalf("Expected 200 rehashing bucket, got %d", status)
+	}
+	rehashed, err := utils.FirstErr(GetThreadsById(db, []int64{second.Tid}))
+	if err != nil || rehashed.Hash == "" || rehashed.Hash == second.Hash {
+		t.Fatalf("Expected new hash: %v vs %s (%v)", rehashed, second.Hash, err)
+	}
+	if status := postAdmin(t, context, server.URL, map[string]string{"action": "rehashbucket", "bucket": "nowhere"}); status != http.StatusNotFound {
+		t.Fatalf("Expected 404 rehashing missing bucket, got %d", status)
+	}
+
+	// Everything that worked is in the audit log, newest first
+	audits, err := GetRecentAudits(db, 10)
+	if err != nil {
+		t.Fatalf("Error getting audits: %s", err)
+	}
+	actions := make([]string, len(audits))
+	for i := range audits {
+		actions[i] = audits[i].Action
+	}
+	if strings.Join(actions, ",") != "rehashbucket,moveimage,deletethread,deletepost" {
+		t.Fatalf("Unexpected audit log: %v", audits)
+	}
+	if audits[0].Ipaddress != "unknown" || !strings.Contains(audits[0].Detail, rehashed.Hash) {
+		t.Fatalf("Unexpected audit: %v", audits[0])
+	}
+}
+
+func TestAdminDeleteSharedImage(t *testing.T) {
+	context, server := getTestServer(t, "admindeleteshared")
+	db, err := context.config.OpenDb()
+	if err != nil {
+		t.Fatalf("Error opening db: %s", err)
+	}
+	defer db.Close()
+	// The same image in two buckets is one file, but each bucket gets its post
+	links := make([]string, 0)
+	for _, bucket := range []string{"one", "two"} {
+		response := postForm(t, server.URL+"/uploadimage", map[string]string{"bucket": bucket}, map[string][]byte{"image": testPng(t)})
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 on upload, got %d", response.StatusCode)
+		}
+		link, _ := io.ReadAll(response.Body)
+		links = append(links, string(link))
+	}
+	if links[0] != links[1] {
+		t.Fatalf("Expected identical uploads to share a link: %v", links)
+	}
+	pids := make([]int64, 0)
+	for _, bucket := range []string{"one", "two"} {
+		thread, err := context.GetOrCreateBucketThread(db, bucket)
+		if err != nil {
+			t.Fatalf("Error getting bucket: %s", err)
+		}
+		posts, err := GetPostsInThread(db, thread.Tid)
+		if err != nil || len(posts) != 1 {
+			t.Fatalf("Expected one post in bucket %s: %v (%v)", bucket, posts, err)
+		}
+		pids = append(pids, posts[0].Pid)
+	}
+	imagePath := filepath.Join(context.config.ImagePath(), filepath.Base(links[0]))
+	// The file stays until the last post using it is gone
+	if status := postAdmin(t, context, server.URL, map[string]string{"action": "deletepost", "pid": fmt.Sprint(pids[0])}); status != http.StatusOK {
+		t.Fatalf("Expected 200 deleting post, got %d", status)
+	}
+	if _, err := os.Stat(imagePath); err != nil {
+		t.Fatalf("Expected shared image to stay: %s", err)
+	}
+	if status := postAdmin(t, context, server.URL, map[string]string{"action": "deletepost", "pid": fmt.Sprint(pids[1])}); status != http.StatusOK {
+		t.Fatalf("Expected 200 deleting post, got %d", status)
+	}
+	if _, err := os.Stat(imagePath); !os.IsNotExist(err) {
+		t.Fatalf("Expected image gone after last post, got %v", err)
+	}
+	// And uploading it again works like it's brand new
+	response := postForm(t, server.URL+"/uploadimage", map[string]string{"bucket": "one"}, map[string][]byte{"image": testPng(t)})
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 on upload, got %d", response.StatusCode)
+	}
+	link, _ := io.ReadAll(response.Body)
+	if _, err := os.Stat(filepath.Join(context.config.ImagePath(), filepath.Base(string(link)))); err != nil {
+		t.Fatalf("Expected reuploaded image to exist: %s", err)
+	}
+}
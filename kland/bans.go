@@ -0,0 +1,156 @@
+package kland
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/randomouscrap98/goldmonolith/utils"
+)
+
+// A ban ready for matching. Old bans which aren't real ips or ranges only match
+// the exact string
+type banRange struct {
+	raw    string
+	prefix netip.Prefix // Invalid if raw isn't an ip or range
+}
+
+// Turn whatever the admin typed in into the form stored in the db: a plain ip
+// for single addresses, or the masked CIDR range
+func NormalizeBanRange(banrange string) (string, error) {
+	banrange = strings.TrimSpace(banrange)
+	if strings.Contains(banrange, "/") {
+		prefix, err := netip.ParsePrefix(banrange)
+		if err != nil {
+			return "", fmt.Errorf("bad CIDR range: %s", banrange)
+		}
+		return prefix.Masked().String(), nil
+	}
+	addr, err := netip.ParseAddr(banrange)
+	if err != nil {
+		return "", fmt.Errorf("bad ip address: %s", banrange)
+	}
+	return addr.Unmap().String(), nil
+}
+
+func parseBanRange(banrange string) banRange {
+	result := banRange{raw: banrange}
+	prefix, err := netip.ParsePrefix(banrange)
+	if err == nil {
+		result.prefix = prefix.Masked()
+	} else if addr, err := netip.ParseAddr(banrange); err == nil {
+		addr = addr.Unmap()
+		result.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	return result
+}
+
+// Whether the ip (as given by GetIpAddress) falls in the ban
+func (br *banRange) Matches(ip string) bool {
+	if ip == br.raw {
+		return true
+	}
+	if !br.prefix.IsValid() {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return br.prefix.Contains(addr.Unmap())
+}
+
+// Reload the bans from the db. Bans are checked on every upload and every post
+// render, so they're kept in memory; call this after changing them
+func (kctx *KlandContext) RefreshBans() error {
+	db, err := kctx.config.OpenDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	bans, err := GetAllBans(db)
+	if err != nil {
+		return err
+	}
+	ranges := make([]banRange, len(bans))
+	for i := range bans {
+		ranges[i] = parseBanRange(bans[i].Range)
+	}
+	kctx.bansmu.Lock()
+	defer kctx.bansmu.Unlock()
+	kctx.bans = ranges
+	return nil
+}
+
+// Whether the ip (as given by GetIpAddress) is in any ban
+func (kctx *KlandContext) IsBanned(ip string) bool {
+	kctx.bansmu.RLock()
+	defer kctx.bansmu.RUnlock()
+	for i := range kctx.bans {
+		if kctx.bans[i].Matches(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reject the request if the user is banned. Returns whether they were (the
+// error is already written)
+func (kctx *KlandContext) CheckBanned(w http.ResponseWriter, r *http.Request) bool {
+	ip := kctx.GetIpAddress(r)
+	if kctx.IsBanned(ip) {
+		log.Printf("Rejected request from banned ip %s", ip)
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// Add or remove the ban given in the form 'range' (audited as the given action),
+// then reload the bans. With allowRaw, ranges that don't parse are used exactly
+// as given instead of rejected (old bans can be anything, they still need removing)
+func (kctx *KlandContext) UpdateBan(w http.ResponseWriter, r *http.Request, action string, allowRaw bool, update func(utils.DbLike, string) error) {
+	banrange, err := NormalizeBanRange(r.FormValue("range"))
+	if err != nil && allowRaw {
+		banrange, err = r.FormValue("range"), nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	db, err := kctx.config.OpenDb()
+	if err != nil {
+		reportDbError(err, w)
+		return
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		reportDbError(err, w)
+		return
+	}
+	defer tx.Rollback()
+	err = update(tx, banrange)
+	if _, ok := err.(*utils.NotFoundError); ok {
+		http.Error(w, "Ban not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = InsertAudit(tx, action, kctx.GetIpAddress(r), banrange)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err == nil {
+		err = kctx.RefreshBans()
+	}
+	if err != nil {
+		log.Printf("ERROR UPDATING BAN: %s", err)
+		http.Error(w, "Error updating ban", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Updated ban on %s", banrange)
+	kctx.FinishAdminAction(w, r, banrange)
+}
@@ -0,0 +1,166 @@
+package kland
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestNormalizeBanRange(t *testing.T) {
+	good := map[string]string{
+		"1.2.3.4":           "1.2.3.4",
+		" 1.2.3.4 ":         "1.2.3.4",
+		"1.2.3.4/16":        "1.2.0.0/16",
+		"::ffff:1.2.3.4":    "1.2.3.4",
+		"2001:db8::1/32":    "2001:db8::/32",
+		"2001:0db8:0:0::01": "2001:db8::1",
+	}
+	for in, expected := range good {
+		out, err := NormalizeBanRange(in)
+		if err != nil {
+			t.Fatalf("Error normalizing %s: %s", in, err)
+		}
+		if out != expected {
+			t.Fatalf("Expected %s to normalize to %s, got %s", in, expected, out)
+		}
+	}
+	for _, bad := range []string{"", "unknown", "1.2.3", "1.2.3.4/33", "1.2.3.4/"} {
+		_, err := NormalizeBanRange(bad)
+		if err == nil {
+			t.Fatalf("Expected error normalizing %q", bad)
+		}
+	}
+}
+
+func TestBanRangeMatches(t *testing.T) {
+	matches := []struct {
+		banrange string
+		ip       string
+		expected bool
+	}{
+		{"1.2.3.4", "1.2.3.4", true},
+		{"1.2.3.4", "1.2.3.5", false},
+		{"1.2.0.0/16", "1.2.200.7", true},
+		{"1.2.0.0/16", "1.3.0.0", false},
+		{"1.2.0.0/16", "::ffff:1.2.3.4", true},
+		{"2001:db8::/32", "2001:db8:1::5", true},
+		{"2001:db8::/32", "1.2.3.4", false},
+		{"1.2.0.0/16", "unknown", false},
+		{"unknown", "unknown", true}, // Weird old bans still work exactly
+	}
+	for _, m := range matches {
+		br := parseBanRange(m.banrange)
+		if br.Matches(m.ip) != m.expected {
+			t.Fatalf("Expected ban %s matching %s to be %t", m.banrange, m.ip, m.expected)
+		}
+	}
+}
+
+func TestBanEndpoints(t *testing.T) {
+	context, server := getTestServer(t, "banendpoints")
+	adminid := context.config.AdminId
+	// Only admins can touch bans
+	response := postForm(t, server.URL+"/bans", map[string]string{"range": "1.2.0.0/16"}, nil)
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 adding ban without admin id, got %d", response.StatusCode)
+	}
+	// Redirects off the site are ignored
+	response = postForm(t, server.URL+"/bans", map[string]string{"adminid": adminid, "range": "1.2.3.4/16", "note": "spammer", "redirect": "//evil.example"}, nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 adding ban, got %d", response.StatusCode)
+	}
+	response = postForm(t, server.URL+"/bans", map[string]string{"adminid": adminid, "range": "nonsense"}, nil)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 adding bad ban, got %d", response.StatusCode)
+	}
+	// The ban shows up in the list (with the range normalized)
+	// Reads only take the cookie, the id shouldn't end up in urls
+	listed, err := http.Get(fmt.Sprintf("%s/bans?adminid=%s", server.URL, adminid))
+	if err != nil {
+		t.Fatalf("Error listing bans: %s", err)
+	}
+	listed.Body.Close()
+	if listed.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 listing bans with id in query, got %d", listed.StatusCode)
+	}
+	listed = requestWithAdminCookie(t, context, "GET", server.URL+"/bans", nil)
+	var bans []Ban
+	err = json.NewDecoder(listed.Body).Decode(&bans)
+	if err != nil {
+		t.Fatalf("Error decoding bans: %s", err)
+	}
+	if len(bans) != 1 || bans[0].Range != "1.2.0.0/16" || bans[0].Note != "spammer" {
+		t.Fatalf("Unexpected bans: %v", bans)
+	}
+	// Everything from inside the range is rejected (the test posts come from 1.2.3.4)
+	response = postForm(t, server.URL+"/submitpost", map[string]string{"subject": "hi", "shitcontent": "spam"}, nil)
+	if response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 posting while banned, got %d", response.StatusCode)
+	}
+	response = postForm(t, server.URL+"/uploadtext", map[string]string{"text": "spam"}, nil)
+	if response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 uploading text while banned, got %d", response.StatusCode)
+	}
+	response = postForm(t, server.URL+"/uploadimage", nil, map[string][]byte{"image": testPng(t)})
+	if response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 uploading image while banned, got %d", response.StatusCode)
+	}
+	// Removing the ban lets them post again, and removing it twice is an error
+	response = postForm(t, server.URL+"/bans/remove", map[string]string{"adminid": adminid, "range": "1.2.0.0/16", "redirect": "/image"}, nil)
+	if response.StatusCode != http.StatusSeeOther || response.Header.Get("Location") != "/image" {
+		t.Fatalf("Expected redirect removing ban, got %d %s", response.StatusCode, response.Header.Get("Location"))
+	}
+	response = postForm(t, server.URL+"/bans/remove", map[string]string{"adminid": adminid, "range": "1.2.0.0/16"}, nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 removing missing ban, got %d", response.StatusCode)
+	}
+	response = postForm(t, server.URL+"/submitpost", map[string]string{"subject": "hi", "shitcontent": "not spam"}, nil)
+	if response.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected redirect posting after unban, got %d", response.StatusCode)
+	}
+	// Ban changes are audited
+	db, err := context.config.OpenDb()
+	if err != nil {
+		t.Fatalf("Error opening db: %s", err)
+	}
+	defer db.Close()
+	audits, err := GetRecentAudits(db, 10)
+	if err != nil || len(audits) != 2 || audits[0].Action != "removeban" || audits[1].Detail != "1.2.0.0/16" {
+		t.Fatalf("Unexpected audits: %v (%v)", audits, err)
+	}
+	// Old bans which were never real ranges can still be removed
+	err = InsertBan(db, "not an ip", "")
+	if err != nil {
+		t.Fatalf("Error inserting legacy ban: %s", err)
+	}
+	response = postForm(t, server.URL+"/bans/remove", map[string]string{"adminid": adminid, "range": "not an ip"}, nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 removing legacy ban, got %d", response.StatusCode)
+	}
+	bans, err = GetAllBans(db)
+	if err != nil || len(bans) != 0 {
+		t.Fatalf("Expected legacy ban to be removed: %v (%v)", bans, err)
+	}
+}
+
+func TestIsBannedRendered(t *testing.T) {
+	context := newTestContext("isbannedrendered")
+	db, err := context.config.OpenDb()
+	if err != nil {
+		t.Fatalf("Error opening db: %s", err)
+	}
+	defer db.Close()
+	err = InsertBan(db, "5.6.7.8", "")
+	if err != nil {
+		t.Fatalf("Error inserting ban: %s", err)
+	}
+	err = context.RefreshBans()
+	if err != nil {
+		t.Fatalf("Error refreshing bans: %s", err)
+	}
+	views := context.ConvertPostResult([]Post{{Ipaddress: "5.6.7.8"}, {Ipaddress: "5.6.7.9"}}, nil, nil)
+	if !views[0].IsBanned || views[1].IsBanned {
+		t.Fatalf("IsBanned set wrong: %v", views)
+	}
+}
@@ -94,6 +94,11 @@ func (c *Config) TextPath() string {
 	return filepath.Join(c.DataPath, "text")
 }
 
+// Thumbnails are generated as needed, so they don't count against MaxTotalFileCount
+func (c *Config) ThumbnailPath() string {
+	return filepath.Join(c.DataPath, "thumbnails")
+}
+
 func (c *Config) OpenDb() (*sql.DB, error) {
 	return sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d", c.DatabasePath(), BusyTimeout))
 }
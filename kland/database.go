@@ -17,11 +17,19 @@ const (
 	OrphanedPostContent  = "orphanedPost"
 )
 
-// NOTE: Ban isn't used
 type Ban struct {
-	range_  string //key?
-	created string // FORMAT: 2023-01-02 HH:MM:SS.MS
-	note    string // was nullable
+	Range   string `json:"range"`   // Either a single ip or a CIDR range
+	Created string `json:"created"` // time.Time in TimeFormat format (old bans have milliseconds)
+	Note    string `json:"note"`    // nullable in db
+}
+
+// A record of something an admin did
+type Audit struct {
+	Aid       int64  `json:"aid"`
+	Created   string `json:"created"` // time.Time in TimeFormat format
+	Action    string `json:"action"`
+	Ipaddress string `json:"ipaddress"`
+	Detail    string `json:"detail"`
 }
 
 type Post struct {
@@ -77,11 +85,24 @@ func CreateTables(db utils.DbLike) error {
       rid integer primary key,
       oldhash text not null,
       newhash next not null
+    );`,
+		`create table if not exists audit (
+      aid integer primary key,
+      created text not null,
+      action text not null,
+      ipaddress text not null,
+      detail text not null
+    );`,
+		`create table if not exists filehashes (
+      filename text primary key,
+      sha256 text not null
     );`,
 		`create index if not exists idx_threads_subject on threads(subject);`,
 		`create index if not exists idx_threads_hash on threads(hash);`,
 		`create index if not exists idx_posts_tid on posts(tid);`,
 		`create index if not exists idx_rehashes_oldhash_newhash on rehashes(oldhash, newhash);`,
+		`create index if not exists idx_filehashes_sha256 on filehashes(sha256);`,
+		`create index if not exists idx_posts_image on posts(image);`,
 	}
 	return utils.CreateTables_VersionedDb(allSql, db, DatabaseVersion)
 }
@@ -155,6 +176,37 @@ func InsertBucketThread(db utils.DbLike, subject string) (int64, string, error)
 	return id, hash, nil
 }
 
+// Add a regular thread (one that shows up in the thread list). Returns the id
+// of the inserted thread
+func InsertThread(db utils.DbLike, subject string) (int64, error) {
+	result, err := db.Exec("INSERT INTO threads(subject, created, deleted) VALUES (?,?,?)",
+		subject, time.Now().Format(TimeFormat), false)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Empty strings go in as NULL for the nullable post fields
+func nullIfEmpty(value string) any {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+// Add a regular post to the thread given in the post. Pid and Created are ignored
+// (they're generated). Returns the id of the post as inserted
+func InsertPost(db utils.DbLike, post *Post) (int64, error) {
+	result, err := db.Exec("INSERT INTO posts(content, created, ipaddress, username, tripraw, image, tid, options) VALUES (?,?,?,?,?,?,?,?)",
+		post.Content, time.Now().Format(TimeFormat), post.Ipaddress, nullIfEmpty(post.Username),
+		nullIfEmpty(post.Tripraw), nullIfEmpty(post.Image), post.Tid, post.Options)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
 // Add a post from the given ip with the given file to the given thread. Returns the
 // id of the post as inserted
 func InsertImagePost(db utils.DbLike, ip string, filename string, tid int64) (int64, error) {
@@ -299,6 +351,14 @@ func GetPostsInThread(db utils.DbLike, tid int64) ([]Post, error) {
 		orderPid, []any{tid})
 }
 
+func GetPostsById(db utils.DbLike, ids []int64) ([]Post, error) {
+	return QueryPosts(db,
+		func(t string) string {
+			return fmt.Sprintf("WHERE %s.pid IN (%s)", t, utils.SliceToPlaceholder(ids))
+		},
+		orderPid, utils.SliceToAny(ids))
+}
+
 func GetPaginatedPosts(db utils.DbLike, tid int64, page int, perpage int) ([]Post, error) {
 	return QueryPosts(db,
 		func(t string) string {
@@ -329,6 +389,139 @@ func AddRehash(db *sql.DB, p *Post, newimage string, newtag string) error {
 	return tx.Commit()
 }
 
+// Hide a regular thread from the thread list. Returns whether the thread existed
+func DeleteThread(db utils.DbLike, tid int64) (bool, error) {
+	result, err := db.Exec("UPDATE threads SET deleted=1 WHERE tid=?", tid)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+// Permanently remove the post (NOT the image file, that's up to you)
+func DeletePost(db utils.DbLike, pid int64) error {
+	_, err := db.Exec("DELETE FROM posts WHERE pid=?", pid)
+	return err
+}
+
+// Put the post in a different thread (usually a bucket)
+func MovePost(db utils.DbLike, pid int64, tid int64) error {
+	_, err := db.Exec("UPDATE posts SET tid=? WHERE pid=?", tid, pid)
+	return err
+}
+
+// Remember the hash of a stored image so identical uploads can reuse it
+func InsertFileHash(db utils.DbLike, filename string, sha256 string) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO filehashes(filename, sha256) VALUES (?,?)", filename, sha256)
+	return err
+}
+
+// The stored image with this hash, or empty if there isn't one
+func LookupFileHash(db utils.DbLike, sha256 string) (string, error) {
+	var filename string
+	err := db.QueryRow("SELECT filename FROM filehashes WHERE sha256=? LIMIT 1", sha256).Scan(&filename)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return filename, err
+}
+
+// Images used by posts which don't have a hash yet (uploaded before there were hashes)
+func GetUnhashedImages(db utils.DbLike) ([]string, error) {
+	result := make([]string, 0)
+	rows, err := db.Query("SELECT DISTINCT image FROM posts WHERE image IS NOT NULL AND image != '' AND image NOT IN (SELECT filename FROM filehashes)")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var image string
+		err := rows.Scan(&image)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, image)
+	}
+	return result, nil
+}
+
+// Forget the hash for an image that's gone
+func DeleteFileHash(db utils.DbLike, filename string) error {
+	_, err := db.Exec("DELETE FROM filehashes WHERE filename=?", filename)
+	return err
+}
+
+// How many posts use the image. Identical uploads share a file, so this is how
+// you know whether it's safe to remove
+func CountImagePosts(db utils.DbLike, filename string) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM posts WHERE image=?", filename).Scan(&count)
+	return count, err
+}
+
+// Record an admin action
+func InsertAudit(db utils.DbLike, action string, ip string, detail string) error {
+	_, err := db.Exec("INSERT INTO audit(created, action, ipaddress, detail) VALUES (?,?,?,?)",
+		time.Now().Format(TimeFormat), action, ip, detail)
+	return err
+}
+
+// The most recent admin actions, newest first
+func GetRecentAudits(db utils.DbLike, limit int) ([]Audit, error) {
+	result := make([]Audit, 0)
+	rows, err := db.Query("SELECT aid, created, action, ipaddress, detail FROM audit ORDER BY aid DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		a := Audit{}
+		err := rows.Scan(&a.Aid, &a.Created, &a.Action, &a.Ipaddress, &a.Detail)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, a)
+	}
+	return result, nil
+}
+
+// Every ban, oldest first
+func GetAllBans(db utils.DbLike) ([]Ban, error) {
+	result := make([]Ban, 0)
+	rows, err := db.Query("SELECT range, created, COALESCE(note,'') FROM bans ORDER BY created, rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		b := Ban{}
+		err := rows.Scan(&b.Range, &b.Created, &b.Note)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+// Add a ban on the range. Banning a range again just updates the note
+func InsertBan(db utils.DbLike, banrange string, note string) error {
+	_, err := db.Exec("INSERT INTO bans(range, created, note) VALUES (?,?,?) ON CONFLICT(range) DO UPDATE SET note=excluded.note",
+		banrange, time.Now().Format(TimeFormat), nullIfEmpty(note))
+	return err
+}
+
+// Remove the ban on exactly this range. Returns whether there was one
+func DeleteBan(db utils.DbLike, banrange string) (bool, error) {
+	result, err := db.Exec("DELETE FROM bans WHERE range = ?", banrange)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
 // Simply return the newhash based on the old hash, if it exists...
 func LookupRehash(db utils.DbLike, hash string) (string, error) {
 	var newhash string
@@ -110,3 +110,82 @@ func TestInsertManyBucketThreads(t *testing.T) {
 		hashes[hash] = tid
 	}
 }
+
+func TestInsertPost(t *testing.T) {
+	db := getTestDb("insertpost", t)
+	defer db.Close()
+	tid, err := InsertThread(db, "a real thread")
+	if err != nil {
+		t.Fatalf("Error inserting thread: %s", err)
+	}
+	thread, err := utils.FirstErr(GetThreadsById(db, []int64{tid}))
+	if err != nil {
+		t.Fatalf("Error retrieving thread: %s", err)
+	}
+	if thread.Deleted || thread.Subject != "a real thread" {
+		t.Fatalf("Thread stored wrong: %v", thread)
+	}
+	pid, err := InsertPost(db, &Post{Tid: tid, Content: "hello", Ipaddress: "1.2.3.4", Tripraw: "secret"})
+	if err != nil {
+		t.Fatalf("Error inserting post: %s", err)
+	}
+	posts, err := GetPostsInThread(db, tid)
+	if err != nil {
+		t.Fatalf("Error retrieving posts: %s", err)
+	}
+	if len(posts) != 1 || posts[0].Pid != pid || posts[0].Content != "hello" || posts[0].Tripraw != "secret" {
+		t.Fatalf("Post stored wrong: %v", posts)
+	}
+	if posts[0].Username != "" || posts[0].Image != "" {
+		t.Fatalf("Empty fields should stay empty: %v", posts[0])
+	}
+	// Regular threads show up in the thread list, buckets don't
+	_, _, err = InsertBucketThread(db, "bucket")
+	if err != nil {
+		t.Fatalf("Error inserting bucket: %s", err)
+	}
+	threads, err := GetAllThreads(db)
+	if err != nil {
+		t.Fatalf("Error retrieving threads: %s", err)
+	}
+	if len(threads) != 1 || threads[0].Tid != tid || threads[0].PostCount != 1 {
+		t.Fatalf("Unexpected thread list: %v", threads)
+	}
+}
+
+func TestBans(t *testing.T) {
+	db := getTestDb("bans", t)
+	defer db.Close()
+	err := InsertBan(db, "1.2.3.4", "first")
+	if err != nil {
+		t.Fatalf("Error inserting ban: %s", err)
+	}
+	err = InsertBan(db, "10.0.0.0/8", "")
+	if err != nil {
+		t.Fatalf("Error inserting ban: %s", err)
+	}
+	// Banning again only changes the note
+	err = InsertBan(db, "1.2.3.4", "second")
+	if err != nil {
+		t.Fatalf("Error re-inserting ban: %s", err)
+	}
+	bans, err := GetAllBans(db)
+	if err != nil {
+		t.Fatalf("Error getting bans: %s", err)
+	}
+	if len(bans) != 2 || bans[0].Range != "1.2.3.4" || bans[0].Note != "second" || bans[1].Note != "" {
+		t.Fatalf("Unexpected bans: %v", bans)
+	}
+	found, err := DeleteBan(db, "1.2.3.4")
+	if err != nil || !found {
+		t.Fatalf("Expected to delete ban: %v", err)
+	}
+	found, err = DeleteBan(db, "1.2.3.4")
+	if err != nil || found {
+		t.Fatalf("Expected nothing to delete: %v", err)
+	}
+	bans, err = GetAllBans(db)
+	if err != nil || len(bans) != 1 {
+		t.Fatalf("Expected one ban left: %v (%v)", bans, err)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"mime"
 	"net/http"
 	"path"
 	"strconv"
@@ -23,6 +22,13 @@ const (
 	IsAdminKey    = "isAdmin"
 	PostStyleKey  = "postStyle"
 	ImageEndpoint = "/i"
+	TextEndpoint  = "/anm"
+	TextExtension = "txt"
+
+	MaxUsernameLength = 30
+	MaxTripLength     = 254
+	MaxSubjectLength  = 254
+	MaxContentLength  = 10000
 )
 
 func reportDbError(err error, w http.ResponseWriter) {
@@ -74,6 +80,16 @@ type UploadImageQuery struct {
 	bucket    string
 }
 
+// A regular post (or new thread if there's no tid)
+type SubmitPostQuery struct {
+	tid       int64
+	subject   string
+	username  string
+	trip      string
+	content   string
+	ipaddress string
+}
+
 func (kctx *KlandContext) GetHandler() (http.Handler, error) {
 	r := chi.NewRouter()
 
@@ -127,6 +143,52 @@ func (kctx *KlandContext) GetHandler() (http.Handler, error) {
 			kctx.RunTemplate("thread.tmpl", w, data)
 		})
 
+		r.Get(ThumbnailEndpoint+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+			kctx.ServeThumbnail(w, r, chi.URLParam(r, "name"))
+		})
+
+		r.Get("/bans", func(w http.ResponseWriter, r *http.Request) {
+			if kctx.CheckNotAdmin(w, r) {
+				return
+			}
+			db, err := kctx.config.OpenDb()
+			if err != nil {
+				reportDbError(err, w)
+				return
+			}
+			defer db.Close()
+			bans, err := GetAllBans(db)
+			if err != nil {
+				log.Printf("ERROR RETRIEVING BANS: %s", err)
+				http.Error(w, "Error retrieving bans", http.StatusInternalServerError)
+				return
+			}
+			utils.RespondJson(bans, w, nil)
+		})
+
+		r.Get("/audit", func(w http.ResponseWriter, r *http.Request) {
+			if kctx.CheckNotAdmin(w, r) {
+				return
+			}
+			count, err := strconv.Atoi(r.FormValue("count"))
+			if err != nil || count <= 0 {
+				count = DefaultAuditCount
+			}
+			db, err := kctx.config.OpenDb()
+			if err != nil {
+				reportDbError(err, w)
+				return
+			}
+			defer db.Close()
+			audits, err := GetRecentAudits(db, count)
+			if err != nil {
+				log.Printf("ERROR RETRIEVING AUDITS: %s", err)
+				http.Error(w, "Error retrieving audit log", http.StatusInternalServerError)
+				return
+			}
+			utils.RespondJson(audits, w, nil)
+		})
+
 		r.Get("/image", func(w http.ResponseWriter, r *http.Request) {
 			db, err := kctx.config.OpenDb()
 			if err != nil {
@@ -197,20 +259,131 @@ func (kctx *KlandContext) GetHandler() (http.Handler, error) {
 		r.Use(httprate.LimitByIP(kctx.config.UploadPerInterval, time.Duration(kctx.config.UploadLimitInterval)))
 
 		r.Post("/admin", func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, "(Admin action): Kland is limping along in readonly mode", http.StatusTeapot)
+			if kctx.CheckNotAdmin(w, r) {
+				return
+			}
+			kctx.RunAdminAction(w, r)
+		})
+		// Bans are by ip or CIDR range, and apply to all posting and uploading
+		r.Post("/bans", func(w http.ResponseWriter, r *http.Request) {
+			if kctx.CheckNotAdmin(w, r) {
+				return
+			}
+			kctx.UpdateBan(w, r, "addban", false, func(db utils.DbLike, banrange string) error {
+				return InsertBan(db, banrange, strings.TrimSpace(r.FormValue("note")))
+			})
+		})
+		r.Post("/bans/remove", func(w http.ResponseWriter, r *http.Request) {
+			if kctx.CheckNotAdmin(w, r) {
+				return
+			}
+			kctx.UpdateBan(w, r, "removeban", true, func(db utils.DbLike, banrange string) error {
+				found, err := DeleteBan(db, banrange)
+				if err == nil && !found {
+					err = &utils.NotFoundError{}
+				}
+				return err
+			})
 		})
 		r.Post("/submitpost", func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, "(Regular post): Kland is limping along in readonly mode", http.StatusTeapot)
+			if kctx.CheckBanned(w, r) {
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, int64(kctx.config.MaxImageSize))
+			r.ParseMultipartForm(kctx.config.MaxMultipartMemory)
+			form, err := kctx.ParseSubmitPostQuery(r)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Bad post: %s", err), http.StatusBadRequest)
+				return
+			}
+			db, err := kctx.config.OpenDb()
+			if err != nil {
+				reportDbError(err, w)
+				return
+			}
+			defer db.Close()
+			if form.tid != 0 {
+				// Deleted threads (which includes image buckets) can't be posted in
+				threads, err := GetThreadsById(db, []int64{form.tid})
+				if !checkSingleThread(threads, err, w) {
+					return
+				}
+				if threads[0].Deleted {
+					http.Error(w, "Thread not found", http.StatusNotFound)
+					return
+				}
+			}
+			var pid int64
+			writePost := func(image string) error {
+				tx, err := db.Begin()
+				if err != nil {
+					return err
+				}
+				defer tx.Rollback()
+				if form.tid == 0 {
+					form.tid, err = InsertThread(tx, form.subject)
+					if err != nil {
+						return err
+					}
+				}
+				pid, err = InsertPost(tx, &Post{
+					Tid:       form.tid,
+					Content:   form.content,
+					Ipaddress: form.ipaddress,
+					Username:  form.username,
+					Tripraw:   form.trip,
+					Image:     image,
+				})
+				if err != nil {
+					return err
+				}
+				return tx.Commit()
+			}
+			// Images are optional on posts. With an image, the post is written while
+			// the upload still holds the image (see RegisterUpload)
+			infile, _, err := r.FormFile("image")
+			if err == nil {
+				defer infile.Close()
+				if kctx.RegisterImageUpload(infile, w, writePost) == "" {
+					return
+				}
+			} else {
+				err = writePost("")
+				if err != nil {
+					log.Printf("CAN'T INSERT POST: %s", err)
+					http.Error(w, "Couldn't write post", http.StatusInternalServerError)
+					return
+				}
+			}
+			http.Redirect(w, r, fmt.Sprintf("%s/thread/%d#p%d", kctx.config.RootPath, form.tid, pid), http.StatusSeeOther)
 		})
+
+		// Animations from the makai animator are stored as plain text and served from /anm
 		r.Post("/uploadtext", func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, "(Animation uploader): Kland is limping along in readonly mode", http.StatusTeapot)
+			if kctx.CheckBanned(w, r) {
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, int64(kctx.config.MaxImageSize))
+			r.ParseMultipartForm(kctx.config.MaxMultipartMemory)
+			text := r.FormValue("text")
+			if text == "" {
+				http.Error(w, "You must provide the text", http.StatusBadRequest)
+				return
+			}
+			filename, err := kctx.RegisterText(strings.NewReader(text))
+			if err != nil {
+				log.Printf("Can't write text upload: %s", err)
+				http.Error(w, "Couldn't write file", http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(kctx.FullTextLink(filename)))
 		})
 
 		r.Post("/settings", func(w http.ResponseWriter, r *http.Request) {
 			adminid := r.FormValue("adminid")
 			poststyle := r.FormValue("poststyle")
 			redirect := r.FormValue("redirect")
-			if redirect == "" {
+			if !IsLocalRedirect(redirect) {
 				redirect = kctx.config.RootPath
 			}
 			handleSetting := func(name string, value string) {
@@ -252,6 +425,9 @@ func (kctx *KlandContext) GetHandler() (http.Handler, error) {
 		})
 
 		r.Post("/uploadimage", func(w http.ResponseWriter, r *http.Request) {
+			if kctx.CheckBanned(w, r) {
+				return
+			}
 			// WE want to parse the form so we can set the mem size...
 			r.ParseMultipartForm(kctx.config.MaxMultipartMemory)
 			// Set limits on the body
@@ -308,28 +484,16 @@ func (kctx *KlandContext) GetHandler() (http.Handler, error) {
 					outfile = tempfile
 				}
 			}
-			defer CloseDeleteUploadFile(outfile)
-			ctype, err := utils.DetectContentType(outfile)
-			if strings.Index(ctype, "image") != 0 {
-				http.Error(w, "Server rejected file: couldn't detect image format!", http.StatusBadRequest)
-				return
-			}
-			extension, err := utils.FirstErr(mime.ExtensionsByType(ctype))
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Server rejected file: %s", err), http.StatusBadRequest)
-				return
-			}
-			// Now we can generate a random name and move the file
-			finalname, err := kctx.RegisterUpload(outfile, *extension)
-			if err != nil {
-				log.Printf("Can't move upload: %s", err)
-				http.Error(w, "Couldn't write file", http.StatusInternalServerError)
+			if outfile == nil {
+				http.Error(w, "You must provide an image", http.StatusBadRequest)
 				return
 			}
-			_, err = InsertImagePost(db, form.ipaddress, finalname, bucketThread.Tid)
-			if err != nil {
-				log.Printf("CAN'T INSERT POST: %s", err)
-				http.Error(w, "Couldn't write post", http.StatusInternalServerError)
+			defer CloseDeleteUploadFile(outfile)
+			finalname := kctx.RegisterImageUpload(outfile, w, func(name string) error {
+				_, err := InsertImagePost(db, form.ipaddress, name, bucketThread.Tid)
+				return err
+			})
+			if finalname == "" {
 				return
 			}
 
@@ -350,7 +514,7 @@ func (kctx *KlandContext) GetHandler() (http.Handler, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = utils.FileServer(r, "/anm", kctx.config.TextPath(), false)
+	err = utils.FileServer(r, TextEndpoint, kctx.config.TextPath(), false)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,224 @@
+package kland
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/randomouscrap98/goldmonolith/utils"
+)
+
+func getTestServer(t *testing.T, name string) (*KlandContext, *httptest.Server) {
+	context := newTestContext(name)
+	handler, err := context.GetHandler()
+	if err != nil {
+		t.Fatalf("Error creating kland handler: %s", err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return context, server
+}
+
+// Post the fields (and optional files) as a multipart form. Redirects aren't followed
+func postForm(t *testing.T, url string, fields map[string]string, files map[string][]byte) *http.Response {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for k, v := range fields {
+		writer.WriteField(k, v)
+	}
+	for k, v := range files {
+		part, err := writer.CreateFormFile(k, k+".png")
+		if err != nil {
+			t.Fatalf("Error creating form file: %s", err)
+		}
+		part.Write(v)
+	}
+	writer.Close()
+	request, err := http.NewRequest("POST", url, &body)
+	if err != nil {
+		t.Fatalf("Error creating request: %s", err)
+	}
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	request.Header.Set("X-Real-IP", "1.2.3.4")
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("Error posting form: %s", err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+func testPng(t *testing.T) []byte {
+	return testPngSize(t, 4)
+}
+
+// Pngs of different sizes are different files (uploads of the same file are shared)
+func testPngSize(t *testing.T, size int) []byte {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, size, size)))
+	if err != nil {
+		t.Fatalf("Error making png: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestSubmitPost(t *testing.T) {
+	context, server := getTestServer(t, "submitpost")
+	response := postForm(t, server.URL+"/submitpost", map[string]string{
+		"subject":     "my thread",
+		"usernamekek": "somebody",
+		"tripfag":     "secret",
+		"shitcontent": "hello <b>world</b>",
+	}, nil)
+	if response.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected redirect on new thread, got %d", response.StatusCode)
+	}
+	db, err := context.config.OpenDb()
+	if err != nil {
+		t.Fatalf("Error opening db: %s", err)
+	}
+	defer db.Close()
+	threads, err := GetAllThreads(db)
+	if err != nil || len(threads) != 1 {
+		t.Fatalf("Expected one thread, got %v (%v)", threads, err)
+	}
+	tid := threads[0].Tid
+	if response.Header.Get("Location") != fmt.Sprintf("%s/thread/%d#p1", context.config.RootPath, tid) {
+		t.Fatalf("Unexpected redirect: %s", response.Header.Get("Location"))
+	}
+	// Replies can have images
+	response = postForm(t, server.URL+"/submitpost", map[string]string{
+		"tid":         fmt.Sprint(tid),
+		"shitcontent": "a reply",
+	}, map[string][]byte{"image": testPng(t)})
+	if response.StatusCode != http.StatusSeeOther {
+		t.Fatalf("Expected redirect on reply, got %d", response.StatusCode)
+	}
+	posts, err := GetPostsInThread(db, tid)
+	if err != nil || len(posts) != 2 {
+		t.Fatalf("Expected two posts, got %v (%v)", posts, err)
+	}
+	if posts[0].Content != "hello &lt;b&gt;world&lt;/b&gt;" || posts[0].Ipaddress != "1.2.3.4" {
+		t.Fatalf("First post stored wrong: %v", posts[0])
+	}
+	view := ConvertPost(posts[0], context.config)
+	if view.RealUsername != "somebody" || view.Trip == "" || view.Trip == "secret" {
+		t.Fatalf("Username/trip wrong: %v", view)
+	}
+	if posts[1].Image == "" {
+		t.Fatalf("Reply image not stored")
+	}
+	stored, err := os.ReadFile(filepath.Join(context.config.ImagePath(), posts[1].Image))
+	if err != nil || !bytes.Equal(stored, testPng(t)) {
+		t.Fatalf("Reply image not written: %v", err)
+	}
+	// The thread renders with everything in it
+	page, err := http.Get(fmt.Sprintf("%s/thread/%d", server.URL, tid))
+	if err != nil {
+		t.Fatalf("Error getting thread: %s", err)
+	}
+	defer page.Body.Close()
+	html, _ := io.ReadAll(page.Body)
+	if !strings.Contains(string(html), "a reply") || !strings.Contains(string(html), view.Trip) {
+		t.Fatalf("Thread page missing posts")
+	}
+	// Bad posts
+	bad := []map[string]string{
+		{"shitcontent": "no subject"},
+		{"subject": "no content"},
+		{"tid": "99999", "shitcontent": "missing thread"},
+		{"subject": "toolong", "shitcontent": strings.Repeat("a", MaxContentLength+1)},
+	}
+	for _, fields := range bad {
+		response = postForm(t, server.URL+"/submitpost", fields, nil)
+		if response.StatusCode != http.StatusBadRequest && response.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected failure for %v, got %d", fields, response.StatusCode)
+		}
+	}
+	// Thread subjects can't pretend to be buckets
+	response = postForm(t, server.URL+"/submitpost", map[string]string{
+		"subject":     BucketSubject("fake"),
+		"shitcontent": "not a bucket",
+	}, nil)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for bucket subject, got %d", response.StatusCode)
+	}
+	// Image buckets aren't threads you can post in
+	bucket, err := context.GetOrCreateBucketThread(db, "somebucket")
+	if err != nil {
+		t.Fatalf("Error creating bucket: %s", err)
+	}
+	response = postForm(t, server.URL+"/submitpost", map[string]string{
+		"tid":         fmt.Sprint(bucket.Tid),
+		"shitcontent": "sneaky",
+	}, nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 posting to bucket, got %d", response.StatusCode)
+	}
+	// Non-images are rejected
+	response = postForm(t, server.URL+"/submitpost", map[string]string{
+		"subject":     "not an image",
+		"shitcontent": "whatever",
+	}, map[string][]byte{"image": []byte("just some text")})
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 on non-image, got %d", response.StatusCode)
+	}
+}
+
+func TestUploadText(t *testing.T) {
+	context, server := getTestServer(t, "uploadtext")
+	response := postForm(t, server.URL+"/uploadtext", map[string]string{"text": `{"version":2}`}, nil)
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 on text upload, got %d", response.StatusCode)
+	}
+	link, _ := io.ReadAll(response.Body)
+	prefix := context.config.FullUrl + context.config.RootPath + TextEndpoint + "/"
+	name, found := strings.CutPrefix(string(link), prefix)
+	if !found || filepath.Ext(name) != "."+TextExtension {
+		t.Fatalf("Unexpected link: %s", link)
+	}
+	// It has to actually be served from the text endpoint
+	served, err := http.Get(server.URL + TextEndpoint + "/" + name)
+	if err != nil {
+		t.Fatalf("Error getting text: %s", err)
+	}
+	defer served.Body.Close()
+	text, _ := io.ReadAll(served.Body)
+	if string(text) != `{"version":2}` {
+		t.Fatalf("Unexpected text served: %s", text)
+	}
+	response = postForm(t, server.URL+"/uploadtext", map[string]string{}, nil)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 with no text, got %d", response.StatusCode)
+	}
+}
+
+func TestRegisterTextLimits(t *testing.T) {
+	context := newTestContext("registertextlimits")
+	// The database lives in the data folder too, so count whatever's already there
+	_, count, err := utils.GetTotalDirectorySize(context.config.DataPath)
+	if err != nil {
+		t.Fatalf("Error counting files: %s", err)
+	}
+	context.config.MaxTotalFileCount = count + 1
+	_, err = context.RegisterText(strings.NewReader("first"))
+	if err != nil {
+		t.Fatalf("Error registering text: %s", err)
+	}
+	_, err = context.RegisterText(strings.NewReader("second"))
+	if _, is := err.(*utils.OutOfSpaceError); !is {
+		t.Fatalf("Expected OutOfSpaceError, got %v", err)
+	}
+}
@@ -2,11 +2,15 @@ package kland
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"html"
 	"html/template"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -27,6 +31,8 @@ type KlandContext struct {
 	tinsmu    sync.Mutex
 	pinsmu    sync.Mutex
 	created   time.Time
+	bans      []banRange
+	bansmu    sync.RWMutex
 }
 
 func NewKlandContext(config *Config) (*KlandContext, error) {
@@ -58,6 +64,10 @@ func NewKlandContext(config *Config) (*KlandContext, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = os.MkdirAll(config.ThumbnailPath(), 0750)
+	if err != nil {
+		return nil, err
+	}
 	// For kland, we initialize the templates first because we don't really need
 	// hot reloading (also it's just better for performance... though memory usage...
 	templates, err := template.New("alltemplates").Funcs(template.FuncMap{
@@ -76,6 +86,16 @@ func NewKlandContext(config *Config) (*KlandContext, error) {
 		created:   time.Now(),
 	}
 
+	err = result.RefreshBans()
+	if err != nil {
+		return nil, err
+	}
+
+	err = result.HashOldImages()
+	if err != nil {
+		return nil, err
+	}
+
 	// We made a mistake, so we have to rehash...
 	if result.config.RehashTag != "" {
 		log.Printf("Rehashing kland posts...")
@@ -130,18 +150,33 @@ func (wc *KlandContext) RehashPosts() error {
 				}
 				return err
 			}
-			newimage, err := wc.RegisterUpload(oldfile, filepath.Ext(p.Image))
+			// Forget the old name's hash first, or the dedupe would just hand it back.
+			// Posts sharing the file end up sharing the new one instead (it has the hash now)
+			err = DeleteFileHash(db, p.Image)
+			if err != nil {
+				oldfile.Close()
+				return err
+			}
+			newimage, err := wc.RegisterUpload(oldfile, filepath.Ext(p.Image), func(newimage string) error {
+				// Do the database work. The function should do a transaction
+				return AddRehash(db, &p, newimage, wc.config.RehashTag)
+			})
 			oldfile.Close()
-			// Do the database work. The function should do a transaction
-			err = AddRehash(db, &p, newimage, wc.config.RehashTag)
 			if err != nil {
 				return err
 			}
-			// Finally, remove the old file
-			err = os.Remove(oldfp)
+			// Finally, remove the old file, once nothing else uses it
+			users, err := CountImagePosts(db, p.Image)
 			if err != nil {
 				return err
 			}
+			if users == 0 {
+				err = os.Remove(oldfp)
+				if err != nil {
+					return err
+				}
+				wc.RemoveThumbnail(p.Image)
+			}
 			log.Printf("Updated post %d (%s->%s)", p.Pid, p.Image, newimage)
 			count += 1
 		}
@@ -164,6 +199,11 @@ func (kctx *KlandContext) FullImageLink(fullname string, short bool) string {
 	}
 }
 
+// Where the uploaded text (see RegisterText) can be found
+func (kctx *KlandContext) FullTextLink(fullname string) string {
+	return fmt.Sprintf("%s%s%s/%s", kctx.config.FullUrl, kctx.config.RootPath, TextEndpoint, fullname)
+}
+
 // Retrieve the default data for any page load. Add your additional data to this
 // map before rendering
 func (kctx *KlandContext) GetDefaultData(r *http.Request) map[string]any {
@@ -182,7 +222,7 @@ func (kctx *KlandContext) GetDefaultData(r *http.Request) map[string]any {
 	result["root"] = kctx.config.RootPath
 	result["appversion"] = Version
 	result[AdminIdKey] = thisadminid
-	result[IsAdminKey] = thisadminid == kctx.config.AdminId
+	result[IsAdminKey] = kctx.IsAdmin(r)
 	result[PostStyleKey] = style
 	result["runtimeInfo"] = rinfo
 	result["requestUri"] = r.URL.RequestURI()
@@ -226,6 +266,7 @@ func (kctx *KlandContext) ConvertPostResult(posts []Post, err error, w http.Resp
 	postViews := make([]PostView, len(posts))
 	for i := range posts {
 		postViews[i] = ConvertPost(posts[i], kctx.config)
+		postViews[i].IsBanned = kctx.IsBanned(posts[i].Ipaddress)
 	}
 	return postViews
 }
@@ -257,14 +298,55 @@ func (kctx *KlandContext) ParseImageUploadQuery(r *http.Request) UploadImageQuer
 	result.animation = r.FormValue("animation")
 	result.redirect = utils.StringToBool(r.FormValue("redirect"))
 	result.short = utils.StringToBool(r.FormValue("shorturl"))
-	result.ipaddress = r.Header.Get(kctx.config.IpHeader)
-	if result.ipaddress == "" {
-		result.ipaddress = "unknown"
-	}
+	result.ipaddress = kctx.GetIpAddress(r)
 	result.bucket = r.FormValue("bucket")
 	return result
 }
 
+// The user's ip as given by the reverse proxy (see IpHeader)
+func (kctx *KlandContext) GetIpAddress(r *http.Request) string {
+	ipaddress := r.Header.Get(kctx.config.IpHeader)
+	if ipaddress == "" {
+		ipaddress = "unknown"
+	}
+	return ipaddress
+}
+
+// Parse the regular post form out of the request. Lengths and such are checked,
+// and the content is escaped (posts are rendered as html)
+func (kctx *KlandContext) ParseSubmitPostQuery(r *http.Request) (SubmitPostQuery, error) {
+	result := SubmitPostQuery{}
+	var err error
+	tid := r.FormValue("tid")
+	if tid != "" {
+		result.tid, err = strconv.ParseInt(tid, 10, 64)
+		if err != nil {
+			return result, fmt.Errorf("bad thread id")
+		}
+	}
+	result.subject = strings.TrimSpace(r.FormValue("subject"))
+	result.username = strings.TrimSpace(r.FormValue("usernamekek"))
+	result.trip = r.FormValue("tripfag")
+	content := strings.TrimSpace(strings.ReplaceAll(r.FormValue("shitcontent"), "\r\n", "\n"))
+	result.ipaddress = kctx.GetIpAddress(r)
+	if result.tid == 0 && result.subject == "" {
+		return result, fmt.Errorf("new threads need a subject")
+	}
+	// Image buckets are found by subject, so a thread could pass itself off as one
+	if strings.HasPrefix(result.subject, OrphanedPrepend) {
+		return result, fmt.Errorf("subject can't start with %s", OrphanedPrepend)
+	}
+	if content == "" {
+		return result, fmt.Errorf("posts need content")
+	}
+	if len(result.subject) > MaxSubjectLength || len(result.username) > MaxUsernameLength ||
+		len(result.trip) > MaxTripLength || len(content) > MaxContentLength {
+		return result, fmt.Errorf("something in the post is too long")
+	}
+	result.content = html.EscapeString(content)
+	return result, nil
+}
+
 // Either retrieve the existing bucket thread, or create a new one. It will always
 // have a valid hash after this call, even if it previously did not.
 func (kctx *KlandContext) GetOrCreateBucketThread(db *sql.DB, bucket string) (Thread, error) {
@@ -308,13 +390,17 @@ func (kctx *KlandContext) GetOrCreateBucketThread(db *sql.DB, bucket string) (Th
 }
 
 func (kctx *KlandContext) GenerateRandomUniqueFilename(extension string) (string, error) {
+	return kctx.generateUniqueFilename(kctx.config.ImagePath(), extension)
+}
+
+// Same as GenerateRandomUniqueFilename but for any folder
+func (kctx *KlandContext) generateUniqueFilename(folder string, extension string) (string, error) {
 	if len(extension) > 0 && extension[0] == '.' {
 		extension = extension[1:]
 	}
 	if len(extension) == 0 {
 		return "", fmt.Errorf("you must provide an extension")
 	}
-	folder := kctx.config.ImagePath()
 	// Maybe change this to generate more...
 	lowerExt := strings.ToLower(extension)
 	upperExt := strings.ToUpper(extension)
@@ -381,43 +467,167 @@ func (kctx *KlandContext) WriteTemp(r io.Reader, w http.ResponseWriter) (*os.Fil
 	return tempfile, nil
 }
 
+func hashFile(file io.ReadSeeker) (string, error) {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return hex.EncodeToString(hasher.Sum(nil)), err
+}
+
 // This function reads the entirety of the data in 'file' stream and puts it in the
 // final destination, giving it a random name with the extension appended. The full
-// filename is returned (without the path)
-func (kctx *KlandContext) RegisterUpload(file io.ReadSeeker, extension string) (string, error) {
-	// Before doing anything, check the size of the destination. If it's too big, return an error
-	if kctx.config.MaxTotalDataSize > 0 || kctx.config.MaxTotalFileCount > 0 {
-		size, count, err := utils.GetTotalDirectorySize(kctx.config.DataPath)
+// filename is returned (without the path). If the exact same data was already
+// stored, the existing file is reused instead (and no space is used). If given,
+// 'store' is called with the filename before the lock is released: save the post
+// using the file there, otherwise an admin could delete a reused file before the
+// post shows up to keep it. If 'store' fails, so does the upload
+func (kctx *KlandContext) RegisterUpload(file io.ReadSeeker, extension string, store func(string) error) (string, error) {
+	hash, err := hashFile(file)
+	if err != nil {
+		return "", err
+	}
+	db, err := kctx.config.OpenDb()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	// Hold the lock across the lookup and the write so two of the same upload
+	// at once don't both write a copy
+	kctx.pinsmu.Lock()
+	defer kctx.pinsmu.Unlock()
+	filename, err := LookupFileHash(db, hash)
+	if err != nil {
+		return "", err
+	}
+	if filename != "" {
+		_, err = os.Stat(filepath.Join(kctx.config.ImagePath(), filename))
+		if os.IsNotExist(err) {
+			log.Printf("Stored file %s for hash %s is missing, writing a new one", filename, hash)
+			err = DeleteFileHash(db, filename)
+			filename = ""
+		}
 		if err != nil {
 			return "", err
 		}
-		if kctx.config.MaxTotalDataSize > 0 && size >= kctx.config.MaxTotalDataSize {
-			return "", &utils.OutOfSpaceError{
-				Allowed: kctx.config.MaxTotalDataSize,
-				Current: size,
-				Units:   "bytes",
+	}
+	written := false
+	if filename == "" {
+		// Before writing anything, check the size of the destination. If it's too big, return an error
+		err = kctx.CheckSpace()
+		if err != nil {
+			return "", err
+		}
+		filename, err = kctx.writeUniqueFileNoLock(kctx.config.ImagePath(), file, extension)
+		if err != nil {
+			return "", err
+		}
+		err = InsertFileHash(db, filename, hash)
+		if err != nil {
+			return "", err
+		}
+		written = true
+	}
+	if store != nil {
+		err = store(filename)
+		if err != nil {
+			// Nothing uses a file we just wrote, so don't leave it around
+			if written {
+				kctx.removeUploadNoLock(db, filename)
 			}
+			return "", err
 		}
-		if kctx.config.MaxTotalFileCount > 0 && count >= kctx.config.MaxTotalFileCount {
-			return "", &utils.OutOfSpaceError{
-				Allowed: kctx.config.MaxTotalFileCount,
-				Current: count,
-				Units:   "files",
+	}
+	return filename, nil
+}
+
+// Get rid of a stored upload and its hash, logging (not returning) failures
+func (kctx *KlandContext) removeUploadNoLock(db utils.DbLike, filename string) {
+	err := DeleteFileHash(db, filename)
+	if err != nil {
+		log.Printf("Couldn't remove hash for %s: %s", filename, err)
+	}
+	err = os.Remove(filepath.Join(kctx.config.ImagePath(), filename))
+	if err != nil {
+		log.Printf("Couldn't remove unused upload %s: %s", filename, err)
+	}
+}
+
+// Images uploaded before there were file hashes can't be found as duplicates, so
+// hash any that are missing. Only images without a hash are read, so this only
+// does real work the first time
+func (kctx *KlandContext) HashOldImages() error {
+	db, err := kctx.config.OpenDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	images, err := GetUnhashedImages(db)
+	if err != nil {
+		return err
+	}
+	kctx.pinsmu.Lock()
+	defer kctx.pinsmu.Unlock()
+	count := 0
+	for _, image := range images {
+		file, err := os.Open(filepath.Join(kctx.config.ImagePath(), image))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // Not much we can do about it
 			}
+			return err
+		}
+		hash, err := hashFile(file)
+		file.Close()
+		if err != nil {
+			return err
 		}
+		err = InsertFileHash(db, image, hash)
+		if err != nil {
+			return err
+		}
+		count++
 	}
-	_, err := file.Seek(0, io.SeekStart)
+	if count > 0 {
+		log.Printf("Hashed %d old images", count)
+	}
+	return nil
+}
+
+// Put the text in the text folder (served from /anm) with a random name. The
+// full filename is returned (without the path)
+func (kctx *KlandContext) RegisterText(text io.Reader) (string, error) {
+	err := kctx.CheckSpace()
 	if err != nil {
 		return "", err
 	}
+	return kctx.writeUniqueFile(kctx.config.TextPath(), text, TextExtension)
+}
+
+// Write everything in the reader to a new randomly named file in the folder
+func (kctx *KlandContext) writeUniqueFile(folder string, file io.Reader, extension string) (string, error) {
 	kctx.pinsmu.Lock()
 	defer kctx.pinsmu.Unlock()
-	filename, err := kctx.GenerateRandomUniqueFilename(extension)
-	dest := filepath.Join(kctx.config.ImagePath(), filename)
+	return kctx.writeUniqueFileNoLock(folder, file, extension)
+}
+
+func (kctx *KlandContext) writeUniqueFileNoLock(folder string, file io.Reader, extension string) (string, error) {
+	filename, err := kctx.generateUniqueFilename(folder, extension)
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(folder, filename)
 	newfile, err := os.Create(dest)
 	if err != nil {
 		return "", err
 	}
+	defer newfile.Close()
 	_, err = io.Copy(newfile, file)
 	if err != nil {
 		return "", err
@@ -425,3 +635,58 @@ func (kctx *KlandContext) RegisterUpload(file io.ReadSeeker, extension string) (
 	//log.Printf("Moved %s to %s", path, destabs)
 	return filename, nil
 }
+
+// Make sure there's room for another file, returning an OutOfSpaceError if not
+func (kctx *KlandContext) CheckSpace() error {
+	if kctx.config.MaxTotalDataSize > 0 || kctx.config.MaxTotalFileCount > 0 {
+		size, count, err := utils.GetTotalDirectorySize(kctx.config.DataPath)
+		if err != nil {
+			return err
+		}
+		// Thumbnails still take space, but they're not real files as far as the limit cares
+		_, thumbcount, err := utils.GetTotalDirectorySize(kctx.config.ThumbnailPath())
+		if err != nil {
+			return err
+		}
+		count -= thumbcount
+		if kctx.config.MaxTotalDataSize > 0 && size >= kctx.config.MaxTotalDataSize {
+			return &utils.OutOfSpaceError{
+				Allowed: kctx.config.MaxTotalDataSize,
+				Current: size,
+				Units:   "bytes",
+			}
+		}
+		if kctx.config.MaxTotalFileCount > 0 && count >= kctx.config.MaxTotalFileCount {
+			return &utils.OutOfSpaceError{
+				Allowed: kctx.config.MaxTotalFileCount,
+				Current: count,
+				Units:   "files",
+			}
+		}
+	}
+	return nil
+}
+
+// Make sure the upload is actually an image, then register it (see RegisterUpload,
+// 'store' is the same). Errors are written to the response for you; the name is
+// empty if it failed
+func (kctx *KlandContext) RegisterImageUpload(file io.ReadSeeker, w http.ResponseWriter, store func(string) error) string {
+	ctype, err := utils.DetectContentType(file)
+	if err != nil || strings.Index(ctype, "image") != 0 {
+		http.Error(w, "Server rejected file: couldn't detect image format!", http.StatusBadRequest)
+		return ""
+	}
+	extension, err := utils.FirstErr(mime.ExtensionsByType(ctype))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Server rejected file: %s", err), http.StatusBadRequest)
+		return ""
+	}
+	// Now we can generate a random name and move the file
+	finalname, err := kctx.RegisterUpload(file, *extension, store)
+	if err != nil {
+		log.Printf("Can't store upload: %s", err)
+		http.Error(w, "Couldn't store upload", http.StatusInternalServerError)
+		return ""
+	}
+	return finalname
+}
@@ -3,6 +3,7 @@ package kland
 import (
 	"bytes"
 	"crypto/rand"
+	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
@@ -39,7 +40,7 @@ func newTestContext(name string) *KlandContext {
 
 func registerUpload(context *KlandContext, data []byte, t *testing.T) string {
 	reader := utils.NewMemBuffer(data)
-	name, err := context.RegisterUpload(&reader, ".png")
+	name, err := context.RegisterUpload(&reader, ".png", nil)
 	if err != nil {
 		t.Fatalf("Couldn't register upload: %s", err)
 	}
@@ -83,6 +84,7 @@ func TestCreateContext(t *testing.T) {
 		context.config.DatabasePath(),
 		context.config.ImagePath(),
 		context.config.TextPath(),
+		context.config.ThumbnailPath(),
 	}
 	// Go check to see if various directories exist
 	for _, check := range checks {
@@ -114,7 +116,7 @@ func TestFileUploadLimits(t *testing.T) {
 	// Now change the requirements to be extremely restrictive
 	context.config.MaxTotalDataSize = 5000
 	reader := utils.NewMemBuffer(make([]byte, 1024))
-	_, err := context.RegisterUpload(&reader, ".png")
+	_, err := context.RegisterUpload(&reader, ".png", nil)
 	ooserr, is := err.(*utils.OutOfSpaceError)
 	if !is {
 		t.Fatalf("Expected error to be OutOfSpaceError")
@@ -128,7 +130,7 @@ func TestFileUploadLimits(t *testing.T) {
 	context.config.MaxTotalDataSize = 0
 	context.config.MaxTotalFileCount = 4
 	reader = utils.NewMemBuffer(make([]byte, 1024))
-	_, err = context.RegisterUpload(&reader, ".png")
+	_, err = context.RegisterUpload(&reader, ".png", nil)
 	ooserr, is = err.(*utils.OutOfSpaceError)
 	if !is {
 		t.Fatalf("Expected error to be OutOfSpaceError")
@@ -175,3 +177,145 @@ func TestNoGrow(t *testing.T) {
 		t.Fatalf("There were collisions when registering uploads! Check %s", context.config.ImagePath())
 	}
 }
+
+func TestRegisterUploadDedupe(t *testing.T) {
+	context := newTestContext("uploaddedupe")
+	data, fp := registerUploadGenerate(context, 1024, t)
+	// Exact same data gets the exact same file, even when there's no room left
+	_, count, err := utils.GetTotalDirectorySize(context.config.DataPath)
+	if err != nil {
+		t.Fatalf("Error counting files: %s", err)
+	}
+	context.config.MaxTotalFileCount = count
+	fp2 := registerUpload(context, data, t)
+	if fp2 != fp {
+		t.Fatalf("Expected identical upload to reuse %s, got %s", fp, fp2)
+	}
+	entries, err := os.ReadDir(context.config.ImagePath())
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one stored file: %v (%v)", entries, err)
+	}
+	context.config.MaxTotalFileCount = 0
+	// Different data is a different file
+	_, fp3 := registerUploadGenerate(context, 1024, t)
+	if fp3 == fp {
+		t.Fatalf("Different upload reused %s", fp)
+	}
+	// If the stored file went missing, the data is written again
+	err = os.Remove(fp)
+	if err != nil {
+		t.Fatalf("Error removing file: %s", err)
+	}
+	fp4 := registerUpload(context, data, t)
+	if fp4 == fp {
+		t.Fatalf("Expected new file when old one is missing")
+	}
+	fp5 := registerUpload(context, data, t)
+	if fp5 != fp4 {
+		t.Fatalf("Expected rewritten file to be reused: %s vs %s", fp4, fp5)
+	}
+	// A new file whose post couldn't be stored is cleaned up, a reused one isn't
+	failStore := func(string) error { return fmt.Errorf("no post for you") }
+	newdata := make([]byte, 1024)
+	rand.Read(newdata)
+	reader := utils.NewMemBuffer(newdata)
+	_, err = context.RegisterUpload(&reader, ".png", failStore)
+	if err == nil {
+		t.Fatalf("Expected store error to fail the upload")
+	}
+	entries, err = os.ReadDir(context.config.ImagePath())
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected failed upload to be removed: %v (%v)", entries, err)
+	}
+	reader = utils.NewMemBuffer(data)
+	_, err = context.RegisterUpload(&reader, ".png", failStore)
+	if err == nil {
+		t.Fatalf("Expected store error to fail the upload")
+	}
+	_, err = os.Stat(fp4)
+	if err != nil {
+		t.Fatalf("Reused file was removed on failed store: %s", err)
+	}
+}
+
+func TestHashOldImages(t *testing.T) {
+	context := newTestContext("hasholdimages")
+	data := make([]byte, 1024)
+	rand.Read(data)
+	// Pretend this was uploaded before there were hashes
+	err := os.WriteFile(filepath.Join(context.config.ImagePath(), "old.png"), data, 0600)
+	if err != nil {
+		t.Fatalf("Error writing old image: %s", err)
+	}
+	db, err := context.config.OpenDb()
+	if err != nil {
+		t.Fatalf("Error opening db: %s", err)
+	}
+	defer db.Close()
+	_, err = InsertImagePost(db, "1.2.3.4", "old.png", 1)
+	if err != nil {
+		t.Fatalf("Error inserting post: %s", err)
+	}
+	err = context.HashOldImages()
+	if err != nil {
+		t.Fatalf("Error hashing old images: %s", err)
+	}
+	fp := registerUpload(context, data, t)
+	if filepath.Base(fp) != "old.png" {
+		t.Fatalf("Expected old image to be reused, got %s", fp)
+	}
+	unhashed, err := GetUnhashedImages(db)
+	if err != nil || len(unhashed) != 0 {
+		t.Fatalf("Expected no unhashed images: %v (%v)", unhashed, err)
+	}
+}
+
+func TestRehashPosts(t *testing.T) {
+	context := newTestContext("rehashposts")
+	db, err := context.config.OpenDb()
+	if err != nil {
+		t.Fatalf("Error opening db: %s", err)
+	}
+	defer db.Close()
+	bucket, err := context.GetOrCreateBucketThread(db, "rehashme")
+	if err != nil {
+		t.Fatalf("Error creating bucket: %s", err)
+	}
+	// Two posts share the same (deduped) file, which has a thumbnail
+	data := make([]byte, 1024)
+	rand.Read(data)
+	old := filepath.Base(registerUpload(context, data, t))
+	for range 2 {
+		_, err = InsertImagePost(db, "1.2.3.4", old, bucket.Tid)
+		if err != nil {
+			t.Fatalf("Error inserting post: %s", err)
+		}
+	}
+	thumbpath := filepath.Join(context.config.ThumbnailPath(), old)
+	err = os.WriteFile(thumbpath, []byte("thumb"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing thumbnail: %s", err)
+	}
+	context.config.RehashTag = "rehashed"
+	err = context.RehashPosts()
+	if err != nil {
+		t.Fatalf("Error rehashing: %s", err)
+	}
+	posts, err := GetPostsInThread(db, bucket.Tid)
+	if err != nil || len(posts) != 2 {
+		t.Fatalf("Expected two posts: %v (%v)", posts, err)
+	}
+	if posts[0].Image == old || posts[0].Image != posts[1].Image || posts[0].Username != "rehashed" {
+		t.Fatalf("Posts not rehashed onto one new file: %v", posts)
+	}
+	stored, err := os.ReadFile(filepath.Join(context.config.ImagePath(), posts[0].Image))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("Rehashed file not written: %v", err)
+	}
+	for _, gone := range []string{filepath.Join(context.config.ImagePath(), old), thumbpath} {
+		_, err = os.Stat(gone)
+		if !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be removed: %v", gone, err)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package kland
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ThumbnailEndpoint  = "/t"
+	ThumbnailSize      = 200        // Thumbnails fit in a square this big
+	ThumbnailQuality   = 85         // For jpeg thumbnails
+	MaxThumbnailPixels = 50_000_000 // Don't even try to decode images bigger than this
+)
+
+// Thumbnails of jpegs are jpegs, everything else becomes a png (to keep transparency)
+func thumbnailIsJpeg(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".jpg" || ext == ".jpeg" || ext == ".jpe"
+}
+
+// Shrink the image so it fits in a size x size square, averaging every pixel
+// that lands on each thumbnail pixel. Keeps transparency
+func scaleThumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	twidth, theight := size, size
+	if width > height {
+		theight = max(1, height*size/width)
+	} else {
+		twidth = max(1, width*size/height)
+	}
+	result := image.NewNRGBA(image.Rect(0, 0, twidth, theight))
+	for ty := 0; ty < theight; ty++ {
+		y0, y1 := bounds.Min.Y+ty*height/theight, bounds.Min.Y+(ty+1)*height/theight
+		for tx := 0; tx < twidth; tx++ {
+			x0, x1 := bounds.Min.X+tx*width/twidth, bounds.Min.X+(tx+1)*width/twidth
+			var r, g, b, a, count uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					// These are alpha premultiplied, so the average is too
+					pr, pg, pb, pa := img.At(x, y).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					count++
+				}
+			}
+			if count == 0 {
+				continue
+			}
+			result.Set(tx, ty, color.RGBA64{
+				R: uint16(r / count), G: uint16(g / count), B: uint16(b / count), A: uint16(a / count),
+			})
+		}
+	}
+	return result
+}
+
+// Read the image and write the thumbnail for it. Returns false (and writes
+// nothing) if the image is small enough to be its own thumbnail
+func WriteThumbnail(in io.ReadSeeker, out io.Writer, asJpeg bool) (bool, error) {
+	config, _, err := image.DecodeConfig(in)
+	if err != nil {
+		return false, err
+	}
+	if config.Width <= ThumbnailSize && config.Height <= ThumbnailSize {
+		return false, nil
+	}
+	if config.Width*config.Height > MaxThumbnailPixels {
+		return false, fmt.Errorf("image too large to thumbnail: %dx%d", config.Width, config.Height)
+	}
+	_, err = in.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, err
+	}
+	img, _, err := image.Decode(in)
+	if err != nil {
+		return false, err
+	}
+	thumb := scaleThumbnail(img, ThumbnailSize)
+	if asJpeg {
+		err = jpeg.Encode(out, thumb, &jpeg.Options{Quality: ThumbnailQuality})
+	} else {
+		err = png.Encode(out, thumb)
+	}
+	return err == nil, err
+}
+
+// Make sure the thumbnail for the image exists, generating it if not. Returns
+// the path to the thumbnail, or empty if the original should just be used
+// instead (it's small already or we can't decode it). That answer is stored as
+// an empty file in place of the thumbnail, so the image is only decoded once
+func (kctx *KlandContext) GetThumbnail(name string) (string, error) {
+	thumbpath := filepath.Join(kctx.config.ThumbnailPath(), name)
+	stat, err := os.Stat(thumbpath)
+	if err == nil {
+		if stat.Size() == 0 {
+			return "", nil
+		}
+		return thumbpath, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	original, err := os.Open(filepath.Join(kctx.config.ImagePath(), name))
+	if err != nil {
+		return "", err
+	}
+	defer original.Close()
+	// Write to a temp file first so nobody gets served half a thumbnail
+	// (multiple requests may be generating the same one)
+	tempfile, err := os.CreateTemp(kctx.config.ThumbnailPath(), "thumb_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tempfile.Name())
+	written, err := WriteThumbnail(original, tempfile, thumbnailIsJpeg(name))
+	tempfile.Close()
+	if err != nil {
+		log.Printf("Not thumbnailing %s: %s", name, err)
+	}
+	if err != nil || !written {
+		return "", os.WriteFile(thumbpath, nil, 0600)
+	}
+	return thumbpath, os.Rename(tempfile.Name(), thumbpath)
+}
+
+// Serve the thumbnail for the image named in the path, generating it the first
+// time. Images which don't need (or can't have) thumbnails redirect to the original
+func (kctx *KlandContext) ServeThumbnail(w http.ResponseWriter, r *http.Request, name string) {
+	name = path.Base(name)
+	thumbpath, err := kctx.GetThumbnail(name)
+	if os.IsNotExist(err) {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("ERROR GETTING THUMBNAIL FOR %s: %s", name, err)
+		http.Error(w, "Couldn't get thumbnail", http.StatusInternalServerError)
+		return
+	}
+	if thumbpath == "" {
+		http.Redirect(w, r, fmt.Sprintf("%s%s/%s", kctx.config.RootPath, ImageEndpoint, name), http.StatusFound)
+		return
+	}
+	thumbfile, err := os.Open(thumbpath)
+	if err != nil {
+		log.Printf("ERROR OPENING THUMBNAIL %s: %s", thumbpath, err)
+		http.Error(w, "Couldn't get thumbnail", http.StatusInternalServerError)
+		return
+	}
+	defer thumbfile.Close()
+	stat, err := thumbfile.Stat()
+	if err != nil {
+		log.Printf("ERROR OPENING THUMBNAIL %s: %s", thumbpath, err)
+		http.Error(w, "Couldn't get thumbnail", http.StatusInternalServerError)
+		return
+	}
+	// The name still has the original extension, which may not be what the thumbnail is
+	if thumbnailIsJpeg(name) {
+		w.Header().Set("Content-Type", "image/jpeg")
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+	}
+	http.ServeContent(w, r, name, stat.ModTime(), thumbfile)
+}
+
+// Get rid of the thumbnail for an image that's gone (if there is one)
+func (kctx *KlandContext) RemoveThumbnail(name string) {
+	err := os.Remove(filepath.Join(kctx.config.ThumbnailPath(), name))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Couldn't remove thumbnail %s: %s", name, err)
+	}
+}
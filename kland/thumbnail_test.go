@@ -0,0 +1,157 @@
+package kland
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/randomouscrap98/goldmonolith/utils"
+)
+
+func TestScaleThumbnail(t *testing.T) {
+	// Left half red, right half see-through
+	img := image.NewNRGBA(image.Rect(0, 0, 400, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			img.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	thumb := scaleThumbnail(img, ThumbnailSize)
+	if thumb.Bounds().Dx() != 200 || thumb.Bounds().Dy() != 50 {
+		t.Fatalf("Expected 200x50 thumbnail, got %v", thumb.Bounds())
+	}
+	left := color.NRGBAModel.Convert(thumb.At(10, 10)).(color.NRGBA)
+	right := color.NRGBAModel.Convert(thumb.At(190, 10)).(color.NRGBA)
+	if left != (color.NRGBA{R: 255, A: 255}) || right.A != 0 {
+		t.Fatalf("Thumbnail colors wrong: %v %v", left, right)
+	}
+	// Tall images fit the other way
+	thumb = scaleThumbnail(image.NewGray(image.Rect(0, 0, 30, 3000)), ThumbnailSize)
+	if thumb.Bounds().Dx() != 2 || thumb.Bounds().Dy() != 200 {
+		t.Fatalf("Expected 2x200 thumbnail, got %v", thumb.Bounds())
+	}
+}
+
+func TestWriteThumbnailSmall(t *testing.T) {
+	var out bytes.Buffer
+	written, err := WriteThumbnail(bytes.NewReader(testPng(t)), &out, false)
+	if err != nil || written || out.Len() != 0 {
+		t.Fatalf("Small images shouldn't get thumbnails: %t %v", written, err)
+	}
+}
+
+func getThumbnail(t *testing.T, url string) *http.Response {
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	response, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("Error getting thumbnail: %s", err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+func TestServeThumbnail(t *testing.T) {
+	context, server := getTestServer(t, "servethumbnail")
+	// Big images get thumbnails
+	var jpg bytes.Buffer
+	err := jpeg.Encode(&jpg, image.NewGray(image.Rect(0, 0, 300, 600)), nil)
+	if err != nil {
+		t.Fatalf("Error making jpeg: %s", err)
+	}
+	uploads := map[string][]byte{"big.png": testPngSize(t, 400), "big.jpg": jpg.Bytes(), "small.png": testPng(t)}
+	names := make(map[string]string)
+	for k, data := range uploads {
+		reader := utils.NewMemBuffer(data)
+		names[k], err = context.RegisterUpload(&reader, filepath.Ext(k), nil)
+		if err != nil {
+			t.Fatalf("Error registering upload: %s", err)
+		}
+	}
+	view := ConvertPost(Post{Image: names["big.png"]}, context.config)
+	if view.ThumbnailLink != context.config.RootPath+ThumbnailEndpoint+"/"+names["big.png"] {
+		t.Fatalf("Unexpected thumbnail link: %s", view.ThumbnailLink)
+	}
+	expected := map[string]struct {
+		ctype  string
+		width  int
+		height int
+	}{
+		"big.png": {"image/png", 200, 200},
+		"big.jpg": {"image/jpeg", 100, 200},
+	}
+	for k, e := range expected {
+		// Twice, once to generate and once to read the stored one
+		for range 2 {
+			response := getThumbnail(t, server.URL+ThumbnailEndpoint+"/"+names[k])
+			if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != e.ctype {
+				t.Fatalf("Unexpected thumbnail response for %s: %d %s", k, response.StatusCode, response.Header.Get("Content-Type"))
+			}
+			config, _, err := image.DecodeConfig(response.Body)
+			if err != nil || config.Width != e.width || config.Height != e.height {
+				t.Fatalf("Unexpected thumbnail for %s: %v (%v)", k, config, err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(context.config.ThumbnailPath(), names[k])); err != nil {
+			t.Fatalf("Thumbnail not stored for %s: %s", k, err)
+		}
+	}
+	// Small images and things we can't read just go to the original
+	err = os.WriteFile(filepath.Join(context.config.ImagePath(), "broken.png"), []byte("not a png"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing broken image: %s", err)
+	}
+	checkRedirects := func() {
+		for _, name := range []string{names["small.png"], "broken.png"} {
+			response := getThumbnail(t, server.URL+ThumbnailEndpoint+"/"+name)
+			if response.StatusCode != http.StatusFound || !strings.HasSuffix(response.Header.Get("Location"), ImageEndpoint+"/"+name) {
+				t.Fatalf("Expected redirect to original for %s, got %d %s", name, response.StatusCode, response.Header.Get("Location"))
+			}
+		}
+	}
+	checkRedirects()
+	// That answer is remembered, the image isn't decoded again
+	err = os.WriteFile(filepath.Join(context.config.ImagePath(), "broken.png"), testPngSize(t, 400), 0600)
+	if err != nil {
+		t.Fatalf("Error rewriting broken image: %s", err)
+	}
+	checkRedirects()
+	response := getThumbnail(t, server.URL+ThumbnailEndpoint+"/missing.png")
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected 404 for missing image, got %d", response.StatusCode)
+	}
+	entries, err := os.ReadDir(context.config.ThumbnailPath())
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("Expected only the two thumbnails and two markers stored: %v (%v)", entries, err)
+	}
+	// Thumbnails don't count as files for the limit
+	_, count, err := utils.GetTotalDirectorySize(context.config.DataPath)
+	if err != nil {
+		t.Fatalf("Error counting files: %s", err)
+	}
+	context.config.MaxTotalFileCount = count - 1
+	err = context.CheckSpace()
+	if err != nil {
+		t.Fatalf("Expected thumbnails to be left out of file count: %s", err)
+	}
+}
+
+func TestDecodeThumbnailPng(t *testing.T) {
+	var out bytes.Buffer
+	written, err := WriteThumbnail(bytes.NewReader(testPngSize(t, 1000)), &out, false)
+	if err != nil || !written {
+		t.Fatalf("Expected thumbnail written: %v", err)
+	}
+	img, err := png.Decode(&out)
+	if err != nil || img.Bounds().Dx() != ThumbnailSize {
+		t.Fatalf("Bad thumbnail: %v", err)
+	}
+}
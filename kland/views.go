@@ -12,17 +12,18 @@ const (
 )
 
 type PostView struct {
-	Pid          int64     `json:"pid"`
-	Tid          int64     `json:"tid"`
-	CreatedOn    time.Time `json:"createdOn"`
-	Content      string    `json:"content"`
-	RealUsername string    `json:"realUsername,omitempty"`
-	Trip         string    `json:"trip,omitempty"`
-	HasImage     bool      `json:"hasImage"`
-	IsBanned     bool      `json:"isBanned"`
-	ImageLink    string    `json:"imageLink,omitempty"`
-	Link         string    `json:"link,omitempty"`
-	IPAddress    string    `json:"ipAddress"`
+	Pid           int64     `json:"pid"`
+	Tid           int64     `json:"tid"`
+	CreatedOn     time.Time `json:"createdOn"`
+	Content       string    `json:"content"`
+	RealUsername  string    `json:"realUsername,omitempty"`
+	Trip          string    `json:"trip,omitempty"`
+	HasImage      bool      `json:"hasImage"`
+	IsBanned      bool      `json:"isBanned"`
+	ImageLink     string    `json:"imageLink,omitempty"`
+	ThumbnailLink string    `json:"thumbnailLink,omitempty"`
+	Link          string    `json:"link,omitempty"`
+	IPAddress     string    `json:"ipAddress"`
 }
 
 type ThreadView struct {
@@ -34,7 +35,8 @@ type ThreadView struct {
 	PostCount  int       `json:"postCount"`
 }
 
-// Convert db post to view
+// Convert db post to view. IsBanned isn't set here, the bans live in the
+// context (see ConvertPostResult)
 func ConvertPost(post Post, config *Config) PostView {
 
 	trip := post.Tripraw
@@ -55,19 +57,20 @@ func ConvertPost(post Post, config *Config) PostView {
 
 	link := fmt.Sprintf("%s/thread/%d#p%d", config.RootPath, post.Tid, post.Pid)
 	imageLink := fmt.Sprintf("%s%s/%s", config.RootPath, ImageEndpoint, image)
+	thumbnailLink := fmt.Sprintf("%s%s/%s", config.RootPath, ThumbnailEndpoint, image)
 
 	return PostView{
-		Tid:          post.Tid,
-		Pid:          post.Pid,
-		Content:      post.Content,
-		CreatedOn:    parseTime(post.Created),
-		IPAddress:    post.Ipaddress,
-		Trip:         trip,
-		RealUsername: realUsername,
-		Link:         link,
-		ImageLink:    imageLink,
-		IsBanned:     false, // TODO: GET BANS
-		HasImage:     post.Image != "",
+		Tid:           post.Tid,
+		Pid:           post.Pid,
+		Content:       post.Content,
+		CreatedOn:     parseTime(post.Created),
+		IPAddress:     post.Ipaddress,
+		Trip:          trip,
+		RealUsername:  realUsername,
+		Link:          link,
+		ImageLink:     imageLink,
+		ThumbnailLink: thumbnailLink,
+		HasImage:      post.Image != "",
 	}
 }
 
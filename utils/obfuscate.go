@@ -39,18 +39,37 @@ func GetDefaultObfuscation() *ObfuscatedKeys {
 
 // Generate a random key to obfuscate the given user generated one
 func (r *ObfuscatedKeys) GetObfuscatedKey(item string) string {
+	k, _ := r.GetOrCreateObfuscatedKey(item)
+	return k
+}
+
+// The key for the given item if it already has one, empty if not (doesn't
+// generate anything)
+func (r *ObfuscatedKeys) FindObfuscatedKey(item string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.reverseassoc[item]
+}
+
+// Same as GetObfuscatedKey, but also tells you whether the key was just now
+// generated (useful if you're persisting keys somewhere)
+func (r *ObfuscatedKeys) GetOrCreateObfuscatedKey(item string) (string, bool) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
 
 	k, ok := r.reverseassoc[item]
 	if ok {
-		return k
+		return k, false
 	}
 
+	return r.newKeyNoLock(item), true
+}
+
+func (r *ObfuscatedKeys) newKeyNoLock(item string) string {
 	retries := 0
 
 	for {
-		k = RandomAsciiName(r.DefaultLength + (retries / r.RetryToLengthIncrease))
+		k := RandomAsciiName(r.DefaultLength + (retries / r.RetryToLengthIncrease))
 		_, ok := r.associations[k]
 		if !ok {
 			// Not found, so this is good
@@ -62,6 +81,44 @@ func (r *ObfuscatedKeys) GetObfuscatedKey(item string) string {
 	}
 }
 
+// Force the given key for the item, such as a key loaded from storage. The
+// item's old key goes away. Fails if the key already belongs to another item
+func (r *ObfuscatedKeys) SetObfuscatedKey(item string, key string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	existing, ok := r.associations[key]
+	if ok && existing != item {
+		return fmt.Errorf("key %s already in use", key)
+	}
+	r.removeNoLock(item)
+	r.associations[key] = item
+	r.reverseassoc[item] = key
+	return nil
+}
+
+// Throw away the item's key (if it has one) and generate a new one
+func (r *ObfuscatedKeys) RegenerateObfuscatedKey(item string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.removeNoLock(item)
+	return r.newKeyNoLock(item)
+}
+
+// Remove the item and its key entirely
+func (r *ObfuscatedKeys) RemoveObfuscatedKey(item string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.removeNoLock(item)
+}
+
+func (r *ObfuscatedKeys) removeNoLock(item string) {
+	k, ok := r.reverseassoc[item]
+	if ok {
+		delete(r.associations, k)
+		delete(r.reverseassoc, item)
+	}
+}
+
 // Get the user generated key from the obfuscated key
 func (r *ObfuscatedKeys) GetFromObfuscatedKey(key string) (string, error) {
 	r.lock.Lock()
@@ -65,3 +65,57 @@ func TestObfuscateSimple(t *testing.T) {
 		t.Fatalf("Supposed to get the same key each time! Got %s vs %s", key3, key)
 	}
 }
+
+func TestObfuscateSetRemove(t *testing.T) {
+	o := GetDefaultObfuscation()
+
+	if o.FindObfuscatedKey("wow") != "" {
+		t.Fatalf("Key found before it was made")
+	}
+	key, created := o.GetOrCreateObfuscatedKey("wow")
+	if !created {
+		t.Fatalf("Key should've been created the first time")
+	}
+	_, created = o.GetOrCreateObfuscatedKey("wow")
+	if created {
+		t.Fatalf("Key shouldn't be created the second time")
+	}
+	if o.FindObfuscatedKey("wow") != key {
+		t.Fatalf("Find didn't give back the created key")
+	}
+
+	err := o.SetObfuscatedKey("other", key)
+	if err == nil {
+		t.Fatalf("Shouldn't be able to steal another item's key")
+	}
+	err = o.SetObfuscatedKey("wow", "loaded")
+	if err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+	_, err = o.GetFromObfuscatedKey(key)
+	if err == nil {
+		t.Fatalf("Old key should be gone after set")
+	}
+	item, err := o.GetFromObfuscatedKey("loaded")
+	if err != nil || item != "wow" {
+		t.Fatalf("Set key doesn't map back: %s (%s)", item, err)
+	}
+
+	key2 := o.RegenerateObfuscatedKey("wow")
+	if key2 == "loaded" {
+		t.Fatalf("Regenerated key is the same as the old one")
+	}
+	_, err = o.GetFromObfuscatedKey("loaded")
+	if err == nil {
+		t.Fatalf("Old key should be gone after regenerate")
+	}
+	if o.GetObfuscatedKey("wow") != key2 {
+		t.Fatalf("Regenerated key isn't the item's key")
+	}
+
+	o.RemoveObfuscatedKey("wow")
+	_, err = o.GetFromObfuscatedKey(key2)
+	if err == nil {
+		t.Fatalf("Key should be gone after remove")
+	}
+}
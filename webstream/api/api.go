@@ -0,0 +1,58 @@
+// The parts of the webstream http interface that both the server and clients
+// need. Nothing in here needs cgo (unlike the server and its sqlite backer), so
+// clients can use it without pulling in the whole server
+package api
+
+import (
+	"fmt"
+)
+
+const (
+	WriteTokenHeader    = "X-Write-Token"
+	ResumeStartHeader   = "X-Resume-Start"   // Where to pick up after data was dropped (410 responses)
+	ResumeMessageHeader = "X-Resume-Message" // Same, but the message for framed rooms
+	EncodingText        = ""                 // Data goes out as-is in a string (default)
+	EncodingBase64      = "base64"           // Data goes out as a base64 string
+	EncodingBinary      = "binary"           // Data goes out raw as application/octet-stream (plain endpoint only)
+)
+
+// Result of a stream completion (often times the user only uses
+// the data portion)
+type StreamResult struct {
+	Data        string        `json:"data"`
+	Readonlykey string        `json:"readonlykey"`
+	Signalled   int           `json:"signalled"`
+	Used        int           `json:"used"`
+	Limit       int           `json:"limit"`
+	NextStart   int           `json:"nextstart"`
+	DataLength  int           `json:"datalength"`
+	Encoding    string        `json:"encoding,omitempty"`
+	Framed      *FramedResult `json:"framed,omitempty"` // Only for framed rooms, which leave Data empty
+}
+
+// The messages from a framed room. Count is the number of messages here, not bytes
+type FramedResult struct {
+	Messages     []string `json:"messages"`
+	FirstMessage int      `json:"firstmessage"`
+	NextMessage  int      `json:"nextmessage"`
+}
+
+// The constants you return from the /constants endpoint,
+// received from the config (don't want to give out the whole config)
+type StreamConstants struct {
+	MaxStreamSize  int    `json:"maxStreamSize"`
+	MaxSingleChunk int    `json:"maxSingleChunk"`
+	Rolling        bool   `json:"rolling"`
+	MaxTotalData   int64  `json:"maxTotalData"`
+	TotalData      int64  `json:"totalData"`
+	Version        string `json:"version"`
+}
+
+type TruncatedError struct {
+	Start   int
+	Message int // Only for framed rooms: the first message still available
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("data truncated, resume at %d", e.Start)
+}
@@ -0,0 +1,210 @@
+package webstream
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metadata stored alongside each room in an archive. The archive uses the same
+// layout as the file backer (data at <room>, metadata at .meta/<room>.json), so
+// an extracted archive is also a usable StreamFolder
+type RoomArchiveMeta struct {
+	WebStreamMeta
+	Length int `json:"length"` // Absolute length of the room (base + data)
+}
+
+// Grab a consistent copy of the room's data and metadata. In-memory data is
+// used if it's there, so nothing needs to be dumped first
+func (wsys *WebStreamSystem) snapshotRoom(name string) ([]byte, *RoomArchiveMeta, error) {
+	ws, err := wsys.lockExistingStream(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ws.mu.Unlock()
+	var data []byte
+	if cap(ws.data) > 0 {
+		data = make([]byte, len(ws.data))
+		copy(data, ws.data)
+	} else {
+		data, err = wsys.readBackerNoLock(name, ws, ws.length-ws.base)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	meta := &RoomArchiveMeta{
+		WebStreamMeta: *ws.getMetaNoLock(),
+		Length:        ws.length,
+	}
+	// The archive holds everything we have, saved or not
+	stored := len(data)
+	meta.Stored = &stored
+	return data, meta, nil
+}
+
+// Write the given rooms (or every room if none are given) as a tar archive
+func (wsys *WebStreamSystem) ExportRooms(w io.Writer, rooms []string) error {
+	if len(rooms) == 0 {
+		for k := range wsys.snapshotStreams() {
+			rooms = append(rooms, k)
+		}
+		sort.Strings(rooms)
+	}
+	tw := tar.NewWriter(w)
+	for _, room := range rooms {
+		data, meta, err := wsys.snapshotRoom(room)
+		if err != nil {
+			return err
+		}
+		rawmeta, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		modified := meta.LastWrite
+		if modified.IsZero() {
+			modified = time.Now()
+		}
+		for _, file := range []struct {
+			name string
+			data []byte
+		}{
+			{room, data},
+			{path.Join(MetaFolder, room+".json"), rawmeta},
+		} {
+			err = tw.WriteHeader(&tar.Header{
+				Name:    file.name,
+				Mode:    0640,
+				Size:    int64(len(file.data)),
+				ModTime: modified,
+			})
+			if err != nil {
+				return err
+			}
+			_, err = tw.Write(file.data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// Replace the room with the given data and metadata, saving it to the backer
+// right away. The room is left unloaded
+func (wsys *WebStreamSystem) importRoom(name string, data []byte, meta *WebStreamMeta) error {
+	limit := wsys.RoomLimits(name).StreamDataLimit
+	if len(data) > limit {
+		return &OverCapacityError{Capacity: limit}
+	}
+	if meta.Framed {
+		_, err := indexMessages(data, meta.Base)
+		if err != nil {
+			return err
+		}
+	}
+	ws, err := wsys.lockStream(name)
+	if err != nil {
+		return err
+	}
+	defer ws.mu.Unlock()
+	old := ws.length - ws.base
+	err = wsys.reserveData(len(data) - old)
+	if err != nil {
+		return err
+	}
+	stored := len(data)
+	meta.Stored = &stored
+	err = wsys.backer.WriteWithMeta(name, data, meta)
+	if err != nil {
+		wsys.reserveData(old - len(data))
+		return err
+	}
+	if cap(ws.data) > 0 {
+		wsys.decActiveCount()
+	}
+	ws.data = nil
+	ws.messages = nil
+	ws.dirty = false
+	ws.backed = true
+	ws.base = meta.Base
+	ws.persistedBase = meta.Base
+	ws.length = meta.Base + len(data)
+	ws.lastWrite = meta.LastWrite
+	if ws.lastWrite.IsZero() {
+		ws.lastWrite = time.Now()
+	}
+	ws.writeToken = meta.WriteToken
+	ws.readonlyKey = meta.ReadonlyKey
+	ws.framed = meta.Framed
+	ws.baseMessage = meta.BaseMessage
+	// The data changed out from under anyone waiting, they can go check it
+	close(ws.readSignal)
+	ws.readSignal = make(chan struct{})
+	return nil
+}
+
+// Restore rooms from an archive made by ExportRooms, overwriting any rooms with
+// the same name. Rooms without metadata in the archive get the default metadata.
+// Returns the rooms that were restored (even on error)
+func (wsys *WebStreamSystem) ImportRooms(r io.Reader) ([]string, error) {
+	datas := make(map[string][]byte)
+	metas := make(map[string]*RoomArchiveMeta)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// Room names are checked against the regex on import, but paths are still
+		// kept to the exact layout we export just in case
+		name := path.Clean(header.Name)
+		if strings.HasPrefix(name, MetaFolder+"/") && strings.HasSuffix(name, ".json") {
+			room := strings.TrimSuffix(strings.TrimPrefix(name, MetaFolder+"/"), ".json")
+			var meta RoomArchiveMeta
+			err = json.NewDecoder(tr).Decode(&meta)
+			if err != nil {
+				return nil, fmt.Errorf("bad metadata for room %s: %s", room, err)
+			}
+			metas[room] = &meta
+		} else if !strings.Contains(name, "/") {
+			limit := wsys.RoomLimits(name).StreamDataLimit
+			if header.Size > int64(limit) {
+				return nil, &OverCapacityError{Capacity: limit}
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			datas[name] = data
+		}
+	}
+	rooms := make([]string, 0, len(datas))
+	for room := range datas {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	imported := make([]string, 0, len(rooms))
+	for _, room := range rooms {
+		meta := &WebStreamMeta{}
+		if m, ok := metas[room]; ok {
+			meta = &m.WebStreamMeta
+		}
+		err := wsys.importRoom(room, datas[room], meta)
+		if err != nil {
+			return imported, fmt.Errorf("couldn't import room %s: %w", room, err)
+		}
+		imported = append(imported, room)
+	}
+	return imported, nil
+}
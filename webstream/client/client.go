@@ -0,0 +1,344 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/randomouscrap98/goldmonolith/webstream/api"
+)
+
+// Talks to a webstream service over http. Endpoint is wherever webstream is mounted,
+// like "https://somewhere.com/stream". Safe to use from many goroutines
+type Client struct {
+	Endpoint  string
+	HTTP      *http.Client
+	Retries   int           // How many times to retry reads that fail with a 5xx (writes only retry 503)
+	RetryWait time.Duration // How long to wait between retries
+}
+
+func NewClient(endpoint string) *Client {
+	return &Client{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		HTTP:      http.DefaultClient,
+		Retries:   3,
+		RetryWait: time.Second,
+	}
+}
+
+// Perform a request, retrying on server errors (only 503 for writes). The body
+// is resent on every attempt. Non-2xx responses are turned into StatusError
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	endpoint := c.Endpoint + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			request.Header[k] = v
+		}
+		response, err := c.HTTP.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode >= 200 && response.StatusCode < 300 {
+			return response, nil
+		}
+		message, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		serr := &StatusError{Status: response.StatusCode, Message: strings.TrimSpace(string(message))}
+		if response.StatusCode == http.StatusGone {
+			// Rolling rooms dropped the data; the server tells us where it picks up
+			resume, err := strconv.Atoi(response.Header.Get(api.ResumeStartHeader))
+			if err == nil {
+				message, _ := strconv.Atoi(response.Header.Get(api.ResumeMessageHeader))
+				return nil, &api.TruncatedError{Start: resume, Message: message}
+			}
+		}
+		retry := serr.Temporary()
+		if method != http.MethodGet {
+			// A write that blew up partway may have gone through anyway, and sending it
+			// again would double it. The server only says 503 when it didn't touch the room
+			retry = response.StatusCode == http.StatusServiceUnavailable
+		}
+		if !retry || attempt >= c.Retries {
+			return nil, serr
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.RetryWait):
+		}
+	}
+}
+
+// Perform a request and parse the json result into the given object
+func (c *Client) doJson(ctx context.Context, path string, query url.Values, result any) error {
+	response, err := c.do(ctx, "GET", path, query, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// Get the limits and such from the server. If room is given, the limits are
+// for that room specifically (rooms can have their own)
+func (c *Client) Constants(ctx context.Context, room string) (*api.StreamConstants, error) {
+	query := url.Values{}
+	if room != "" {
+		query.Set("room", room)
+	}
+	var result api.StreamConstants
+	err := c.doJson(ctx, "/constants", query, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Get the readonly key for the given room; other people can read the room
+// with it (see ReadonlyRoom) but not write to it
+func (c *Client) ReadonlyKey(ctx context.Context, room string) (string, error) {
+	query := url.Values{}
+	query.Set("nonblocking", "true")
+	query.Set("count", "0")
+	var result api.StreamResult
+	err := c.doJson(ctx, "/"+url.PathEscape(room)+"/json", query, &result)
+	if err != nil {
+		return "", err
+	}
+	return result.Readonlykey, nil
+}
+
+// A single room on the server, which remembers where you are in the stream
+// so you can keep reading from where you left off. Not safe to use from many
+// goroutines (make a room for each)
+type Room struct {
+	Name       string
+	Readonly   bool   // Name is a readonly key rather than the room itself
+	Start      int    // Where the next read starts. Moved forward by every read
+	WriteToken string // The token for claimed rooms, sent with every write
+	client     *Client
+}
+
+// Use the given room. Reads start at the beginning of the stream; set Start
+// to go elsewhere
+func (c *Client) Room(name string) *Room {
+	return &Room{Name: name, client: c}
+}
+
+// Use a room through its readonly key. Writes will fail
+func (c *Client) ReadonlyRoom(key string) *Room {
+	return &Room{Name: key, Readonly: true, client: c}
+}
+
+func (r *Room) path() string {
+	return "/" + url.PathEscape(r.Name)
+}
+
+// Get a single result from the json endpoint at the current position, without
+// moving forward. Blocking reads wait until data shows up or the server's read
+// timeout passes, at which point the data is simply empty. Data is base64 (the
+// result says so in Encoding), since streams can hold anything. Framed rooms
+// put their messages in Framed instead (also base64)
+func (r *Room) ReadResult(ctx context.Context, nonblocking bool) (*api.StreamResult, error) {
+	query := url.Values{}
+	query.Set("start", strconv.Itoa(r.Start))
+	query.Set("encoding", api.EncodingBase64)
+	if nonblocking {
+		query.Set("nonblocking", "true")
+	}
+	if r.Readonly {
+		query.Set("readonlykey", "true")
+	}
+	var result api.StreamResult
+	err := r.client.doJson(ctx, r.path()+"/json", query, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Read whatever data is available and move forward past it. Blocking reads
+// keep waiting (through as many server timeouts as it takes) until there's
+// data or the context is done. If a rolling room dropped the data we were
+// after, Start is moved to the oldest data and a TruncatedError is returned;
+// reading again continues from there. Framed rooms fail with ErrFramed, read
+// them with NextMessages instead
+func (r *Room) Next(ctx context.Context, nonblocking bool) ([]byte, error) {
+	for {
+		result, err := r.nextResult(ctx, nonblocking)
+		if err != nil {
+			return nil, err
+		}
+		if result.Framed != nil {
+			return nil, ErrFramed
+		}
+		data, err := base64.StdEncoding.DecodeString(result.Data)
+		if err != nil {
+			return nil, err
+		}
+		r.Start = result.NextStart
+		if len(data) > 0 || nonblocking {
+			return data, nil
+		}
+	}
+}
+
+// Same as Next, but for framed rooms: you get whole messages, exactly as they
+// were written. Rooms which aren't framed fail with ErrNotFramed
+func (r *Room) NextMessages(ctx context.Context, nonblocking bool) ([][]byte, error) {
+	for {
+		result, err := r.nextResult(ctx, nonblocking)
+		if err != nil {
+			return nil, err
+		}
+		if result.Framed == nil {
+			return nil, ErrNotFramed
+		}
+		messages := make([][]byte, len(result.Framed.Messages))
+		for i, m := range result.Framed.Messages {
+			messages[i], err = base64.StdEncoding.DecodeString(m)
+			if err != nil {
+				return nil, err
+			}
+		}
+		r.Start = result.NextStart
+		if len(messages) > 0 || nonblocking {
+			return messages, nil
+		}
+	}
+}
+
+// Read at the current position, moving to the oldest data if it was dropped
+func (r *Room) nextResult(ctx context.Context, nonblocking bool) (*api.StreamResult, error) {
+	result, err := r.ReadResult(ctx, nonblocking)
+	if truncerr, ok := err.(*api.TruncatedError); ok {
+		r.Start = truncerr.Start
+	}
+	return result, err
+}
+
+// Add data to the end of the room
+func (r *Room) Append(ctx context.Context, data []byte) error {
+	response, err := r.write(ctx, data, false)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// Claim the room while adding the data, so only writers with the token can
+// write afterward. The token is saved in WriteToken and also returned
+func (r *Room) Claim(ctx context.Context, data []byte) (string, error) {
+	response, err := r.write(ctx, data, true)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	r.WriteToken = response.Header.Get(api.WriteTokenHeader)
+	return r.WriteToken, nil
+}
+
+func (r *Room) write(ctx context.Context, data []byte, claim bool) (*http.Response, error) {
+	if r.Readonly {
+		return nil, errors.New("can't write to a room through its readonly key")
+	}
+	query := url.Values{}
+	if claim {
+		query.Set("claim", "true")
+	}
+	// The data goes as-is; base64 would count against the write limit before it's decoded
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	if r.WriteToken != "" {
+		header.Set(api.WriteTokenHeader, r.WriteToken)
+	}
+	return r.client.do(ctx, "POST", r.path(), query, data, header)
+}
+
+// Follows a room forever, see Room.Reader
+type tailReader struct {
+	room    *Room
+	ctx     context.Context
+	pending []byte
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for len(t.pending) == 0 {
+		data, err := t.room.Next(t.ctx, false)
+		if _, ok := err.(*api.TruncatedError); ok {
+			// Readers just want the stream, there's nothing they can do about lost data
+			continue
+		}
+		if err != nil {
+			if t.ctx.Err() != nil {
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		t.pending = data
+	}
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+// Get a reader which tails the room from Start: reads block until new data
+// is written. The reader only ends (with io.EOF) when the context is done.
+// Data dropped by rolling rooms is silently skipped
+func (r *Room) Reader(ctx context.Context) io.Reader {
+	return &tailReader{room: r, ctx: ctx}
+}
+
+// A single chunk of data from a subscription, or the error that ended it
+type Chunk struct {
+	Data  []byte
+	Start int // Absolute offset of Data in the room
+	Err   error
+}
+
+// Follow the room from Start, sending every new bit of data to the returned
+// channel. The channel is closed when the context is done, or after sending
+// a Chunk with an error the reads couldn't recover from (retries are already
+// handled). Don't use the room for anything else while subscribed
+func (r *Room) Subscribe(ctx context.Context) <-chan Chunk {
+	chunks := make(chan Chunk)
+	go func() {
+		defer close(chunks)
+		for {
+			start := r.Start
+			data, err := r.Next(ctx, false)
+			if _, ok := err.(*api.TruncatedError); ok {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			chunk := Chunk{Data: data, Start: start, Err: err}
+			select {
+			case chunks <- chunk:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return chunks
+}
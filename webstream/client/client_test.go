@@ -0,0 +1,323 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/randomouscrap98/goldmonolith/utils"
+	"github.com/randomouscrap98/goldmonolith/webstream"
+)
+
+func testConfig(name string) *webstream.Config {
+	return &webstream.Config{
+		StreamFolder:    utils.RandomTestFolder(name, false),
+		TotalRoomLimit:  10,
+		SingleDataLimit: 500,
+		StreamDataLimit: 1000,
+		ActiveRoomLimit: 10,
+		ReadTimeout:     utils.Duration(100 * time.Millisecond),
+		RoomRegex:       "^[a-zA-Z0-9-]{3,256}$",
+	}
+}
+
+// Host a real webstream for the client to talk to. Requests go through the
+// given wrapper first (if any) so tests can mess with them
+func getTestClient(t *testing.T, config *webstream.Config, wrap func(http.Handler) http.Handler) *Client {
+	webctx, err := webstream.NewWebstreamContext(config)
+	if err != nil {
+		t.Fatalf("Error creating webstream context: %s", err)
+	}
+	handler, err := webctx.GetHandler()
+	if err != nil {
+		t.Fatalf("Error creating webstream handler: %s", err)
+	}
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := NewClient(server.URL)
+	client.RetryWait = time.Millisecond
+	return client
+}
+
+func TestConstants(t *testing.T) {
+	config := testConfig("clientconstants")
+	config.RoomClass = []webstream.RoomClass{{Regex: "^big-", StreamDataLimit: 5000}}
+	client := getTestClient(t, config, nil)
+	constants, err := client.Constants(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Error getting constants: %s", err)
+	}
+	if constants.MaxStreamSize != 1000 || constants.MaxSingleChunk != 500 || constants.Version != webstream.Version {
+		t.Fatalf("Unexpected constants: %v", constants)
+	}
+	constants, err = client.Constants(context.Background(), "big-room")
+	if err != nil {
+		t.Fatalf("Error getting constants: %s", err)
+	}
+	if constants.MaxStreamSize != 5000 {
+		t.Fatalf("Expected room specific limit, got %d", constants.MaxStreamSize)
+	}
+}
+
+func TestAppendNext(t *testing.T) {
+	client := getTestClient(t, testConfig("clientappendnext"), nil)
+	ctx := context.Background()
+	room := client.Room("appendnext")
+	// Binary data has to survive the trip
+	for _, data := range [][]byte{[]byte("hello"), {0, 1, 2, 255}} {
+		err := room.Append(ctx, data)
+		if err != nil {
+			t.Fatalf("Error appending: %s", err)
+		}
+	}
+	reader := client.Room("appendnext")
+	data, err := reader.Next(ctx, false)
+	if err != nil {
+		t.Fatalf("Error reading: %s", err)
+	}
+	if !bytes.Equal(data, []byte("hello\x00\x01\x02\xff")) {
+		t.Fatalf("Unexpected data: %v", data)
+	}
+	if reader.Start != 9 {
+		t.Fatalf("Expected start to move to 9, got %d", reader.Start)
+	}
+	data, err = reader.Next(ctx, true)
+	if err != nil || len(data) != 0 {
+		t.Fatalf("Expected nothing from nonblocking read at the end, got %v (%v)", data, err)
+	}
+	// A blocking read waits through server timeouts until something shows up
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		room.Append(ctx, []byte("later"))
+	}()
+	data, err = reader.Next(ctx, false)
+	if err != nil {
+		t.Fatalf("Error reading: %s", err)
+	}
+	if string(data) != "later" || reader.Start != 14 {
+		t.Fatalf("Unexpected blocking read: %s (start %d)", data, reader.Start)
+	}
+}
+
+func TestAppendLimit(t *testing.T) {
+	client := getTestClient(t, testConfig("clientappendlimit"), nil)
+	ctx := context.Background()
+	// The whole write limit is usable, nothing is lost to encoding
+	err := client.Room("appendlimit").Append(ctx, bytes.Repeat([]byte{0xff}, 500))
+	if err != nil {
+		t.Fatalf("Error appending a full chunk: %s", err)
+	}
+	err = client.Room("appendlimit").Append(ctx, bytes.Repeat([]byte{0xff}, 501))
+	if err == nil {
+		t.Fatalf("Expected error appending past the limit")
+	}
+}
+
+func TestNextMessages(t *testing.T) {
+	client := getTestClient(t, testConfig("clientnextmessages"), nil)
+	ctx := context.Background()
+	response, err := http.Post(client.Endpoint+"/framedroom?framed=true", "text/plain", strings.NewReader("one"))
+	if err != nil {
+		t.Fatalf("Error making framed room: %s", err)
+	}
+	response.Body.Close()
+	room := client.Room("framedroom")
+	err = room.Append(ctx, []byte{0, 1, 2})
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	reader := client.Room("framedroom")
+	_, err = reader.Next(ctx, false)
+	if err != ErrFramed {
+		t.Fatalf("Expected ErrFramed reading framed room with Next, got %v", err)
+	}
+	messages, err := reader.NextMessages(ctx, false)
+	if err != nil {
+		t.Fatalf("Error reading messages: %s", err)
+	}
+	if len(messages) != 2 || string(messages[0]) != "one" || !bytes.Equal(messages[1], []byte{0, 1, 2}) {
+		t.Fatalf("Unexpected messages: %q", messages)
+	}
+	// Blocking reads wait for the next message
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		room.Append(ctx, []byte("later"))
+	}()
+	messages, err = reader.NextMessages(ctx, false)
+	if err != nil || len(messages) != 1 || string(messages[0]) != "later" {
+		t.Fatalf("Unexpected blocking read: %q (%v)", messages, err)
+	}
+	err = client.Room("plainroom").Append(ctx, []byte("plain"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	_, err = client.Room("plainroom").NextMessages(ctx, true)
+	if err != ErrNotFramed {
+		t.Fatalf("Expected ErrNotFramed, got %v", err)
+	}
+}
+
+func TestReadonlyRoom(t *testing.T) {
+	client := getTestClient(t, testConfig("clientreadonly"), nil)
+	ctx := context.Background()
+	err := client.Room("readonly").Append(ctx, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	key, err := client.ReadonlyKey(ctx, "readonly")
+	if err != nil {
+		t.Fatalf("Error getting readonly key: %s", err)
+	}
+	if key == "" || key == "readonly" {
+		t.Fatalf("Bad readonly key: %s", key)
+	}
+	room := client.ReadonlyRoom(key)
+	data, err := room.Next(ctx, true)
+	if err != nil {
+		t.Fatalf("Error reading readonly room: %s", err)
+	}
+	if string(data) != "secret" {
+		t.Fatalf("Unexpected data: %s", data)
+	}
+	if room.Append(ctx, []byte("nope")) == nil {
+		t.Fatalf("Expected error writing through readonly key")
+	}
+}
+
+func TestClaim(t *testing.T) {
+	client := getTestClient(t, testConfig("clientclaim"), nil)
+	ctx := context.Background()
+	room := client.Room("claimed")
+	token, err := room.Claim(ctx, []byte("mine"))
+	if err != nil {
+		t.Fatalf("Error claiming: %s", err)
+	}
+	if token == "" || room.WriteToken != token {
+		t.Fatalf("Token not saved: %s", token)
+	}
+	err = room.Append(ctx, []byte("more"))
+	if err != nil {
+		t.Fatalf("Error appending with token: %s", err)
+	}
+	err = client.Room("claimed").Append(ctx, []byte("intruder"))
+	serr, ok := err.(*StatusError)
+	if !ok || serr.Status != http.StatusForbidden {
+		t.Fatalf("Expected 403 without token, got %v", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var failures atomic.Int32
+	failures.Store(2)
+	flaky := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if failures.Add(-1) >= 0 {
+				http.Error(w, "Active room limit reached", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	client := getTestClient(t, testConfig("clientretry"), flaky)
+	ctx := context.Background()
+	err := client.Room("retry").Append(ctx, []byte("eventually"))
+	if err != nil {
+		t.Fatalf("Expected append to succeed after retries, got %s", err)
+	}
+	// Now too many failures in a row
+	client.Retries = 1
+	failures.Store(2)
+	_, err = client.Room("retry").Next(ctx, true)
+	serr, ok := err.(*StatusError)
+	if !ok || serr.Status != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 after running out of retries, got %v", err)
+	}
+	// Writes might have gone through on other server errors, so they aren't retried
+	client = getTestClient(t, testConfig("clientretrywrite"), func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost && failures.Add(-1) >= 0 {
+				http.Error(w, "Something broke", http.StatusInternalServerError)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	failures.Store(1)
+	err = client.Room("retry").Append(ctx, []byte("once"))
+	serr, ok = err.(*StatusError)
+	if !ok || serr.Status != http.StatusInternalServerError {
+		t.Fatalf("Expected 500 on write without retry, got %v", err)
+	}
+	// Client errors are never retried
+	client.Retries = 3
+	failures.Store(0)
+	err = client.Room("x").Append(ctx, []byte("bad name"))
+	serr, ok = err.(*StatusError)
+	if !ok || serr.Status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 on bad room, got %v", err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	client := getTestClient(t, testConfig("clientreader"), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer := client.Room("tailed")
+	reader := client.Room("tailed").Reader(ctx)
+	go func() {
+		for _, part := range []string{"abc", "defg", "hi"} {
+			writer.Append(ctx, []byte(part))
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	buf := make([]byte, 9)
+	_, err := io.ReadFull(reader, buf)
+	if err != nil {
+		t.Fatalf("Error reading tail: %s", err)
+	}
+	if string(buf) != "abcdefghi" {
+		t.Fatalf("Unexpected tail data: %s", buf)
+	}
+	cancel()
+	_, err = reader.Read(buf)
+	if err != io.EOF {
+		t.Fatalf("Expected EOF after cancel, got %v", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	client := getTestClient(t, testConfig("clientsubscribe"), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer := client.Room("subscribed")
+	err := writer.Append(ctx, []byte("first"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	chunks := client.Room("subscribed").Subscribe(ctx)
+	chunk := <-chunks
+	if chunk.Err != nil || string(chunk.Data) != "first" || chunk.Start != 0 {
+		t.Fatalf("Unexpected first chunk: %v", chunk)
+	}
+	err = writer.Append(ctx, []byte("second"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	chunk = <-chunks
+	if chunk.Err != nil || string(chunk.Data) != "second" || chunk.Start != 5 {
+		t.Fatalf("Unexpected second chunk: %v", chunk)
+	}
+	cancel()
+	for range chunks {
+		// Anything in flight is fine, we just need the channel to close
+	}
+}
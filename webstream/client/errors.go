@@ -0,0 +1,28 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrFramed    = errors.New("room is framed, read it with NextMessages")
+	ErrNotFramed = errors.New("room isn't framed, read it with Next")
+)
+
+// The server answered with something other than success. Message is whatever
+// the server put in the body (usually the actual error)
+type StatusError struct {
+	Status  int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Webstream responded %d: %s", e.Status, e.Message)
+}
+
+// Whether trying the same request again later might work. Server side problems
+// (like running out of active rooms) are usually temporary
+func (e *StatusError) Temporary() bool {
+	return e.Status >= 500
+}
@@ -1,7 +1,10 @@
 package webstream
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/randomouscrap98/goldmonolith/utils"
@@ -11,32 +14,81 @@ import (
 type Config struct {
 	RoomRegex       string
 	StreamFolder    string
+	Backer          string         // Where rooms are persisted: "file" (StreamFolder) or "sqlite" (StreamDatabase)
+	StreamDatabase  string         // Sqlite database for the sqlite backer
+	CompressRooms   bool           // The file backer gzips rooms (uncompressed rooms still load). Every append rewrites the whole room
 	SingleDataLimit int            // Allowed amount of data to write at once
 	StreamDataLimit int            // Allowed amount of data per room
 	TotalRoomLimit  int            // Total amount of rooms allowed to be stored on the filesystem.
 	ActiveRoomLimit int            // Amount of rooms allowed to be active in memory at once (memory issue)
 	IdleRoomTime    utils.Duration // Time since last write = dump if greater
 	ReadTimeout     utils.Duration // How long you're allowed to wait on read before it completes with empty data
-	//TotalDataLimit  int64 // Total amount of data
+	Rolling         bool           // Full rooms drop their oldest data to make space rather than rejecting writes
+	TotalDataLimit  int64          // Total amount of data across all rooms (0 for no limit)
+	ExpireRoomTime  utils.Duration // Time since last write = delete the room entirely (0 for never)
+	AdminKey        string         // Key for admin endpoints (sent as a bearer token)
+	PublicMetrics   bool           // Serve /metrics without the admin key (room names become public)
+	RoomClass       []RoomClass    // Per-room limit overrides, first matching class wins
+	Peers           []string       // Webstream endpoints of every replica, including this one (empty for no replication)
+	PeerSelf        string         // Which of the Peers is this instance
+	PeerKey         string         // Shared secret replicas use when talking to each other
+}
+
+// Limits for a set of rooms, matched by name. Zero values fall back to the global
+// limits in Config
+type RoomClass struct {
+	Regex           string         // Rooms with names matching this use these limits
+	SingleDataLimit int            // Allowed amount of data to write at once
+	StreamDataLimit int            // Allowed amount of data per room
+	ReadTimeout     utils.Duration // How long reads can wait for data
 }
 
 // Retrieve a default configuration in TOML which should parse to
 // a Config object
 func GetDefaultConfig_Toml() string {
+	randomKey := make([]byte, 16)
+	_, err := rand.Read(randomKey)
+	if err != nil {
+		log.Printf("WARN: couldn't generate random admin key")
+	}
+	randomHex := hex.EncodeToString(randomKey)
 	return fmt.Sprintf(`# Config auto-generated on %s
+AdminKey="%s"                       # Admin key for deleting rooms/etc (randomly generated)
+PublicMetrics=false                 # Let anyone read /metrics, not just the admin key (room names are in there)
 RoomRegex="^[a-zA-Z0-9_-]{5,256}$"  # Allowed room names
+Backer="file"                       # How to store data streams: "file" (one per room in StreamFolder) or "sqlite" (StreamDatabase)
 StreamFolder="data/streams"         # Where to store the data streams on the filesystem
+StreamDatabase="data/streams.db"    # Where to store the data streams for the sqlite backer
+CompressRooms=false                 # Gzip rooms in the file backer (old rooms load either way, and are compressed on their next write). Every append rewrites the whole room, so keep this off for busy rooms
 SingleDataLimit=50000               # Allowed amount of data in one write
 StreamDataLimit=5000000             # Allowed amount of data for total room
-# TotalDataLimit=1_000_000_000      # Total amount of data in all rooms
+TotalDataLimit=2_000_000_000        # Total amount of data in all rooms (0 for no limit)
 TotalRoomLimit=400                  # Total amount of rooms allowed to be created.
-ActiveRoomLimit=10                 # Amount of rooms allowed to be active at once
+ActiveRoomLimit=10                 # Amount of rooms allowed to be active at once (idle rooms are unloaded to make space)
 IdleRoomTime="1m"                   # How long a room can have no writes in before dumping it to fs (AGGRESSIVE)
 ReadTimeout="1m"                    # How long you're allowed to wait on read before it completes with empty data
+Rolling=false                       # Full rooms drop their oldest data instead of rejecting writes (offsets never reset)
+ExpireRoomTime="never"              # How long a room can have no writes in before it's deleted entirely
+
+# NOTE: the upper limit of storage is the smaller of TotalDataLimit and
+# TotalRoomLimit * StreamDataLimit. This config targets a 2GB general limit.
+# The total is tracked in memory from what the backer reports on startup, so
+# files added to the backer by hand while running aren't counted
+
+# Replication across several instances. Every replica lists the webstream endpoint
+# of ALL replicas (including itself) in Peers, like "http://10.0.0.2:5000/stream".
+# Each room has one home replica which does all its writes (the others forward
+# writes, deletes, resets and readonly keys there), which then sends them on to the rest
+Peers=[]                            # Webstream endpoints of every replica (empty for no replication)
+PeerSelf=""                         # Which of the Peers is this instance
+PeerKey=""                          # Shared secret for replicas, must be the same everywhere
 
-# NOTE: the upper limit of storage will be the TotalRoomLimit * StreamDataLimit.
-# This config targets a 2GB general limit. It is difficult to enforce a global
-# limit, as each write would require querying the filesystem, which in some cases
-# may be prohibitively slow
-`, time.Now().Format(time.RFC3339))
+# Rooms can have their own limits, matched by name (first match wins). Anything
+# left out uses the limits above. For example:
+#[[Webstream.RoomClass]]
+#Regex="^big-"
+#StreamDataLimit=50_000_000
+#SingleDataLimit=1_000_000
+#ReadTimeout="5m"
+`, time.Now().Format(time.RFC3339), randomHex)
 }
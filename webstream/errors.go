@@ -2,13 +2,19 @@ package webstream
 
 import (
 	"fmt"
+
+	"github.com/randomouscrap98/goldmonolith/webstream/api"
 )
 
 type RoomNameError struct {
-	Regex string
+	Regex    string
+	Reserved bool // The name is fine, but an endpoint already uses it
 }
 
 func (e *RoomNameError) Error() string {
+	if e.Reserved {
+		return "Room name is reserved"
+	}
 	return fmt.Sprintf("Room name has invalid characters! Regex: %s", e.Regex)
 }
 
@@ -35,3 +41,61 @@ type OverCapacityError struct {
 func (e *OverCapacityError) Error() string {
 	return fmt.Sprintf("data overflows capacity: %d", e.Capacity)
 }
+
+type TotalDataLimitError struct {
+	Limit   int64
+	Current int64
+}
+
+func (e *TotalDataLimitError) Error() string {
+	return fmt.Sprintf("Total data limit reached (%d / %d), no more data can be written", e.Current, e.Limit)
+}
+
+type RoomClaimedError struct {
+	Room    string
+	HasData bool // Not claimed, but somebody already wrote to it
+}
+
+func (e *RoomClaimedError) Error() string {
+	if e.HasData {
+		return fmt.Sprintf("Room %s already has data, only new rooms can be claimed", e.Room)
+	}
+	return fmt.Sprintf("Room %s is already claimed", e.Room)
+}
+
+type WriteTokenError struct {
+	Room string
+}
+
+func (e *WriteTokenError) Error() string {
+	return fmt.Sprintf("Room %s is claimed, a valid write token is required", e.Room)
+}
+
+type FramingError struct {
+	Message string
+}
+
+func (e *FramingError) Error() string {
+	return fmt.Sprintf("framing error: %s", e.Message)
+}
+
+// Clients get this too, so it lives with the other shared types
+type TruncatedError = api.TruncatedError
+
+type PeerOffsetError struct {
+	Room     string
+	Expected int
+}
+
+func (e *PeerOffsetError) Error() string {
+	return fmt.Sprintf("out of order peer append for room %s, expected data at %d", e.Room, e.Expected)
+}
+
+type PeerDivergedError struct {
+	Room string
+	At   int
+}
+
+func (e *PeerDivergedError) Error() string {
+	return fmt.Sprintf("peer append for room %s at %d doesn't match the data already there", e.Room, e.At)
+}
@@ -0,0 +1,142 @@
+package webstream
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Write a single server-sent event. SSE doesn't allow raw newlines in a data
+// field, so the data is split into multiple data lines (the client joins them
+// back together with \n). Empty id or event fields are left out
+func writeEvent(w io.Writer, id string, event string, data []byte) error {
+	var buf bytes.Buffer
+	if id != "" {
+		fmt.Fprintf(&buf, "id: %s\n", id)
+	}
+	if event != "" {
+		fmt.Fprintf(&buf, "event: %s\n", event)
+	}
+	// SSE treats \r\n, \r and \n all as line endings; normalize so we split properly
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Keep a connection open and push every write to the room as an SSE event. The
+// id of each event is the offset just past its data, so it can be sent back
+// as-is in Last-Event-ID (or as 'start') to resume. Writes that happen close
+// together may arrive as a single event. The stream ends on its own after
+// ReadTimeout passes with no data; EventSource clients will simply reconnect.
+// If a rolling room dropped the requested data, a 'truncated' event is sent
+// with the new starting offset and the stream continues from there. SSE is
+// text only, so use encoding=base64 for binary rooms. Framed rooms send one
+// event per message instead (without the length prefix), and can start at
+// 'message' rather than 'start'
+func (wc *WebstreamContext) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	room, query, err := wc.parseStreamRequest(w, r)
+	if err != nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	start := query.Start
+	lastid := r.Header.Get("Last-Event-ID")
+	if lastid != "" {
+		start, err = strconv.Atoi(lastid)
+		if err != nil || start < 0 {
+			http.Error(w, "Bad Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+	// Catch the simple problems (bad room name, too many rooms) before we commit to streaming
+	info, err := wc.webstreams.RoomInfo(room)
+	if err != nil {
+		log.Printf("Error during Roominfo: %s", err)
+		http.Error(w, fmt.Sprintf("Error while reading data: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Nginx buffers by default, which breaks streaming
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	timeout := wc.webstreams.RoomLimits(room).ReadTimeout
+	message := query.Message
+	for {
+		var cancel context.Context = nil
+		var cancelfunc context.CancelFunc = func() {}
+		if !query.Nonblocking {
+			cancel, cancelfunc = context.WithTimeout(r.Context(), timeout)
+		}
+		var data []byte
+		var framed *FramedRead
+		if info.Framed {
+			framed, err = wc.webstreams.ReadMessages(room, start, message, query.Count, cancel)
+			if err == nil {
+				data = framed.Raw
+				start = framed.Start
+			}
+			// Only the first read goes by message, after that we know the offset
+			message = -1
+		} else {
+			data, err = wc.webstreams.ReadData(room, start, query.Count, cancel)
+		}
+		cancelfunc()
+		if truncerr, ok := err.(*TruncatedError); ok {
+			// A rolling room dropped what we wanted; say so, then pick up from the oldest data
+			start = truncerr.Start
+			writeEvent(w, strconv.Itoa(start), "truncated", []byte(strconv.Itoa(start)))
+			flusher.Flush()
+			continue
+		}
+		if err != nil {
+			// Too late for a status code, the best we can do is tell them through the stream
+			log.Printf("Error during ReadData (events): %s", err)
+			writeEvent(w, "", "error", []byte(err.Error()))
+			flusher.Flush()
+			return
+		}
+		// Either we timed out, the client went away, or there's just nothing
+		// to read in nonblocking mode. Any way, the stream is over
+		if len(data) == 0 {
+			return
+		}
+		if framed != nil {
+			// Each message is its own event, so resuming from any of them works
+			for _, m := range framed.Messages {
+				start += MessageHeaderSize + len(m)
+				err = writeEvent(w, strconv.Itoa(start), "", []byte(encodeData(m, query.Encoding)))
+				if err != nil {
+					return
+				}
+			}
+		} else {
+			start += len(data)
+			err = writeEvent(w, strconv.Itoa(start), "", []byte(encodeData(data, query.Encoding)))
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		if query.Nonblocking {
+			return
+		}
+	}
+}
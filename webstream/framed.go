@@ -0,0 +1,188 @@
+package webstream
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const (
+	MessageHeaderSize = 4 // Every message in a framed room starts with its length (big endian uint32)
+)
+
+// Messages read out of a framed room. Offsets are the same absolute byte
+// offsets as raw rooms (they include the length prefixes)
+type FramedRead struct {
+	Messages     [][]byte
+	Raw          []byte // All the messages still framed, exactly as stored
+	FirstMessage int    // Index of the first message in Messages
+	Start        int    // Byte offset of the first message
+}
+
+// Index of the message just past the last one read
+func (fr *FramedRead) NextMessage() int {
+	return fr.FirstMessage + len(fr.Messages)
+}
+
+// Byte offset just past the last message read
+func (fr *FramedRead) NextStart() int {
+	return fr.Start + len(fr.Raw)
+}
+
+// Put the length prefix on the message
+func frameMessage(data []byte) []byte {
+	result := make([]byte, MessageHeaderSize+len(data))
+	binary.BigEndian.PutUint32(result, uint32(len(data)))
+	copy(result[MessageHeaderSize:], data)
+	return result
+}
+
+// Go through the framed data and find the absolute offset of every message.
+// It's an error if the data doesn't end on a message boundary
+func indexMessages(data []byte, base int) ([]int, error) {
+	result := make([]int, 0)
+	offset := 0
+	for offset < len(data) {
+		if len(data)-offset < MessageHeaderSize {
+			return nil, &FramingError{Message: fmt.Sprintf("partial header at %d", base+offset)}
+		}
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		if len(data)-offset-MessageHeaderSize < size {
+			return nil, &FramingError{Message: fmt.Sprintf("partial message at %d", base+offset)}
+		}
+		result = append(result, base+offset)
+		offset += MessageHeaderSize + size
+	}
+	return result, nil
+}
+
+// Split framed data into its messages (which point into the given data). Stops
+// after count messages, unless count is negative. Also returns how much of the
+// data was used
+func splitMessages(data []byte, count int) ([][]byte, int) {
+	result := make([][]byte, 0)
+	offset := 0
+	for len(data)-offset >= MessageHeaderSize && (count < 0 || len(result) < count) {
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		end := offset + MessageHeaderSize + size
+		if end > len(data) {
+			break
+		}
+		result = append(result, data[offset+MessageHeaderSize:end])
+		offset = end
+	}
+	return result, offset
+}
+
+// The absolute offset of the first message at or after the given offset
+// (or the end of the stream). Must be loaded
+func (ws *webStream) messageBoundaryNoLock(offset int) int {
+	i := sort.SearchInts(ws.messages, offset)
+	if i < len(ws.messages) {
+		return ws.messages[i]
+	}
+	return ws.length
+}
+
+// Throw away the index for messages which were dropped from the front
+func (ws *webStream) trimMessagesNoLock() {
+	i := sort.SearchInts(ws.messages, ws.base)
+	ws.messages = ws.messages[i:]
+	ws.baseMessage += i
+}
+
+// Turn the room into a framed room, where every write is stored as one discrete
+// message. Only empty rooms can become framed, and it's permanent. Does nothing
+// if the room is already framed
+func (wsys *WebStreamSystem) MakeFramed(name string) error {
+	ws, err := wsys.lockStream(name)
+	if err != nil {
+		return err
+	}
+	defer ws.mu.Unlock()
+	if ws.framed {
+		return nil
+	}
+	if ws.length > 0 {
+		return &FramingError{Message: fmt.Sprintf("room %s already has unframed data", name)}
+	}
+	ws.framed = true
+	ws.messages = make([]int, 0)
+	err = wsys.persistMetaNoLock(name, ws)
+	if err != nil {
+		ws.framed = false
+		return err
+	}
+	return nil
+}
+
+// Figure out both the byte offset and message index to start reading at in a
+// framed room. If message is not negative, it's used instead of start
+func (wsys *WebStreamSystem) locateMessage(name string, start int, message int) (int, int, error) {
+	ws, err := wsys.lockStream(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer ws.mu.Unlock()
+	if !ws.framed {
+		return 0, 0, &FramingError{Message: fmt.Sprintf("room %s is not framed", name)}
+	}
+	// The index is only there when the room is loaded
+	_, err = wsys.refreshStreamNoLock(name, ws)
+	if err != nil {
+		return 0, 0, err
+	}
+	end := ws.baseMessage + len(ws.messages)
+	if message >= 0 {
+		if message < ws.baseMessage {
+			return 0, 0, &TruncatedError{Start: ws.base, Message: ws.baseMessage}
+		}
+		if message > end {
+			return 0, 0, &FramingError{Message: fmt.Sprintf("message %d doesn't exist yet", message)}
+		}
+		if message == end {
+			return ws.length, message, nil
+		}
+		return ws.messages[message-ws.baseMessage], message, nil
+	}
+	if start < ws.base {
+		return 0, 0, &TruncatedError{Start: ws.base, Message: ws.baseMessage}
+	}
+	if start == ws.length {
+		return start, end, nil
+	}
+	i := sort.SearchInts(ws.messages, start)
+	if i >= len(ws.messages) || ws.messages[i] != start {
+		return 0, 0, &FramingError{Message: fmt.Sprintf("%d is not the start of a message", start)}
+	}
+	return start, ws.baseMessage + i, nil
+}
+
+// Read whole messages out of a framed room, blocking just like ReadData. Start
+// at either the byte offset or message index (if message is not negative), and
+// read up to count messages (or all of them if count is negative)
+func (wsys *WebStreamSystem) ReadMessages(name string, start int, message int, count int, cancel context.Context) (*FramedRead, error) {
+	return wsys.readMessages(name, start, message, count, cancel, true)
+}
+
+// The real ReadMessages. Set listen to false like readData
+func (wsys *WebStreamSystem) readMessages(name string, start int, message int, count int, cancel context.Context, listen bool) (*FramedRead, error) {
+	start, message, err := wsys.locateMessage(name, start, message)
+	if err != nil {
+		return nil, err
+	}
+	// Messages are never changed once written, so the offset we found is good forever
+	// (as long as a rolling room doesn't drop it, which ReadData will tell us about)
+	data, err := wsys.readData(name, start, -1, cancel, listen)
+	if err != nil {
+		return nil, err
+	}
+	messages, used := splitMessages(data, count)
+	return &FramedRead{
+		Messages:     messages,
+		Raw:          data[:used],
+		FirstMessage: message,
+		Start:        start,
+	}, nil
+}
@@ -0,0 +1,111 @@
+package webstream
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds (in seconds) for the dump duration histogram
+var dumpBuckets = [...]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Running counts of things the system does, for the metrics endpoint. Everything
+// is atomic so it can be bumped from anywhere without caring about locks
+type webStreamMetrics struct {
+	appends         atomic.Int64
+	appendBytes     atomic.Int64
+	readsImmediate  atomic.Int64
+	readsBlocked    atomic.Int64
+	overCapacity    atomic.Int64
+	activeRoomLimit atomic.Int64
+	totalDataLimit  atomic.Int64
+	evictions       atomic.Int64
+	dumpBuckets     [len(dumpBuckets)]atomic.Int64 // NOT cumulative, that's done on output
+	dumpCount       atomic.Int64
+	dumpNanos       atomic.Int64
+}
+
+// Count any of the errors we care about
+func (m *webStreamMetrics) countError(err error) {
+	switch err.(type) {
+	case *OverCapacityError:
+		m.overCapacity.Add(1)
+	case *ActiveRoomLimitError:
+		m.activeRoomLimit.Add(1)
+	case *TotalDataLimitError:
+		m.totalDataLimit.Add(1)
+	}
+}
+
+func (m *webStreamMetrics) observeDump(duration time.Duration) {
+	m.dumpCount.Add(1)
+	m.dumpNanos.Add(int64(duration))
+	for i, bound := range dumpBuckets {
+		if duration.Seconds() <= bound {
+			m.dumpBuckets[i].Add(1)
+			return
+		}
+	}
+}
+
+// Room names end up in label values, which have their own escaping
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+// Write all the metrics for the system in the Prometheus text format. Appends
+// per second and the like are left to the scraper (use rate())
+func (wsys *WebStreamSystem) WriteMetrics(w io.Writer) {
+	m := &wsys.metrics
+	infos := wsys.AllRoomInfo()
+	writeMetric(w, "webstream_rooms", "gauge", "Rooms the system knows about.", len(infos))
+	writeMetric(w, "webstream_room_limit", "gauge", "Maximum amount of rooms (TotalRoomLimit).", wsys.config.TotalRoomLimit)
+	writeMetric(w, "webstream_active_rooms", "gauge", "Rooms currently loaded in memory.", wsys.ActiveCount())
+	writeMetric(w, "webstream_active_room_limit", "gauge", "Maximum amount of rooms in memory (ActiveRoomLimit).", wsys.config.ActiveRoomLimit)
+	writeMetric(w, "webstream_data_bytes", "gauge", "Data stored across all rooms.", wsys.TotalData())
+	writeMetric(w, "webstream_data_limit_bytes", "gauge", "Maximum data across all rooms (TotalDataLimit, 0 is unlimited).", wsys.config.TotalDataLimit)
+
+	names := make([]string, 0, len(infos))
+	for k := range infos {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "# HELP webstream_room_bytes Data stored in each room.\n# TYPE webstream_room_bytes gauge\n")
+	for _, k := range names {
+		fmt.Fprintf(w, "webstream_room_bytes{room=\"%s\"} %d\n", escapeLabel(k), infos[k].Length-infos[k].Base)
+	}
+	fmt.Fprintf(w, "# HELP webstream_room_listeners Listeners currently waiting on each room.\n# TYPE webstream_room_listeners gauge\n")
+	for _, k := range names {
+		fmt.Fprintf(w, "webstream_room_listeners{room=\"%s\"} %d\n", escapeLabel(k), infos[k].ListenerCount)
+	}
+
+	writeMetric(w, "webstream_appends_total", "counter", "Successful appends to any room.", m.appends.Load())
+	writeMetric(w, "webstream_append_bytes_total", "counter", "Data appended to any room.", m.appendBytes.Load())
+	fmt.Fprintf(w, "# HELP webstream_reads_total Reads, by whether they had to wait for data.\n# TYPE webstream_reads_total counter\n")
+	fmt.Fprintf(w, "webstream_reads_total{mode=\"immediate\"} %d\n", m.readsImmediate.Load())
+	fmt.Fprintf(w, "webstream_reads_total{mode=\"blocked\"} %d\n", m.readsBlocked.Load())
+	fmt.Fprintf(w, "# HELP webstream_errors_total Limit errors, by type.\n# TYPE webstream_errors_total counter\n")
+	fmt.Fprintf(w, "webstream_errors_total{type=\"overcapacity\"} %d\n", m.overCapacity.Load())
+	fmt.Fprintf(w, "webstream_errors_total{type=\"activeroomlimit\"} %d\n", m.activeRoomLimit.Load())
+	fmt.Fprintf(w, "webstream_errors_total{type=\"totaldatalimit\"} %d\n", m.totalDataLimit.Load())
+	writeMetric(w, "webstream_evictions_total", "counter", "Rooms unloaded early to make space for another.", m.evictions.Load())
+
+	fmt.Fprintf(w, "# HELP webstream_dump_duration_seconds Time taken by each DumpStreams pass.\n# TYPE webstream_dump_duration_seconds histogram\n")
+	var cumulative int64
+	for i, bound := range dumpBuckets {
+		cumulative += m.dumpBuckets[i].Load()
+		fmt.Fprintf(w, "webstream_dump_duration_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	// Read the count last so the +Inf bucket is never less than the others
+	count := m.dumpCount.Load()
+	fmt.Fprintf(w, "webstream_dump_duration_seconds_bucket{le=\"+Inf\"} %d\n", max(count, cumulative))
+	fmt.Fprintf(w, "webstream_dump_duration_seconds_sum %g\n", time.Duration(m.dumpNanos.Load()).Seconds())
+	fmt.Fprintf(w, "webstream_dump_duration_seconds_count %d\n", max(count, cumulative))
+}
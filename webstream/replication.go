@@ -0,0 +1,503 @@
+package webstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/randomouscrap98/goldmonolith/utils"
+)
+
+const (
+	PeerKeyHeader       = "X-Peer-Key"       // Replicas prove who they are with the PeerKey in this
+	ExpectedStartHeader = "X-Expected-Start" // Where a replica wanted an out of order append to start
+	PeerQueueSize       = 1000               // Changes waiting to go out to each replica before we start dropping them
+	PeerRetryWait       = time.Second        // How long to wait before sending to a replica that's down again
+	PeerArchiveOverhead = 64 * 1024          // Room copies are tar archives, which need some room on top of the data
+)
+
+// The kinds of changes replicas send each other
+const (
+	peerAppend  = "append"  // A chunk of data, exactly as stored
+	peerDelete  = "delete"  // The room is gone
+	peerReplace = "replace" // The whole room, data and metadata (resets, readonly keys, fixing drift)
+)
+
+// A change to a room to send to another replica. Only appends carry their
+// data; replacements are read from the room when they're sent
+type peerChange struct {
+	kind   string
+	room   string
+	at     int
+	data   []byte
+	framed bool
+}
+
+// Keeps the rooms on every replica the same. Each room has a single home replica
+// which does all the writes for it (the others forward writes there), so offsets
+// are only ever decided in one place. The home then sends every chunk it stores
+// to all the other replicas, which apply them in offset order. Deletes (including
+// expiry), resets and readonly key changes go out through the same queue, so
+// they land in the same order everywhere. Admin imports are still per replica
+type replicator struct {
+	self   string
+	nodes  []string // Every replica, sorted so everyone agrees on homes
+	key    string
+	client *http.Client
+	queues map[string]chan *peerChange // Changes waiting to go out to each other replica
+	wsys   *WebStreamSystem
+}
+
+// Set up replication for the system from the config. Returns nil if there's
+// no replication configured
+func newReplicator(config *Config, wsys *WebStreamSystem) (*replicator, error) {
+	if len(config.Peers) == 0 {
+		return nil, nil
+	}
+	if config.PeerKey == "" {
+		return nil, fmt.Errorf("replication requires a PeerKey")
+	}
+	self := strings.TrimSuffix(config.PeerSelf, "/")
+	nodes := make([]string, 0, len(config.Peers))
+	for _, peer := range config.Peers {
+		nodes = append(nodes, strings.TrimSuffix(peer, "/"))
+	}
+	slices.Sort(nodes)
+	nodes = slices.Compact(nodes)
+	if !slices.Contains(nodes, self) {
+		return nil, fmt.Errorf("PeerSelf %q is not one of the Peers", config.PeerSelf)
+	}
+	rp := &replicator{
+		self:   self,
+		nodes:  nodes,
+		key:    config.PeerKey,
+		client: &http.Client{Timeout: time.Minute},
+		queues: make(map[string]chan *peerChange),
+		wsys:   wsys,
+	}
+	for _, node := range nodes {
+		if node != self {
+			rp.queues[node] = make(chan *peerChange, PeerQueueSize)
+		}
+	}
+	wsys.SetAppendHook(rp.enqueueAppend)
+	wsys.SetChangeHook(rp.enqueueChange)
+	return rp, nil
+}
+
+// The replica which does all the writes for the given room
+func (rp *replicator) home(room string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(room))
+	return rp.nodes[hash.Sum32()%uint32(len(rp.nodes))]
+}
+
+// Where writes for the room need to go, or empty if they're ours to do (which
+// is always the case without replication)
+func (rp *replicator) forwardTo(room string) string {
+	if rp == nil {
+		return ""
+	}
+	home := rp.home(room)
+	if home == rp.self {
+		return ""
+	}
+	return home
+}
+
+// Whether the request came from another replica
+func (rp *replicator) isPeer(r *http.Request) bool {
+	if rp == nil {
+		return false
+	}
+	key := r.Header.Get(PeerKeyHeader)
+	return subtle.ConstantTimeCompare([]byte(key), []byte(rp.key)) == 1
+}
+
+// Queue a change to go out to every other replica. This is called with the room
+// locked, so changes for a room are always queued in order
+func (rp *replicator) enqueue(pc *peerChange) {
+	for peer, queue := range rp.queues {
+		select {
+		case queue <- pc:
+		default:
+			// Not the end of the world: the replica tells us what it's missing on the next append
+			log.Printf("WARN: Queue for replica %s is full, dropping %s for %s\n", peer, pc.kind, pc.room)
+		}
+	}
+}
+
+// Queue a chunk we just stored (see SetAppendHook)
+func (rp *replicator) enqueueAppend(room string, at int, data []byte, framed bool) {
+	rp.enqueue(&peerChange{kind: peerAppend, room: room, at: at, data: bytes.Clone(data), framed: framed})
+}
+
+// Queue any other change to a room (see SetChangeHook). Only the home speaks for
+// the room; everyone else is just applying what the home sent them
+func (rp *replicator) enqueueChange(room string, deleted bool) {
+	if rp.home(room) != rp.self {
+		return
+	}
+	kind := peerReplace
+	if deleted {
+		kind = peerDelete
+	}
+	rp.enqueue(&peerChange{kind: kind, room: room})
+}
+
+// Send everything queued to the other replicas until cancelled. Whatever's
+// still queued on shutdown is lost, but replicas catch up on the next append
+func (rp *replicator) run(cancel context.Context, wg *sync.WaitGroup) {
+	for peer, queue := range rp.queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-cancel.Done():
+					return
+				case pc := <-queue:
+					rp.deliver(cancel, peer, pc)
+				}
+			}
+		}()
+	}
+}
+
+// Keep trying to get the change to the replica until it takes it, it refuses it
+// outright, or we're shutting down. Replicas which missed something are sent
+// what they're missing from our own copy of the room, and replicas which no
+// longer match us (or are missing more than we have) get the whole room
+func (rp *replicator) deliver(cancel context.Context, peer string, pc *peerChange) {
+	for {
+		status, expected, err := rp.send(cancel, peer, pc)
+		if cancel.Err() != nil {
+			return
+		}
+		if err != nil || status >= 500 {
+			log.Printf("WARN: Couldn't send %s for %s to replica %s (status %d), retrying: %v\n", pc.kind, pc.room, peer, status, err)
+			select {
+			case <-cancel.Done():
+				return
+			case <-time.After(PeerRetryWait):
+			}
+			continue
+		}
+		if status == http.StatusConflict && pc.kind == peerAppend {
+			end := pc.at + len(pc.data)
+			if expected >= end {
+				return // They already have it
+			}
+			data, err := rp.wsys.readData(pc.room, expected, end-expected, nil, false)
+			if err == nil {
+				pc = &peerChange{kind: peerAppend, room: pc.room, at: expected, data: data, framed: pc.framed}
+				continue
+			}
+			// Rolling rooms may have dropped it already, so they get everything we still have
+			log.Printf("WARN: Couldn't catch up replica %s on %s at %d, sending the whole room: %s\n", peer, pc.room, expected, err)
+			pc = &peerChange{kind: peerReplace, room: pc.room}
+			continue
+		}
+		if status == http.StatusPreconditionFailed && pc.kind == peerAppend {
+			log.Printf("ERROR: Replica %s has different data for %s at %d, sending the whole room\n", peer, pc.room, pc.at)
+			pc = &peerChange{kind: peerReplace, room: pc.room}
+			continue
+		}
+		if status >= 400 {
+			log.Printf("WARN: Replica %s refused %s for %s (status %d)\n", peer, pc.kind, pc.room, status)
+		}
+		return
+	}
+}
+
+// Send a single change to the replica. Returns the status and, for out of order
+// appends, where the replica wanted it to start. Replacements that find the room
+// already gone don't send anything (the delete is queued after them)
+func (rp *replicator) send(cancel context.Context, peer string, pc *peerChange) (int, int, error) {
+	endpoint := fmt.Sprintf("%s/peer/%s/%s", peer, pc.kind, url.PathEscape(pc.room))
+	var body []byte
+	switch pc.kind {
+	case peerAppend:
+		endpoint += fmt.Sprintf("?at=%d&framed=%t", pc.at, pc.framed)
+		body = pc.data
+	case peerReplace:
+		var archive bytes.Buffer
+		err := rp.wsys.ExportRooms(&archive, []string{pc.room})
+		if _, ok := err.(*utils.NotFoundError); ok {
+			return http.StatusNoContent, 0, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		body = archive.Bytes()
+	}
+	request, err := http.NewRequestWithContext(cancel, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	request.Header.Set(PeerKeyHeader, rp.key)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	response, err := rp.client.Do(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	expected, _ := strconv.Atoi(response.Header.Get(ExpectedStartHeader))
+	return response.StatusCode, expected, nil
+}
+
+// Where to send a request for the room (plus whatever comes after the room in
+// the path) on the given replica
+func roomEndpoint(home string, room string, suffix string) string {
+	return home + "/" + url.PathEscape(room) + suffix
+}
+
+// Send a write (or admin change) on to the room's home replica, exactly as the
+// client gave it to us
+func (rp *replicator) forward(method string, endpoint string, query string, header http.Header, body io.Reader) (*http.Response, error) {
+	if query != "" {
+		endpoint += "?" + query
+	}
+	request, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range []string{"Content-Type", "Authorization", WriteTokenHeader} {
+		if v := header.Get(h); v != "" {
+			request.Header.Set(h, v)
+		}
+	}
+	// Replicas should never forward a write twice, even if they disagree on the home
+	request.Header.Set(PeerKeyHeader, rp.key)
+	return rp.client.Do(request)
+}
+
+// Pass a client's request for the room on to the room's home replica, then pass
+// the home's response back to the client. The suffix is whatever comes after the
+// room in the path
+func (rp *replicator) forwardRequest(w http.ResponseWriter, r *http.Request, home string, room string, suffix string) {
+	response, err := rp.forward(r.Method, roomEndpoint(home, room, suffix), r.URL.RawQuery, r.Header, r.Body)
+	if err != nil {
+		log.Printf("Couldn't forward %s for %s to %s: %s\n", r.Method, room, home, err)
+		http.Error(w, "Couldn't reach the server for this room", http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+	for _, h := range []string{"Content-Type", WriteTokenHeader} {
+		if v := response.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
+}
+
+// Forward a single append (like from a socket) to the room's home replica
+func (rp *replicator) forwardAppend(home string, room string, data []byte, token string) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	if token != "" {
+		header.Set(WriteTokenHeader, token)
+	}
+	response, err := rp.forward("POST", roomEndpoint(home, room, ""), "", header, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		message, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("%s", strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// Have the system tell you about every chunk it stores from a normal append: the
+// room, the absolute offset it went to, the data exactly as stored, and whether
+// the room is framed. Called with the room locked, so it must not block
+func (wsys *WebStreamSystem) SetAppendHook(hook func(string, int, []byte, bool)) {
+	wsys.appendHook = hook
+}
+
+// Have the system tell you about every other change to a room: true when other
+// copies of the room should be thrown away (it was deleted or expired, or it has
+// nothing worth copying), false when it changed in a way that needs the whole
+// room copied (resets, readonly keys). Called with the room locked, so it must
+// not block
+func (wsys *WebStreamSystem) SetChangeHook(hook func(string, bool)) {
+	wsys.changeHook = hook
+}
+
+func (wsys *WebStreamSystem) roomChangedNoLock(name string, deleted bool) {
+	if wsys.changeHook != nil {
+		wsys.changeHook(name, deleted)
+	}
+}
+
+// Ask the room's home replica for the room's readonly key (it makes one if
+// there isn't one yet), so the key is the same everywhere
+func (rp *replicator) fetchReadonlyKey(home string, room string) (string, error) {
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s/peer/readonlykey/%s", home, url.PathEscape(room)), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set(PeerKeyHeader, rp.key)
+	response, err := rp.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d: %s", response.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+// Store a chunk of data sent from the room's home replica at the given offset,
+// exactly as the home stored it. Anything we already have is skipped (as long as
+// it matches, otherwise it's a PeerDivergedError), and chunks past the end of the
+// room are rejected with a PeerOffsetError saying where the data needs to start.
+// Write tokens aren't checked (the home already did)
+func (wsys *WebStreamSystem) ApplyPeerAppend(name string, at int, data []byte, framed bool) error {
+	ws, err := wsys.lockStream(name)
+	if err != nil {
+		return err
+	}
+	defer ws.mu.Unlock()
+	_, err = wsys.refreshStreamNoLock(name, ws)
+	if err != nil {
+		return err
+	}
+	if framed && !ws.framed {
+		if ws.length > 0 {
+			return &FramingError{Message: fmt.Sprintf("room %s already has unframed data", name)}
+		}
+		ws.framed = true
+		ws.messages = make([]int, 0)
+	}
+	if at > ws.length {
+		return &PeerOffsetError{Room: name, Expected: ws.length}
+	}
+	// Chunks we already have come from retries and catching up, so they had better
+	// be the same. Anything older than what we still store can't be checked
+	from, end := max(at, ws.base), min(ws.length, at+len(data))
+	if from < end && !bytes.Equal(ws.data[from-ws.base:end-ws.base], data[from-at:end-at]) {
+		return &PeerDivergedError{Room: name, At: at}
+	}
+	skip := ws.length - at
+	if skip >= len(data) {
+		return nil
+	}
+	return wsys.appendNoLock(ws, data[skip:])
+}
+
+// Accept an append from the room's home replica (see ApplyPeerAppend)
+func (wc *WebstreamContext) PeerAppend(w http.ResponseWriter, r *http.Request) {
+	if !wc.replicator.isPeer(r) {
+		http.Error(w, "Peer key required", http.StatusUnauthorized)
+		return
+	}
+	room := chi.URLParam(r, "room")
+	at, err := strconv.Atoi(r.URL.Query().Get("at"))
+	if err != nil || at < 0 {
+		http.Error(w, "Bad offset", http.StatusBadRequest)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(wc.webstreams.RoomLimits(room).StreamDataLimit))
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Can't read post body (maybe it's too long?)", http.StatusBadRequest)
+		return
+	}
+	err = wc.webstreams.ApplyPeerAppend(room, at, data, r.URL.Query().Get("framed") == "true")
+	if offseterr, ok := err.(*PeerOffsetError); ok {
+		w.Header().Set(ExpectedStartHeader, strconv.Itoa(offseterr.Expected))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if _, ok := err.(*PeerDivergedError); ok {
+		log.Printf("ERROR: %s\n", err)
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		log.Printf("Peer append error for room %s: %s\n", room, err)
+		status := http.StatusBadRequest
+		if _, ok := err.(*ActiveRoomLimitError); ok {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, fmt.Sprintf("Couldn't append to room: %s", err), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Remove a room the home replica deleted. Rooms we never had are fine
+func (wc *WebstreamContext) PeerDelete(w http.ResponseWriter, r *http.Request) {
+	if !wc.replicator.isPeer(r) {
+		http.Error(w, "Peer key required", http.StatusUnauthorized)
+		return
+	}
+	room := chi.URLParam(r, "room")
+	err := wc.webstreams.DeleteRoom(room)
+	if _, ok := err.(*utils.NotFoundError); ok {
+		err = nil
+	}
+	if err == nil {
+		wc.obfuscator.RemoveObfuscatedKey(room)
+	}
+	respondRoomAdmin(w, room, "peer delete", err)
+}
+
+// Replace a room with the home replica's copy (an archive from ExportRooms)
+func (wc *WebstreamContext) PeerReplace(w http.ResponseWriter, r *http.Request) {
+	if !wc.replicator.isPeer(r) {
+		http.Error(w, "Peer key required", http.StatusUnauthorized)
+		return
+	}
+	room := chi.URLParam(r, "room")
+	r.Body = http.MaxBytesReader(w, r.Body, int64(wc.webstreams.RoomLimits(room).StreamDataLimit)+PeerArchiveOverhead)
+	imported, err := wc.webstreams.ImportRooms(r.Body)
+	wc.restoreReadonlyKeys(imported)
+	if err == nil && (len(imported) != 1 || imported[0] != room) {
+		err = fmt.Errorf("expected archive of just %s, got %v", room, imported)
+	}
+	if err != nil {
+		log.Printf("Peer replace error for room %s: %s\n", room, err)
+		http.Error(w, fmt.Sprintf("Couldn't replace room: %s", err), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Replaced room %s with the copy from its home\n", room)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Give another replica the room's readonly key, making it if needed. We're the
+// room's home, so ours is the real one
+func (wc *WebstreamContext) PeerReadonlyKey(w http.ResponseWriter, r *http.Request) {
+	if !wc.replicator.isPeer(r) {
+		http.Error(w, "Peer key required", http.StatusUnauthorized)
+		return
+	}
+	room := chi.URLParam(r, "room")
+	if wc.webstreams.checkRoomName(room) != nil {
+		http.Error(w, "Bad room name", http.StatusBadRequest)
+		return
+	}
+	utils.RespondPlaintext([]byte(wc.getReadonlyKey(room)), w)
+}
@@ -1,26 +1,127 @@
 package webstream
 
 import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/randomouscrap98/goldmonolith/utils"
+
+	_ "github.com/mattn/go-sqlite3"
 )
 
+const (
+	MetaFolder      = ".meta" // Subfolder in the stream folder for room metadata
+	TempFolder      = ".temp" // Subfolder in the stream folder for files that aren't done being written
+	CompressedExt   = ".gz"   // Rooms stored compressed have this on the end of the file
+	BackerFile      = "file"
+	BackerSqlite    = "sqlite"
+	DatabaseVersion = "1"
+	BusyTimeout     = 5000
+)
+
+// Extra persisted information about a room that isn't the data itself
+type WebStreamMeta struct {
+	Base        int       `json:"base"`                  // Absolute offset of the first stored byte (rolling rooms drop old data)
+	LastWrite   time.Time `json:"lastwrite"`             // Last time data was written to the room
+	WriteToken  string    `json:"writetoken,omitempty"`  // Hash of the token needed to write to the room (empty = unclaimed)
+	ReadonlyKey string    `json:"readonlykey,omitempty"` // Public key for readonly access to the room
+	Framed      bool      `json:"framed,omitempty"`      // Every write is stored as a length prefixed message
+	BaseMessage int       `json:"basemessage,omitempty"` // Index of the first stored message (framed rooms drop old messages too)
+	Stored      *int      `json:"stored,omitempty"`      // Bytes of backing the room really has; anything past it is from a crashed write (nil = older rooms)
+}
+
 // Streams are in-memory for maximum performance and minimum complexity.
 // However, they can periodically be dumped to a "backer" for
 // permanent (or otherwise) storage
 type WebStreamBacker interface {
 	// Write the given data to the backing at the given string. Does a full overwrite
 	Write(string, []byte) error
+	// Add the given data to the end of the backing, which is expected to hold exactly
+	// the given length already. Anything past that length (say, from a failed append)
+	// is thrown away first. It is an error if the backing holds less than that
+	Append(string, []byte, int) error
 	// Returns the full backing data, letting you know if it previous existed or not.
 	// Pass the capacity for the newly created byte array
 	Read(string, int) ([]byte, bool, error)
 	// Repeatedly calls your given function for each backing available in the system.
 	// Useful for searches or otherwise
 	BackingIterator(func(string, func() int) bool) error
+	// Retrieve the metadata for the given backing. Rooms without metadata
+	// get the default (empty) metadata rather than an error, though LastWrite
+	// should fall back to whatever modification time the backing has
+	ReadMeta(string) (*WebStreamMeta, error)
+	// Write the metadata for the given backing. Does a full overwrite
+	WriteMeta(string, *WebStreamMeta) error
+	// Write the data and the metadata together, full overwrite of both. A crash
+	// leaves both old or both new, never the new data with the old metadata (which
+	// would shift every offset in a room that dropped data)
+	WriteWithMeta(string, []byte, *WebStreamMeta) error
+	// Remove the backing and its metadata entirely. Not an error if it doesn't exist
+	Delete(string) error
+}
+
+// Create whichever backer the config asks for
+func NewConfigBacker(config *Config) (WebStreamBacker, error) {
+	switch config.Backer {
+	case "", BackerFile:
+		backer, err := NewFileBacker(config.StreamFolder)
+		if err != nil {
+			return nil, err
+		}
+		backer.Compress = config.CompressRooms
+		return backer, nil
+	case BackerSqlite:
+		backer, err := NewSqliteBacker(config.StreamDatabase)
+		if err != nil {
+			return nil, err
+		}
+		return backer, nil
+	default:
+		return nil, fmt.Errorf("unknown webstream backer: %s", config.Backer)
+	}
+}
+
+// Copy every room (and its metadata) from one backer into another, overwriting
+// whatever is there. Returns the number of rooms copied
+func MigrateBacker(from WebStreamBacker, to WebStreamBacker) (int, error) {
+	// Don't do the copying inside the iterator, some backers might not like that
+	rooms := make(map[string]int)
+	err := from.BackingIterator(func(k string, gl func() int) bool {
+		rooms[k] = gl()
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for k, length := range rooms {
+		data, _, err := from.Read(k, length)
+		if err != nil {
+			return count, err
+		}
+		meta, err := from.ReadMeta(k)
+		if err != nil {
+			return count, err
+		}
+		err = to.WriteWithMeta(k, data, meta)
+		if err != nil {
+			return count, err
+		}
+		count += 1
+	}
+	return count, nil
 }
 
 func Exists(b WebStreamBacker, name string) (bool, error) {
@@ -44,65 +145,366 @@ type WebStreamBacker_File struct {
 	// such that only one can happen at a time (on purpose)
 	mu     sync.Mutex
 	Folder string
+	// Write rooms gzipped. Rooms are read either way, based on the file extension.
+	// gzip can't be appended to in place, so EVERY append to a compressed room
+	// reads, recompresses and rewrites the whole room: only use it for rooms which
+	// are written rarely or are small
+	Compress bool
 }
 
 func NewFileBacker(folder string) (*WebStreamBacker_File, error) {
-	err := os.MkdirAll(folder, 0750)
+	err := os.MkdirAll(filepath.Join(folder, MetaFolder), 0750)
 	if err != nil {
 		return nil, err
 	}
-	return &WebStreamBacker_File{
+	err = os.MkdirAll(filepath.Join(folder, TempFolder), 0750)
+	if err != nil {
+		return nil, err
+	}
+	wb := &WebStreamBacker_File{
 		Folder: folder,
-	}, nil
+	}
+	err = wb.recover()
+	if err != nil {
+		return nil, err
+	}
+	return wb, nil
+}
+
+// Metadata as it's stored on disk. Pending is the file in the temp folder with the
+// data that goes with this metadata, if it hasn't been moved into place yet (see
+// WriteWithMeta)
+type fileMeta struct {
+	WebStreamMeta
+	Pending string `json:"pending,omitempty"`
+}
+
+// Finish any WriteWithMeta that crashed after the metadata was written, then
+// throw out everything else in the temp folder (writes that never finished)
+func (wb *WebStreamBacker_File) recover() error {
+	metas, err := os.ReadDir(filepath.Join(wb.Folder, MetaFolder))
+	if err != nil {
+		return err
+	}
+	for _, de := range metas {
+		name, ok := strings.CutSuffix(de.Name(), ".json")
+		if !ok || de.IsDir() {
+			continue
+		}
+		meta, err := wb.readMetaNoLock(name)
+		if err != nil {
+			return err
+		}
+		if meta.Pending != "" {
+			err = wb.finishPendingNoLock(name, meta)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	temps, err := os.ReadDir(filepath.Join(wb.Folder, TempFolder))
+	if err != nil {
+		return err
+	}
+	for _, de := range temps {
+		err = os.RemoveAll(filepath.Join(wb.Folder, TempFolder, de.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (wb *WebStreamBacker_File) fpath(name string) string {
 	return filepath.Join(wb.Folder, name)
 }
 
-func (wb *WebStreamBacker_File) Write(name string, data []byte) error {
-	wb.mu.Lock()
-	defer wb.mu.Unlock()
-	writer, err := os.Create(wb.fpath(name))
+func (wb *WebStreamBacker_File) gzpath(name string) string {
+	return wb.fpath(name) + CompressedExt
+}
+
+// Find the file currently holding the room and whether it's compressed. If both
+// kinds exist (a crash while switching), the kind we write is the newer one.
+// Returns an empty path if the room has no file
+func (wb *WebStreamBacker_File) findNoLock(name string) (string, bool, error) {
+	order := []bool{false, true}
+	if wb.Compress {
+		order = []bool{true, false}
+	}
+	for _, compressed := range order {
+		path := wb.fpath(name)
+		if compressed {
+			path = wb.gzpath(name)
+		}
+		_, err := os.Stat(path)
+		if err == nil {
+			return path, compressed, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", false, err
+		}
+	}
+	return "", false, nil
+}
+
+// Gzip stores the uncompressed size (mod 4GB, rooms are never that big) in the
+// last 4 bytes, so we don't have to decompress the whole thing to get the length
+func gzipLength(file *os.File) (int, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if stat.Size() < 4 {
+		return 0, fmt.Errorf("compressed room %s is too short", file.Name())
+	}
+	var trailer [4]byte
+	_, err = file.ReadAt(trailer[:], stat.Size()-4)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.LittleEndian.Uint32(trailer[:])), nil
+}
+
+func (wb *WebStreamBacker_File) metapath(name string) string {
+	return filepath.Join(wb.Folder, MetaFolder, name+".json")
+}
+
+// Write the data to a new file in the temp folder (named by the CreateTemp pattern)
+// and make sure it's on disk. Returns the full path; removing it is up to you
+func (wb *WebStreamBacker_File) writeTemp(pattern string, data []byte) (string, error) {
+	temp, err := os.CreateTemp(filepath.Join(wb.Folder, TempFolder), pattern)
+	if err != nil {
+		return "", err
+	}
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	closeErr := temp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	return temp.Name(), nil
+}
+
+// Write the whole file somewhere else first, then swap it in. A crash in the
+// middle leaves either the old file or the new file, never half of one
+func (wb *WebStreamBacker_File) writeAtomic(path string, data []byte) error {
+	temp, err := wb.writeTemp(filepath.Base(path)+"_*", data)
 	if err != nil {
 		return err
 	}
-	defer writer.Close()
-	_, err = writer.Write(data)
-	return err
+	// Does nothing if the rename went through
+	defer os.Remove(temp)
+	err = os.Rename(temp, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
 }
 
-func (wb *WebStreamBacker_File) Read(name string, capacity int) ([]byte, bool, error) {
+// The rename itself isn't durable until the directory is synced
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Put the data in whichever format we're set to. Returns what to actually write
+// and whether it's compressed
+func (wb *WebStreamBacker_File) encode(data []byte) ([]byte, bool, error) {
+	if !wb.Compress {
+		return data, false, nil
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write(data)
+	if err != nil {
+		return nil, false, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+// The path for the room in the given format, and the path for the other format
+func (wb *WebStreamBacker_File) formatPaths(name string, compressed bool) (string, string) {
+	if compressed {
+		return wb.gzpath(name), wb.fpath(name)
+	}
+	return wb.fpath(name), wb.gzpath(name)
+}
+
+// Get rid of the room in the format we're not using, so there's only ever one copy
+func removeOther(other string) error {
+	err := os.Remove(other)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Write the room in whichever format we're set to, then get rid of the other
+// format so there's only ever one copy
+func (wb *WebStreamBacker_File) writeNoLock(name string, data []byte) error {
+	data, compressed, err := wb.encode(data)
+	if err != nil {
+		return err
+	}
+	path, other := wb.formatPaths(name, compressed)
+	err = wb.writeAtomic(path, data)
+	if err != nil {
+		return err
+	}
+	return removeOther(other)
+}
+
+func (wb *WebStreamBacker_File) Write(name string, data []byte) error {
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
-	backing, err := os.Open(wb.fpath(name))
+	return wb.writeNoLock(name, data)
+}
+
+func (wb *WebStreamBacker_File) Append(name string, data []byte, at int) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	path, compressed, err := wb.findNoLock(name)
 	if err != nil {
-		if errors.Is(err, fs.ErrNotExist) {
-			// File doesn't exist, create memory and tell the caller there's no file
-			return make([]byte, 0, capacity), false, nil
+		return err
+	}
+	if compressed || (wb.Compress && path != "") {
+		// Can't append to the middle of a gzip stream, so compressed rooms (or rooms
+		// which are about to be) are rewritten whole
+		stream, _, err := wb.readNoLock(name, at+len(data))
+		if err != nil {
+			return err
+		}
+		if len(stream) < at {
+			return fmt.Errorf("backing for %s has %d bytes, expected %d", name, len(stream), at)
+		}
+		return wb.writeNoLock(name, append(stream[:at], data...))
+	}
+	if wb.Compress {
+		// Brand new room, nothing to rewrite
+		if at > 0 {
+			return fmt.Errorf("backing for %s has 0 bytes, expected %d", name, at)
 		}
+		return wb.writeNoLock(name, data)
+	}
+	file, err := os.OpenFile(wb.fpath(name), os.O_WRONLY|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < int64(at) {
+		return fmt.Errorf("backing for %s has %d bytes, expected %d", name, stat.Size(), at)
+	}
+	// Leftovers from an append that didn't finish; the caller never counted them
+	if stat.Size() > int64(at) {
+		err = file.Truncate(int64(at))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = file.WriteAt(data, int64(at))
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (wb *WebStreamBacker_File) readNoLock(name string, capacity int) ([]byte, bool, error) {
+	path, compressed, err := wb.findNoLock(name)
+	if err != nil {
 		return nil, false, err
 	}
-	defer backing.Close()
-	stat, err := backing.Stat()
+	if path == "" {
+		// File doesn't exist, create memory and tell the caller there's no file
+		return make([]byte, 0, capacity), false, nil
+	}
+	backing, err := os.Open(path)
 	if err != nil {
 		return nil, false, err
 	}
-	stream := make([]byte, stat.Size(), capacity)
-	_, err = io.ReadFull(backing, stream)
+	defer backing.Close()
+	var size int
+	var reader io.Reader = backing
+	if compressed {
+		size, err = gzipLength(backing)
+		if err != nil {
+			return nil, false, err
+		}
+		gz, err := gzip.NewReader(backing)
+		if err != nil {
+			return nil, false, err
+		}
+		defer gz.Close()
+		reader = gz
+	} else {
+		stat, err := backing.Stat()
+		if err != nil {
+			return nil, false, err
+		}
+		size = int(stat.Size())
+	}
+	// Limits can shrink while rooms are stored, don't lose data over it
+	stream := make([]byte, size, max(capacity, size))
+	_, err = io.ReadFull(reader, stream)
 	if err != nil {
 		return nil, false, err
 	}
 	return stream, true, nil
 }
 
+func (wb *WebStreamBacker_File) Read(name string, capacity int) ([]byte, bool, error) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	return wb.readNoLock(name, capacity)
+}
+
 func (wb *WebStreamBacker_File) BackingIterator(callback func(string, func() int) bool) error {
 	d, err := os.ReadDir(wb.Folder)
 	if err != nil {
 		return err
 	}
+	seen := make(map[string]bool)
 	for _, de := range d {
+		// The metadata folder (or anything else weird) isn't a room
+		if de.IsDir() {
+			continue
+		}
+		name, compressed := strings.CutSuffix(de.Name(), CompressedExt)
+		// Only possible if we crashed while switching formats; both are the same room
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
 		getLength := func() int {
+			if compressed {
+				// Callers want the actual room length, not what it takes up on disk
+				file, err := os.Open(filepath.Join(wb.Folder, de.Name()))
+				if err != nil {
+					return 0
+				}
+				defer file.Close()
+				length, err := gzipLength(file)
+				if err != nil {
+					return 0
+				}
+				return length
+			}
 			info, err := de.Info()
 			if err == nil {
 				return int(info.Size())
@@ -110,28 +512,301 @@ func (wb *WebStreamBacker_File) BackingIterator(callback func(string, func() int
 				return 0
 			}
 		}
-		if !callback(de.Name(), getLength) {
+		if !callback(name, getLength) {
 			return nil
 		}
 	}
 	return nil
 }
 
+func (wb *WebStreamBacker_File) readMetaNoLock(name string) (*fileMeta, error) {
+	var meta fileMeta
+	raw, err := os.ReadFile(wb.metapath(name))
+	if err == nil {
+		err = json.Unmarshal(raw, &meta)
+		if err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (wb *WebStreamBacker_File) ReadMeta(name string) (*WebStreamMeta, error) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	fmeta, err := wb.readMetaNoLock(name)
+	if err != nil {
+		return nil, err
+	}
+	meta := fmeta.WebStreamMeta
+	// Older rooms don't have metadata, but the file itself knows when it was written
+	if meta.LastWrite.IsZero() {
+		path, _, err := wb.findNoLock(name)
+		if err != nil {
+			return nil, err
+		}
+		if path != "" {
+			info, err := os.Stat(path)
+			if err == nil {
+				meta.LastWrite = info.ModTime()
+			}
+		}
+	}
+	return &meta, nil
+}
+
+func (wb *WebStreamBacker_File) writeMetaNoLock(name string, meta *fileMeta) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return wb.writeAtomic(wb.metapath(name), raw)
+}
+
+func (wb *WebStreamBacker_File) WriteMeta(name string, meta *WebStreamMeta) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	return wb.writeMetaNoLock(name, &fileMeta{WebStreamMeta: *meta})
+}
+
+// The data and metadata are two files, so they can't be swapped in together. The
+// data goes to the temp folder first, then the metadata is written saying where
+// it is: that's the point the write happened. Moving the data into place is then
+// finished here, or on startup if we crash before that
+func (wb *WebStreamBacker_File) WriteWithMeta(name string, data []byte, meta *WebStreamMeta) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	data, compressed, err := wb.encode(data)
+	if err != nil {
+		return err
+	}
+	ext := ""
+	if compressed {
+		ext = CompressedExt
+	}
+	temp, err := wb.writeTemp(name+"_*"+ext, data)
+	if err != nil {
+		return err
+	}
+	// Does nothing if the data was moved into place
+	defer os.Remove(temp)
+	fmeta := &fileMeta{WebStreamMeta: *meta, Pending: filepath.Base(temp)}
+	err = wb.writeMetaNoLock(name, fmeta)
+	if err != nil {
+		return err
+	}
+	return wb.finishPendingNoLock(name, fmeta)
+}
+
+// Move the pending data for the metadata into place and clear the mark. If the
+// pending file is gone, it was already moved before we crashed
+func (wb *WebStreamBacker_File) finishPendingNoLock(name string, meta *fileMeta) error {
+	path, other := wb.formatPaths(name, strings.HasSuffix(meta.Pending, CompressedExt))
+	err := os.Rename(filepath.Join(wb.Folder, TempFolder, meta.Pending), path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = removeOther(other)
+	if err != nil {
+		return err
+	}
+	err = syncDir(wb.Folder)
+	if err != nil {
+		return err
+	}
+	meta.Pending = ""
+	return wb.writeMetaNoLock(name, meta)
+}
+
+func (wb *WebStreamBacker_File) Delete(name string) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	for _, path := range []string{wb.fpath(name), wb.gzpath(name), wb.metapath(name)} {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// --- SQLITE: All rooms in a single database ---
+
+// Backing data storage for WebStream that stores every room as a row in a
+// single sqlite database. The database is held open for the life of the backer
+type WebStreamBacker_Sqlite struct {
+	db *sql.DB
+}
+
+func NewSqliteBacker(path string) (*WebStreamBacker_Sqlite, error) {
+	dir, _ := filepath.Split(path)
+	if dir != "" {
+		err := os.MkdirAll(dir, 0750)
+		if err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d", path, BusyTimeout))
+	if err != nil {
+		return nil, err
+	}
+	err = utils.CreateTables_VersionedDb([]string{
+		`create table if not exists rooms (
+      name text primary key,
+      data blob not null,
+      length int not null,
+      modified text not null,
+      meta text not null
+    );`,
+	}, db, DatabaseVersion)
+	if err == nil {
+		err = utils.VerifyVersionedDb(db, DatabaseVersion)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &WebStreamBacker_Sqlite{db: db}, nil
+}
+
+func (wb *WebStreamBacker_Sqlite) Close() error {
+	return wb.db.Close()
+}
+
+func (wb *WebStreamBacker_Sqlite) Write(name string, data []byte) error {
+	_, err := wb.db.Exec(`INSERT INTO rooms(name, data, length, modified, meta) VALUES(?,?,?,?,'{}')
+    ON CONFLICT(name) DO UPDATE SET data=excluded.data, length=excluded.length, modified=excluded.modified`,
+		name, data, len(data), time.Now().Format(time.RFC3339))
+	return err
+}
+
+func (wb *WebStreamBacker_Sqlite) Append(name string, data []byte, at int) error {
+	tx, err := wb.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var length int
+	err = tx.QueryRow("SELECT length FROM rooms WHERE name = ?", name).Scan(&length)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if length < at {
+		return fmt.Errorf("backing for %s has %d bytes, expected %d", name, length, at)
+	}
+	_, err = tx.Exec(`INSERT INTO rooms(name, data, length, modified, meta) VALUES(?,?,?,?,'{}')
+    ON CONFLICT(name) DO UPDATE SET data=CAST(substr(data, 1, ?) || excluded.data AS BLOB),
+      length=?, modified=excluded.modified`,
+		name, data, len(data), time.Now().Format(time.RFC3339), at, at+len(data))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (wb *WebStreamBacker_Sqlite) Read(name string, capacity int) ([]byte, bool, error) {
+	var data []byte
+	err := wb.db.QueryRow("SELECT data FROM rooms WHERE name = ?", name).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return make([]byte, 0, capacity), false, nil
+		}
+		return nil, false, err
+	}
+	stream := make([]byte, len(data), max(capacity, len(data)))
+	copy(stream, data)
+	return stream, true, nil
+}
+
+func (wb *WebStreamBacker_Sqlite) BackingIterator(callback func(string, func() int) bool) error {
+	rows, err := wb.db.Query("SELECT name, length FROM rooms")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var length int
+		err = rows.Scan(&name, &length)
+		if err != nil {
+			return err
+		}
+		if !callback(name, func() int { return length }) {
+			return nil
+		}
+	}
+	return rows.Err()
+}
+
+func (wb *WebStreamBacker_Sqlite) ReadMeta(name string) (*WebStreamMeta, error) {
+	var meta WebStreamMeta
+	var raw string
+	var modified string
+	err := wb.db.QueryRow("SELECT meta, modified FROM rooms WHERE name = ?", name).Scan(&raw, &modified)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return &meta, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(raw), &meta)
+	if err != nil {
+		return nil, err
+	}
+	if meta.LastWrite.IsZero() {
+		meta.LastWrite, _ = time.Parse(time.RFC3339, modified)
+	}
+	return &meta, nil
+}
+
+func (wb *WebStreamBacker_Sqlite) WriteMeta(name string, meta *WebStreamMeta) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// Metadata for a room that hasn't been written yet makes an empty room
+	_, err = wb.db.Exec(`INSERT INTO rooms(name, data, length, modified, meta) VALUES(?,x'',0,?,?)
+    ON CONFLICT(name) DO UPDATE SET meta=excluded.meta`,
+		name, time.Now().Format(time.RFC3339), string(raw))
+	return err
+}
+
+// It's one row, so this is just one statement
+func (wb *WebStreamBacker_Sqlite) WriteWithMeta(name string, data []byte, meta *WebStreamMeta) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = wb.db.Exec(`INSERT INTO rooms(name, data, length, modified, meta) VALUES(?,?,?,?,?)
+    ON CONFLICT(name) DO UPDATE SET data=excluded.data, length=excluded.length, modified=excluded.modified, meta=excluded.meta`,
+		name, data, len(data), time.Now().Format(time.RFC3339), string(raw))
+	return err
+}
+
+func (wb *WebStreamBacker_Sqlite) Delete(name string) error {
+	_, err := wb.db.Exec("DELETE FROM rooms WHERE name = ?", name)
+	return err
+}
+
 // --- MEM: A backer for testing, in-memory storage only ---
 
 type backerEvent struct {
-	Type int    // Read 0 write 1
+	Type int    // Read 0 write 1 append 2 delete 3
 	Data []byte // This is wasteful but like whatever
 }
 
 type testBacker struct {
 	Rooms  map[string][]byte
+	Metas  map[string]WebStreamMeta
 	Events []backerEvent
 }
 
 func NewTestBacker() *testBacker {
 	return &testBacker{
 		Rooms:  make(map[string][]byte),
+		Metas:  make(map[string]WebStreamMeta),
 		Events: make([]backerEvent, 0),
 	}
 }
@@ -145,6 +820,23 @@ func (tb *testBacker) Write(name string, data []byte) error {
 	return nil
 }
 
+func (tb *testBacker) Append(name string, data []byte, at int) error {
+	existing := tb.Rooms[name]
+	if len(existing) < at {
+		return fmt.Errorf("backing for %s has %d bytes, expected %d", name, len(existing), at)
+	}
+	// Always make a new slice, the old one might be shared with the system
+	room := make([]byte, at+len(data))
+	copy(room, existing[:at])
+	copy(room[at:], data)
+	tb.Rooms[name] = room
+	tb.Events = append(tb.Events, backerEvent{
+		Type: 2,
+		Data: data,
+	})
+	return nil
+}
+
 func (tb *testBacker) Read(name string, capacity int) ([]byte, bool, error) {
 	data, ok := tb.Rooms[name]
 	tb.Events = append(tb.Events, backerEvent{
@@ -154,7 +846,10 @@ func (tb *testBacker) Read(name string, capacity int) ([]byte, bool, error) {
 	if !ok { // This is a "new" room, so give it something...
 		return make([]byte, 0, capacity), false, nil
 	} else {
-		return data, true, nil
+		// Like the real backers, the system gets its own memory with the capacity it asked for
+		stream := make([]byte, len(data), max(capacity, len(data)))
+		copy(stream, data)
+		return stream, true, nil
 	}
 }
 
@@ -166,3 +861,30 @@ func (tb *testBacker) BackingIterator(callback func(string, func() int) bool) er
 	}
 	return nil
 }
+
+func (tb *testBacker) ReadMeta(name string) (*WebStreamMeta, error) {
+	meta := tb.Metas[name]
+	return &meta, nil
+}
+
+func (tb *testBacker) WriteMeta(name string, meta *WebStreamMeta) error {
+	tb.Metas[name] = *meta
+	return nil
+}
+
+func (tb *testBacker) WriteWithMeta(name string, data []byte, meta *WebStreamMeta) error {
+	err := tb.Write(name, data)
+	if err != nil {
+		return err
+	}
+	return tb.WriteMeta(name, meta)
+}
+
+func (tb *testBacker) Delete(name string) error {
+	delete(tb.Rooms, name)
+	delete(tb.Metas, name)
+	tb.Events = append(tb.Events, backerEvent{
+		Type: 3,
+	})
+	return nil
+}
@@ -2,22 +2,36 @@ package webstream
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"regexp"
+	"slices"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/randomouscrap98/goldmonolith/utils"
 )
 
+// Room names which other endpoints sit on (GET /metrics would hide the room)
+var ReservedRooms = []string{"metrics"}
+
 // A snapshot of information about a webstream. For informational purposes only;
 // data is immediately stale as soon as snapshot is made
 type WebStreamInfo struct {
 	Length                 int
+	Base                   int
 	Capacity               int
 	ListenerCount          int
 	LastWrite              time.Time
 	LastWriteListenerCount int
 	Dirty                  bool
+	Claimed                bool
+	Framed                 bool
 }
 
 // Single webstream, tightly coupled with the WebStreamSystem
@@ -26,10 +40,21 @@ type webStream struct {
 	mu                 sync.Mutex
 	readSignal         chan struct{}
 	length             int       // Length of data (even if data has been cleared for mem saving)
+	base               int       // Absolute offset of data[0]. Only rolling rooms ever move this
 	listeners          int       // Amount of listeners currently active
 	lastWrite          time.Time // Time of last write to this webstream
 	dirty              bool      // There's some change here
+	persisted          int       // How much of data the backer is known to have
+	persistedBase      int       // The base the backer is known to have
 	lastWriteListeners int       // Count of listeners at last signal (write)
+	deleted            bool      // This stream was removed from the system; anyone holding it should let go
+	writeToken         string    // Hash of the token required to write (empty means anyone can write)
+	readonlyKey        string    // Persisted public readonly key (the context does the actual mapping)
+	lastAccess         time.Time // Last time data was actually read or written (for eviction)
+	framed             bool      // Every write is stored as one length prefixed message
+	baseMessage        int       // Index of the first stored message (framed only)
+	messages           []int     // Absolute offset of each stored message, only while loaded (framed only)
+	backed             bool      // The backer knows about this room (it's been saved at least once)
 }
 
 func newWebStream(data []byte) *webStream {
@@ -39,25 +64,64 @@ func newWebStream(data []byte) *webStream {
 	}
 }
 
+// The metadata to persist for this stream. Only write it once the data it
+// describes is in the backer, since it says how much of the backing is real
+func (ws *webStream) getMetaNoLock() *WebStreamMeta {
+	stored := ws.length - ws.base
+	if cap(ws.data) > 0 {
+		stored = ws.persisted
+	}
+	return &WebStreamMeta{
+		Base:        ws.base,
+		LastWrite:   ws.lastWrite,
+		WriteToken:  ws.writeToken,
+		ReadonlyKey: ws.readonlyKey,
+		Framed:      ws.framed,
+		BaseMessage: ws.baseMessage,
+		Stored:      &stored,
+	}
+}
+
 func (ws *webStream) getInfoNoLock() *WebStreamInfo {
 	return &WebStreamInfo{
 		Length:                 ws.length,
+		Base:                   ws.base,
 		Capacity:               cap(ws.data),
 		ListenerCount:          ws.listeners,
 		LastWriteListenerCount: ws.lastWriteListeners,
 		LastWrite:              ws.lastWrite,
 		Dirty:                  ws.dirty,
+		Claimed:                ws.writeToken != "",
+		Framed:                 ws.framed,
 	}
 }
 
+// The limits that apply to a particular room
+type RoomLimits struct {
+	SingleDataLimit int
+	StreamDataLimit int
+	ReadTimeout     time.Duration
+}
+
+// A RoomClass with its regex ready to use
+type roomClass struct {
+	regex *regexp.Regexp
+	class RoomClass
+}
+
 type WebStreamSystem struct {
 	roomRegex   *regexp.Regexp        // Regex to limit room names
+	roomClasses []roomClass           // Per-room limit overrides, in config order
 	backer      WebStreamBacker       // The backing system to persist streams
 	webstreams  map[string]*webStream // ALL streams the system has ever seen at runtime
 	wsmu        sync.Mutex            // Lock for webstreams object
 	config      *Config
 	activeCount int        // Number of active rooms
-	acmu        sync.Mutex // lock for activeCount
+	totalData   int64      // Amount of data stored across all rooms
+	acmu        sync.Mutex // lock for activeCount and totalData
+	metrics     webStreamMetrics
+	appendHook  func(string, int, []byte, bool) // Told about every local append, see SetAppendHook
+	changeHook  func(string, bool)              // Told about every other change to a room, see SetChangeHook
 }
 
 func NewWebStreamSystem(config *Config, backer WebStreamBacker) (*WebStreamSystem, error) {
@@ -65,33 +129,154 @@ func NewWebStreamSystem(config *Config, backer WebStreamBacker) (*WebStreamSyste
 	if err != nil {
 		return nil, err
 	}
+	roomClasses := make([]roomClass, len(config.RoomClass))
+	for i, class := range config.RoomClass {
+		roomClasses[i].regex, err = regexp.Compile(class.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("bad RoomClass regex %q: %w", class.Regex, err)
+		}
+		roomClasses[i].class = class
+	}
 	// WARN: This may seem ridiculous, but we preload EVERY room from the system. This shouldn't
 	// be too bad, since it's just metadata and we're talking rooms in the thousands, not
 	// millions (I think...). This simplifies a great number of things, but if this needs
 	// to be changed, it should be doable...
 	webstreams := make(map[string]*webStream)
+	var totalData int64
 	err = backer.BackingIterator(func(k string, gl func() int) bool {
 		webstreams[k] = newWebStream(nil)
 		webstreams[k].length = gl()
+		totalData += int64(webstreams[k].length)
 		return true
 	})
 	if err != nil {
 		return nil, err
 	}
+	// Offsets are absolute, so rooms which have dropped data need to know where they start
+	for k, ws := range webstreams {
+		meta, err := backer.ReadMeta(k)
+		if err != nil {
+			return nil, err
+		}
+		ws.base = meta.Base
+		ws.persistedBase = meta.Base
+		ws.length += meta.Base
+		ws.lastWrite = meta.LastWrite
+		ws.writeToken = meta.WriteToken
+		ws.readonlyKey = meta.ReadonlyKey
+		ws.framed = meta.Framed
+		ws.baseMessage = meta.BaseMessage
+		ws.backed = true
+		if meta.Stored != nil && *meta.Stored < ws.length-ws.base {
+			// We crashed in the middle of writing; the tail was never acknowledged
+			log.Printf("WARN: webstream %s has %d bytes past what was stored, ignoring them\n", k, ws.length-ws.base-*meta.Stored)
+			totalData -= int64(ws.length - ws.base - *meta.Stored)
+			ws.length = ws.base + *meta.Stored
+		} else if meta.Stored != nil && *meta.Stored > ws.length-ws.base {
+			// The data doesn't go with the metadata (something replaced it behind our
+			// back). Which part we have is anyone's guess, so drop all of it and carry
+			// on after everything the room had: offsets never go backwards or point at
+			// the wrong data
+			log.Printf("WARN: webstream %s has %d bytes but should have %d, dropping them\n", k, ws.length-ws.base, *meta.Stored)
+			totalData -= int64(ws.length - ws.base)
+			ws.length = ws.base + *meta.Stored
+			ws.base = ws.length
+		}
+		if ws.lastWrite.IsZero() {
+			// Nobody knows when this was written, so start the expiry clock now
+			ws.lastWrite = time.Now()
+		}
+	}
 	return &WebStreamSystem{
-		roomRegex:  roomRegex,
-		backer:     backer,
-		webstreams: webstreams,
-		config:     config,
+		roomRegex:   roomRegex,
+		roomClasses: roomClasses,
+		backer:      backer,
+		webstreams:  webstreams,
+		totalData:   totalData,
+		config:      config,
 	}, nil
 }
 
-func (wsys *WebStreamSystem) RoomCount() int {
+// Get the limits for the given room: the first matching RoomClass, with anything
+// it doesn't set coming from the global config. Rooms don't have to exist
+func (wsys *WebStreamSystem) RoomLimits(name string) *RoomLimits {
+	limits := &RoomLimits{
+		SingleDataLimit: wsys.config.SingleDataLimit,
+		StreamDataLimit: wsys.config.StreamDataLimit,
+		ReadTimeout:     time.Duration(wsys.config.ReadTimeout),
+	}
+	for _, rc := range wsys.roomClasses {
+		if !rc.regex.MatchString(name) {
+			continue
+		}
+		if rc.class.SingleDataLimit > 0 {
+			limits.SingleDataLimit = rc.class.SingleDataLimit
+		}
+		if rc.class.StreamDataLimit > 0 {
+			limits.StreamDataLimit = rc.class.StreamDataLimit
+		}
+		if rc.class.ReadTimeout > 0 {
+			limits.ReadTimeout = time.Duration(rc.class.ReadTimeout)
+		}
+		break
+	}
+	return limits
+}
+
+// Amount of rooms currently loaded in memory
+func (wsys *WebStreamSystem) ActiveCount() int {
 	wsys.acmu.Lock()
 	defer wsys.acmu.Unlock()
+	return wsys.activeCount
+}
+
+func (wsys *WebStreamSystem) RoomCount() int {
+	wsys.wsmu.Lock()
+	defer wsys.wsmu.Unlock()
 	return len(wsys.webstreams)
 }
 
+// Whether the system knows about the room at all (doesn't create it)
+func (wsys *WebStreamSystem) RoomExists(name string) bool {
+	wsys.wsmu.Lock()
+	defer wsys.wsmu.Unlock()
+	_, ok := wsys.webstreams[name]
+	return ok
+}
+
+// Get a copy of the current set of streams, so you can work with each one
+// without holding the lock on the whole system. Streams in the copy may get
+// deleted while you work, so check for that. NEVER lock a stream while holding
+// wsmu, other things lock in the opposite order
+func (wsys *WebStreamSystem) snapshotStreams() map[string]*webStream {
+	wsys.wsmu.Lock()
+	defer wsys.wsmu.Unlock()
+	result := make(map[string]*webStream, len(wsys.webstreams))
+	for k, ws := range wsys.webstreams {
+		result[k] = ws
+	}
+	return result
+}
+
+// Amount of data stored across all rooms
+func (wsys *WebStreamSystem) TotalData() int64 {
+	wsys.acmu.Lock()
+	defer wsys.acmu.Unlock()
+	return wsys.totalData
+}
+
+// Claim space in the global data total, failing if it would go over the limit.
+// Negative amounts give space back (and always succeed)
+func (wsys *WebStreamSystem) reserveData(amount int) error {
+	wsys.acmu.Lock()
+	defer wsys.acmu.Unlock()
+	if amount > 0 && wsys.config.TotalDataLimit > 0 && wsys.totalData+int64(amount) > wsys.config.TotalDataLimit {
+		return &TotalDataLimitError{Limit: wsys.config.TotalDataLimit, Current: wsys.totalData}
+	}
+	wsys.totalData += int64(amount)
+	return nil
+}
+
 func (wsys *WebStreamSystem) atActiveCapacity() bool {
 	wsys.acmu.Lock()
 	defer wsys.acmu.Unlock()
@@ -110,13 +295,26 @@ func (wsys *WebStreamSystem) decActiveCount() {
 	wsys.acmu.Unlock()
 }
 
+// Whether the name is allowed for a room: it has to match the RoomRegex and
+// not be one of the ReservedRooms
+func (wsys *WebStreamSystem) checkRoomName(name string) error {
+	if !wsys.roomRegex.MatchString(name) {
+		return &RoomNameError{Regex: wsys.roomRegex.String()}
+	}
+	if slices.Contains(ReservedRooms, name) {
+		return &RoomNameError{Regex: wsys.roomRegex.String(), Reserved: true}
+	}
+	return nil
+}
+
 // Retrieve the ready-made stream object for the given name. Will load
 // stream from persistent storage if this is a brand new room, regardless of
 // what might be done with it in the future. If stream object already exists,
 // you'll get whatever is available (may be a dumped(idle) room...)
 func (wsys *WebStreamSystem) getStream(name string) (*webStream, error) {
-	if !wsys.roomRegex.MatchString(name) {
-		return nil, &RoomNameError{Regex: wsys.roomRegex.String()}
+	err := wsys.checkRoomName(name)
+	if err != nil {
+		return nil, err
 	}
 	wsys.wsmu.Lock()
 	defer wsys.wsmu.Unlock()
@@ -128,69 +326,246 @@ func (wsys *WebStreamSystem) getStream(name string) (*webStream, error) {
 		}
 		// We're fine to add it, and I don't think there's any need to refresh it
 		ws = newWebStream(nil)
+		// Nothing's been written, but the expiry clock has to start somewhere
+		ws.lastWrite = time.Now()
 		wsys.webstreams[name] = ws
 	}
 	return ws, nil
 }
 
+// Get the stream (creating it if needed, like getStream) and lock it. Streams
+// which get deleted while we wait on the lock are skipped, you'll get the
+// replacement instead. You MUST unlock the stream when done
+func (wsys *WebStreamSystem) lockStream(name string) (*webStream, error) {
+	for {
+		ws, err := wsys.getStream(name)
+		if err != nil {
+			return nil, err
+		}
+		ws.mu.Lock()
+		if !ws.deleted {
+			return ws, nil
+		}
+		ws.mu.Unlock()
+	}
+}
+
+// Like lockStream, but does NOT create the stream if it doesn't exist
+func (wsys *WebStreamSystem) lockExistingStream(name string) (*webStream, error) {
+	for {
+		wsys.wsmu.Lock()
+		ws, ok := wsys.webstreams[name]
+		wsys.wsmu.Unlock()
+		if !ok {
+			return nil, &utils.NotFoundError{Message: name}
+		}
+		ws.mu.Lock()
+		if !ws.deleted {
+			return ws, nil
+		}
+		ws.mu.Unlock()
+	}
+}
+
 // Bring the backing back into the stream. It is safe to call this even if the stream
 // is already active; it will NOT pull from the backing store again. This does mean
 // the backing store can become desynchronized with the in-memory store; this is
 // fine for our purposes, as there are many undefines for "changing a backing store
 // out from under listeners"
 func (wsys *WebStreamSystem) refreshStreamNoLock(name string, ws *webStream) (bool, error) {
+	// Everyone who touches the data comes through here
+	ws.lastAccess = time.Now()
 	if cap(ws.data) > 0 {
 		// Nothing to do, stream has data
 		return false, nil
 	}
-	// Can't refresh if there's too many active rooms
-	if wsys.atActiveCapacity() {
+	// Too many active rooms, something has to go to make space
+	if wsys.atActiveCapacity() && !wsys.evictStream(ws) {
 		return false, &ActiveRoomLimitError{Limit: wsys.config.ActiveRoomLimit}
 	}
-	// This ALWAYS loads the stream into memory.
-	stream, _, err := wsys.backer.Read(name, wsys.config.StreamDataLimit)
+	// This ALWAYS loads the stream into memory, with however much space this room gets
+	stream, err := wsys.readBackerNoLock(name, ws, wsys.RoomLimits(name).StreamDataLimit)
 	if err != nil {
 		return false, err
 	}
-	ws.length = len(stream)
+	if ws.framed {
+		ws.messages, err = indexMessages(stream, ws.base)
+		if err != nil {
+			return false, err
+		}
+	}
+	ws.length = ws.base + len(stream)
 	ws.data = stream
+	ws.persisted = len(stream)
 	wsys.incActiveCount()
 	return true, nil
 }
 
+// Read the room's data from the backer, without anything past the length we
+// know about (the leftovers of a write that crashed). The next append to the
+// backer throws those away for good
+func (wsys *WebStreamSystem) readBackerNoLock(name string, ws *webStream, capacity int) ([]byte, error) {
+	stream, _, err := wsys.backer.Read(name, capacity)
+	if err != nil {
+		return nil, err
+	}
+	if len(stream) > ws.length-ws.base {
+		stream = stream[:ws.length-ws.base]
+	}
+	return stream, nil
+}
+
+// Save any unsaved data in the stream to the backer. Normally only the new tail is
+// written; rooms which dropped data (rolling) must be rewritten whole since their
+// start moved. Does NOT clear the data
+func (wsys *WebStreamSystem) persistStreamNoLock(name string, ws *webStream) error {
+	full := ws.base != ws.persistedBase || ws.persisted > len(ws.data)
+	if !full {
+		err := wsys.backer.Append(name, ws.data[ws.persisted:], ws.persisted)
+		if err == nil {
+			// The data is definitely there now, so the metadata can say so. If we crash
+			// before this, the extra data is ignored on startup (see Stored)
+			ws.persisted = len(ws.data)
+			err = wsys.backer.WriteMeta(name, ws.getMetaNoLock())
+			if err != nil {
+				return err
+			}
+		} else {
+			// The backer lost track somehow (or someone messed with it), a full write fixes everything
+			log.Printf("WARN: Append failed for webstream %s, doing full write: %s\n", name, err)
+			full = true
+		}
+	}
+	if full {
+		// The base may have moved (rolling rooms), so the data and the metadata
+		// saying where it starts have to be written together
+		meta := ws.getMetaNoLock()
+		stored := len(ws.data)
+		meta.Stored = &stored
+		err := wsys.backer.WriteWithMeta(name, ws.data, meta)
+		if err != nil {
+			return err
+		}
+		ws.persisted = len(ws.data)
+		ws.persistedBase = ws.base
+	}
+	ws.dirty = false
+	ws.backed = true
+	return nil
+}
+
+// Immediately persist the metadata for the stream, for things which can't wait
+// until the next dump (like claims). The room has to survive a restart even if
+// it has no data yet, so the data is written too
+func (wsys *WebStreamSystem) persistMetaNoLock(name string, ws *webStream) error {
+	if cap(ws.data) > 0 {
+		return wsys.persistStreamNoLock(name, ws)
+	}
+	var err error
+	if ws.length == 0 {
+		// The backer may not know about this room at all, make sure it does
+		err = wsys.backer.WriteWithMeta(name, []byte{}, ws.getMetaNoLock())
+	} else {
+		err = wsys.backer.WriteMeta(name, ws.getMetaNoLock())
+	}
+	if err == nil {
+		ws.backed = true
+	}
+	return err
+}
+
+// Save the stream (if needed) and clear the data from memory. Returns whether
+// anything was written. On error, the stream is left loaded
+func (wsys *WebStreamSystem) unloadStreamNoLock(name string, ws *webStream) (bool, error) {
+	written := false
+	// Only write if the data is dirty (to save disk writes? idk...)
+	if ws.dirty {
+		err := wsys.persistStreamNoLock(name, ws)
+		if err != nil {
+			return false, err
+		}
+		written = true
+	}
+	ws.data = nil
+	ws.messages = nil
+	ws.dirty = false
+	wsys.decActiveCount()
+	return written, nil
+}
+
+// Unload the least recently used room which nobody is listening to, so another
+// room can be loaded. The given stream is the one that wants to load (it's
+// locked, so it's skipped). Returns whether a room was unloaded
+func (wsys *WebStreamSystem) evictStream(except *webStream) bool {
+	type candidate struct {
+		name       string
+		ws         *webStream
+		lastAccess time.Time
+	}
+	candidates := make([]candidate, 0)
+	// We already hold a stream lock, so we can't block on any other stream or
+	// we might deadlock with someone doing the same thing. Busy streams are
+	// obviously not good candidates anyway
+	for k, ws := range wsys.snapshotStreams() {
+		if ws == except || !ws.mu.TryLock() {
+			continue
+		}
+		if !ws.deleted && cap(ws.data) > 0 && ws.listeners == 0 {
+			candidates = append(candidates, candidate{name: k, ws: ws, lastAccess: ws.lastAccess})
+		}
+		ws.mu.Unlock()
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastAccess.Before(candidates[j].lastAccess)
+	})
+	for _, c := range candidates {
+		if !c.ws.mu.TryLock() {
+			continue
+		}
+		// Things may have changed since we looked
+		evicted := false
+		if !c.ws.deleted && cap(c.ws.data) > 0 && c.ws.listeners == 0 {
+			_, err := wsys.unloadStreamNoLock(c.name, c.ws)
+			if err != nil {
+				log.Printf("WARN: Error evicting webstream %s: %s\n", c.name, err)
+			} else {
+				log.Printf("Evicted room %s to make space\n", c.name)
+				wsys.metrics.evictions.Add(1)
+				evicted = true
+			}
+		}
+		c.ws.mu.Unlock()
+		if evicted {
+			return true
+		}
+	}
+	return false
+}
+
 // Dump data from all streams which are idling and still have data. Alternatively, force
 // dump every single room with data. Will always clear any dumped stream to conserve memory
 func (wsys *WebStreamSystem) DumpStreams(force bool) []string {
+	defer func(started time.Time) {
+		wsys.metrics.observeDump(time.Since(started))
+	}(time.Now())
 	dumped := make([]string, 0)
-	wsys.wsmu.Lock()
-	defer wsys.wsmu.Unlock()
+	webstreams := wsys.snapshotStreams()
 	if force {
-		log.Printf("FORCE DUMPING %d STREAMS", len(wsys.webstreams))
+		log.Printf("FORCE DUMPING %d STREAMS", len(webstreams))
 	}
 	idleTime := time.Duration(wsys.config.IdleRoomTime)
-	for k, ws := range wsys.webstreams {
+	for k, ws := range webstreams {
 		// Lock for the duration of dump checking, you MUST not randomly unlock!!
 		ws.mu.Lock()
 		if force || time.Now().Sub(ws.lastWrite) > idleTime {
 			// Only dump if there's really something to dump
 			if cap(ws.data) != 0 {
-				var err error
-				var written bool
-				// Only write if the data is dirty (to save disk writes? idk...)
-				if ws.dirty {
-					err = wsys.backer.Write(k, ws.data)
-					if err != nil {
-						// A warning is about all we can do...
-						log.Printf("WARN: Error saving webstream %s: %s\n", k, err)
-					} else {
-						written = true
-					}
-				}
-				// Only CLEAR the data if nothing bad happened
-				if err == nil {
-					ws.data = nil
-					ws.dirty = false
-					wsys.decActiveCount()
+				// Data is only cleared if nothing bad happened
+				written, err := wsys.unloadStreamNoLock(k, ws)
+				if err != nil {
+					// A warning is about all we can do...
+					log.Printf("WARN: Error saving webstream %s: %s\n", k, err)
+				} else {
 					dumped = append(dumped, k)
 					if written {
 						log.Printf("Dumped room %s to persistent storage\n", k)
@@ -205,17 +580,157 @@ func (wsys *WebStreamSystem) DumpStreams(force bool) []string {
 	return dumped
 }
 
+// Hash a write token for storage or comparison. Only the hash is ever stored
+func hashWriteToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Claim the room so that only writers with the returned token can write to it
+// (see AppendDataWithToken). The claim is persisted immediately. Rooms can only
+// be claimed once, and only before anything is written to them: otherwise anyone
+// could lock the owners out of a room that's already in use
+func (wsys *WebStreamSystem) ClaimRoom(name string) (string, error) {
+	ws, err := wsys.lockStream(name)
+	if err != nil {
+		return "", err
+	}
+	defer ws.mu.Unlock()
+	if ws.writeToken != "" {
+		return "", &RoomClaimedError{Room: name}
+	}
+	// Offsets never go backwards (even through resets), and rooms from the backer
+	// start with its length, so this covers everything that was ever stored
+	if ws.length > 0 {
+		return "", &RoomClaimedError{Room: name, HasData: true}
+	}
+	raw := make([]byte, 16)
+	_, err = rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	ws.writeToken = hashWriteToken(token)
+	err = wsys.persistMetaNoLock(name, ws)
+	if err != nil {
+		ws.writeToken = ""
+		return "", err
+	}
+	return token, nil
+}
+
+// Undo a claim whose token never made it back to anyone. Only works while the
+// room is still empty, otherwise the claim has been used and stays
+func (wsys *WebStreamSystem) releaseClaim(name string, token string) error {
+	ws, err := wsys.lockExistingStream(name)
+	if err != nil {
+		return err
+	}
+	defer ws.mu.Unlock()
+	if ws.writeToken == "" || ws.length > 0 || !ws.checkWriteTokenNoLock(token) {
+		return nil
+	}
+	old := ws.writeToken
+	ws.writeToken = ""
+	err = wsys.persistMetaNoLock(name, ws)
+	if err != nil {
+		ws.writeToken = old
+		return err
+	}
+	return nil
+}
+
+func (ws *webStream) checkWriteTokenNoLock(token string) bool {
+	return ws.writeToken == "" ||
+		subtle.ConstantTimeCompare([]byte(hashWriteToken(token)), []byte(ws.writeToken)) == 1
+}
+
+// Whether the room is claimed AND the token is the one that claimed it. Unlike
+// writing, unclaimed rooms always fail this check
+func (wsys *WebStreamSystem) CheckWriteToken(name string, token string) (bool, error) {
+	ws, err := wsys.lockExistingStream(name)
+	if err != nil {
+		return false, err
+	}
+	defer ws.mu.Unlock()
+	return ws.writeToken != "" && ws.checkWriteTokenNoLock(token), nil
+}
+
+// Persist the readonly key for the room. The mapping itself is up to the caller.
+// Rooms the backer doesn't have yet only keep it in memory (it's saved with the
+// room if it ever is): looking at a room shouldn't be enough to store it
+func (wsys *WebStreamSystem) SetReadonlyKey(name string, key string) error {
+	ws, err := wsys.lockExistingStream(name)
+	if err != nil {
+		return err
+	}
+	defer ws.mu.Unlock()
+	old := ws.readonlyKey
+	ws.readonlyKey = key
+	if !ws.backed && ws.length == 0 {
+		if old != "" {
+			// There's nothing to copy, but anyone else holding the old key has to let it go
+			wsys.roomChangedNoLock(name, true)
+		}
+		return nil
+	}
+	err = wsys.persistMetaNoLock(name, ws)
+	if err != nil {
+		ws.readonlyKey = old
+		return err
+	}
+	wsys.roomChangedNoLock(name, false)
+	return nil
+}
+
+// All the persisted readonly keys, as room -> key
+func (wsys *WebStreamSystem) ReadonlyKeys() map[string]string {
+	result := make(map[string]string)
+	for k, ws := range wsys.snapshotStreams() {
+		ws.mu.Lock()
+		if !ws.deleted && ws.readonlyKey != "" {
+			result[k] = ws.readonlyKey
+		}
+		ws.mu.Unlock()
+	}
+	return result
+}
+
 // Append the given data to this stream. Will throw an error if the
-// stream overflows the capacity
+// stream overflows the capacity. Does NOT check write tokens, use
+// AppendDataWithToken for untrusted writers
 func (wsys *WebStreamSystem) AppendData(name string, data []byte) error {
-	ws, err := wsys.getStream(name)
+	return wsys.appendData(name, data, false, "")
+}
+
+// Append the given data to this stream, but only if the token is allowed to
+// write to it. Unclaimed rooms accept any token (even empty)
+func (wsys *WebStreamSystem) AppendDataWithToken(name string, data []byte, token string) error {
+	return wsys.appendData(name, data, true, token)
+}
+
+func (wsys *WebStreamSystem) appendData(name string, data []byte, checkToken bool, token string) error {
+	err := wsys.appendDataInner(name, data, checkToken, token)
 	if err != nil {
-		return err
+		wsys.metrics.countError(err)
+	} else {
+		wsys.metrics.appends.Add(1)
+		wsys.metrics.appendBytes.Add(int64(len(data)))
 	}
+	return err
+}
+
+func (wsys *WebStreamSystem) appendDataInner(name string, data []byte, checkToken bool, token string) error {
 	// Lock for the ENTIRE duration of the append, including refresh. The
 	// system doesn't work if you refresh then randomly lose it!
-	ws.mu.Lock()
+	ws, err := wsys.lockStream(name)
+	if err != nil {
+		return err
+	}
 	defer ws.mu.Unlock()
+	if checkToken && !ws.checkWriteTokenNoLock(token) {
+		return &WriteTokenError{Room: name}
+	}
 	// Data MUST be available, do a refresh
 	refreshed, err := wsys.refreshStreamNoLock(name, ws)
 	if err != nil {
@@ -224,13 +739,66 @@ func (wsys *WebStreamSystem) AppendData(name string, data []byte) error {
 	if refreshed {
 		log.Printf("Write for %s at %d+%d refreshed backing stream\n", name, ws.length, len(data))
 	}
-	if len(data)+ws.length > cap(ws.data) {
-		return &OverCapacityError{Capacity: cap(ws.data)}
+	if ws.framed {
+		data = frameMessage(data)
+	}
+	at := ws.length
+	err = wsys.appendNoLock(ws, data)
+	if err != nil {
+		return err
+	}
+	if wsys.appendHook != nil {
+		wsys.appendHook(name, at, data, ws.framed)
+	}
+	return nil
+}
+
+// Put the data on the end of the loaded stream exactly as given (framed rooms
+// must be given whole, already framed messages) and wake up the readers
+func (wsys *WebStreamSystem) appendNoLock(ws *webStream, data []byte) error {
+	var messages []int
+	if ws.framed {
+		// Usually just the one message, but peers can send many at once
+		var err error
+		messages, err = indexMessages(data, 0)
+		if err != nil {
+			return err
+		}
 	}
-	ws.data = ws.data[:ws.length+len(data)] // Embiggen
-	copy(ws.data[ws.length:], data)         // we don't use append because we specifically do not want it to grow ever
+	stored := len(ws.data)
+	drop := 0
+	if len(data)+stored > cap(ws.data) {
+		if !wsys.config.Rolling || len(data) > cap(ws.data) {
+			return &OverCapacityError{Capacity: cap(ws.data)}
+		}
+		// Rolling rooms shift out just enough of the oldest data to fit the new data.
+		drop = len(data) + stored - cap(ws.data)
+		if ws.framed {
+			// Never leave half a message behind
+			drop = ws.messageBoundaryNoLock(ws.base+drop) - ws.base
+		}
+	}
+	// Only the growth counts against the total (rolling rooms might not grow at all)
+	err := wsys.reserveData(len(data) - drop)
+	if err != nil {
+		return err
+	}
+	if drop > 0 {
+		// Offsets stay absolute, so the base moves forward by the same amount
+		copy(ws.data, ws.data[drop:])
+		ws.base += drop
+		stored -= drop
+		if ws.framed {
+			ws.trimMessagesNoLock()
+		}
+	}
+	for _, m := range messages {
+		ws.messages = append(ws.messages, ws.base+stored+m)
+	}
+	ws.data = ws.data[:stored+len(data)] // Embiggen
+	copy(ws.data[stored:], data)         // we don't use append because we specifically do not want it to grow ever
 	// Keep track of all the little data
-	ws.length = len(ws.data)
+	ws.length = ws.base + len(ws.data)
 	ws.lastWrite = time.Now()
 	ws.lastWriteListeners = ws.listeners
 	ws.dirty = true
@@ -244,48 +812,72 @@ func (wsys *WebStreamSystem) AppendData(name string, data []byte) error {
 // you're trying to read past the end of the data. You can cancel it with the
 // given context. If the context is nil, the function is NONBLOCKING
 func (wsys *WebStreamSystem) ReadData(name string, start, length int, cancel context.Context) ([]byte, error) {
+	return wsys.readData(name, start, length, cancel, true)
+}
+
+// The real ReadData. Set listen to false if the caller is tracking itself as a
+// listener some other way (like a long-lived socket that reads over and over)
+func (wsys *WebStreamSystem) readData(name string, start, length int, cancel context.Context, listen bool) ([]byte, error) {
 	if start < 0 {
 		// This is what the other service did, mmm want to make it as similar as possible
 		return nil, fmt.Errorf("start must be non-zero")
 	}
-	ws, err := wsys.getStream(name)
+	ws, err := wsys.lockStream(name)
 	if err != nil {
 		return nil, err
 	}
-	ws.mu.Lock()
-	// This should "just work" to give a relatively accurate listener count
-	ws.listeners += 1
-	defer func() { ws.listeners -= 1 }()
+	defer ws.mu.Unlock()
+	if listen {
+		// This should "just work" to give a relatively accurate listener count. Defers
+		// run in reverse, so this is still within the lock
+		ws.listeners += 1
+		defer func() { ws.listeners -= 1 }()
+	}
+	blocked := false
+	defer func() {
+		if blocked {
+			wsys.metrics.readsBlocked.Add(1)
+		} else {
+			wsys.metrics.readsImmediate.Add(1)
+		}
+	}()
 	// In this special situation, we must simply wait until the data becomes available.
 	// It is also OK if the data is not currently backed, since we're just waiting on
 	// a signal and not actually reading anything.
-	if start >= ws.length {
-		if cancel != nil {
-			// We're still locked at this point, so we know nobody is changing this out
-			// from under us
-			waiter := ws.readSignal
-			ws.mu.Unlock()
-			select {
-			case <-waiter:
-				// We were signalled, recursively call us again for easiness
-				return wsys.ReadData(name, start, length, cancel)
-			case <-cancel.Done():
-				// We were killed, but we DON'T throw the error? Is that OK??
+	for start >= ws.length {
+		if cancel == nil {
+			// This is the "nonblocking" part of reading at the end of the stream
+			return nil, nil
+		}
+		// We're still locked at this point, so we know nobody is changing this out
+		// from under us
+		waiter := ws.readSignal
+		blocked = true
+		ws.mu.Unlock()
+		select {
+		case <-waiter:
+			// We were signalled, go check the length again
+			ws.mu.Lock()
+			if ws.deleted {
+				// Nothing is ever coming, but it's not really an error either
 				return nil, nil
 			}
-			// We should always exit this if statement with a return...
-		} else {
-			ws.mu.Unlock()
-			// This is the "nonblocking" part of reading at the end of the stream
+		case <-cancel.Done():
+			// We were killed, but we DON'T throw the error? Is that OK??
+			ws.mu.Lock()
 			return nil, nil
 		}
 	}
+	// Rolling rooms may have already dropped what they're asking for
+	if start < ws.base {
+		return nil, &TruncatedError{Start: ws.base, Message: ws.baseMessage}
+	}
 	// If we get here, we know that we have data to read. Data can only ever grow
 	// (also we're in a lock so we know the length is static at this point).
-	defer ws.mu.Unlock()
 	// Also, since we're ACTUALLY reading, we must have the data available, so refresh
 	refreshed, err := wsys.refreshStreamNoLock(name, ws)
 	if err != nil {
+		wsys.metrics.countError(err)
 		return nil, err
 	}
 	if refreshed {
@@ -297,17 +889,150 @@ func (wsys *WebStreamSystem) ReadData(name string, start, length int, cancel con
 	if length < 0 || length > ws.length-start {
 		length = ws.length - start
 	}
+	start -= ws.base
+	if wsys.config.Rolling {
+		// Rolling rooms shift their data around in place, so the caller needs their own copy
+		result := make([]byte, length)
+		copy(result, ws.data[start:start+length])
+		return result, nil
+	}
 	// I don't really care if people up top mess around with the data,
 	// just return a simple slice
 	return ws.data[start : start+length], nil
 }
 
+// Register a long-lived listener on the given room, such as a socket. Make sure
+// you call the returned function when you're done to remove the listener!
+func (wsys *WebStreamSystem) AddListener(name string) (func(), error) {
+	ws, err := wsys.lockStream(name)
+	if err != nil {
+		return nil, err
+	}
+	ws.listeners += 1
+	ws.mu.Unlock()
+	// This is tied to the stream itself, so it can't accidentally remove a
+	// listener from some new room with the same name
+	return func() {
+		ws.mu.Lock()
+		ws.listeners -= 1
+		ws.mu.Unlock()
+	}, nil
+}
+
 func (wsys *WebStreamSystem) RoomInfo(name string) (*WebStreamInfo, error) {
-	ws, err := wsys.getStream(name)
+	ws, err := wsys.lockStream(name)
 	if err != nil {
 		return nil, err
 	}
-	ws.mu.Lock()
 	defer ws.mu.Unlock()
 	return ws.getInfoNoLock(), nil
 }
+
+// Remove the stream from the backer and the system entirely. Must be locked
+func (wsys *WebStreamSystem) deleteStreamNoLock(name string, ws *webStream) error {
+	err := wsys.backer.Delete(name)
+	if err != nil {
+		return err
+	}
+	if cap(ws.data) > 0 {
+		wsys.decActiveCount()
+	}
+	wsys.reserveData(-(ws.length - ws.base))
+	ws.data = nil
+	ws.deleted = true
+	// Let any waiting readers know the room is gone
+	close(ws.readSignal)
+	ws.readSignal = make(chan struct{})
+	wsys.wsmu.Lock()
+	delete(wsys.webstreams, name)
+	wsys.wsmu.Unlock()
+	wsys.roomChangedNoLock(name, true)
+	return nil
+}
+
+// Delete the room and all its data, freeing up the room slot. Anyone waiting
+// on the room gets nothing back
+func (wsys *WebStreamSystem) DeleteRoom(name string) error {
+	ws, err := wsys.lockExistingStream(name)
+	if err != nil {
+		return err
+	}
+	defer ws.mu.Unlock()
+	return wsys.deleteStreamNoLock(name, ws)
+}
+
+// Throw away all the data in the room, but keep the room. Offsets are NOT reset:
+// the room picks up at its current length, like a rolling room that dropped
+// everything. Reads for older data get a TruncatedError
+func (wsys *WebStreamSystem) ResetRoom(name string) error {
+	ws, err := wsys.lockExistingStream(name)
+	if err != nil {
+		return err
+	}
+	defer ws.mu.Unlock()
+	if ws.framed {
+		// Message indexes keep going too, so we need to know how many there are
+		_, err = wsys.refreshStreamNoLock(name, ws)
+		if err != nil {
+			return err
+		}
+	}
+	meta := ws.getMetaNoLock()
+	meta.Base = ws.length
+	meta.BaseMessage = ws.baseMessage + len(ws.messages)
+	meta.Stored = new(int)
+	err = wsys.backer.WriteWithMeta(name, []byte{}, meta)
+	if err != nil {
+		return err
+	}
+	wsys.reserveData(-(ws.length - ws.base))
+	ws.base = ws.length
+	ws.baseMessage = meta.BaseMessage
+	if cap(ws.data) > 0 {
+		// Fresh memory, so the old data isn't hanging around where a slice could still see it
+		ws.data = make([]byte, 0, cap(ws.data))
+	}
+	if ws.messages != nil {
+		ws.messages = ws.messages[:0]
+	}
+	ws.persisted = 0
+	ws.persistedBase = ws.base
+	ws.dirty = false
+	wsys.roomChangedNoLock(name, false)
+	return nil
+}
+
+// Delete every room that hasn't been written to within the given amount of time.
+// Rooms with listeners are left alone. Returns the deleted rooms
+func (wsys *WebStreamSystem) ExpireStreams(age time.Duration) []string {
+	expired := make([]string, 0)
+	for k, ws := range wsys.snapshotStreams() {
+		ws.mu.Lock()
+		if !ws.deleted && ws.listeners == 0 && time.Since(ws.lastWrite) > age {
+			err := wsys.deleteStreamNoLock(k, ws)
+			if err != nil {
+				log.Printf("WARN: Error expiring webstream %s: %s\n", k, err)
+			} else {
+				expired = append(expired, k)
+			}
+		}
+		ws.mu.Unlock()
+	}
+	if len(expired) > 0 {
+		log.Printf("Expired %d rooms\n", len(expired))
+	}
+	return expired
+}
+
+// Info for every room in the system (even ones not loaded), keyed by room name
+func (wsys *WebStreamSystem) AllRoomInfo() map[string]*WebStreamInfo {
+	result := make(map[string]*WebStreamInfo)
+	for k, ws := range wsys.snapshotStreams() {
+		ws.mu.Lock()
+		if !ws.deleted {
+			result[k] = ws.getInfoNoLock()
+		}
+		ws.mu.Unlock()
+	}
+	return result
+}
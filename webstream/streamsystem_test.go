@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -15,8 +18,21 @@ import (
 const (
 	DefaultCapacity = 1000
 	GoroutineWait   = time.Millisecond
+	WaitDeadline    = 5 * time.Second // Longest waitUntil will wait for something to happen
 )
 
+// Poll the check until it's true, failing the test if it takes longer than
+// WaitDeadline. Goroutines can take a while to get going when the machine is busy
+func waitUntil(t *testing.T, what string, check func() bool) {
+	deadline := time.Now().Add(WaitDeadline)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(GoroutineWait)
+	}
+}
+
 func reasonableConfig(name string) *Config {
 	return &Config{
 		StreamFolder:    utils.RandomTestFolder(name, false),
@@ -67,6 +83,10 @@ func TestRoomRegexEmptyNonblockingRead(t *testing.T) {
 	if !is {
 		t.Errorf("Expected RoomNameError for special char string, got %s", err)
 	}
+	err = system.AppendData("metrics", []byte("hidden"))
+	if nameErr, is := err.(*RoomNameError); !is || !nameErr.Reserved {
+		t.Errorf("Expected reserved RoomNameError for metrics, got %s", err)
+	}
 	data, err := system.ReadData("abcdef", 0, -1, nil)
 	if err != nil {
 		t.Errorf("Expected no error for normal room string, got %s", err)
@@ -122,6 +142,14 @@ func TestActiveRoomLimit(t *testing.T) {
 			}
 		}
 	}
+	// Rooms with listeners can't be evicted to make space
+	for i := range 10 {
+		removeListener, err := system.AddListener(fmt.Sprintf("heck%d", i))
+		if err != nil {
+			t.Fatalf("Error adding listener: %s", err)
+		}
+		defer removeListener()
+	}
 	// Now this room should fail
 	err := system.AppendData("finalroom", []byte("Death"))
 	_, is := err.(*ActiveRoomLimitError)
@@ -242,29 +270,108 @@ func TestWebstreamFileSimple(t *testing.T) {
 	_ = basicStreamTest(t, "simfile", system)
 }
 
+func newTestSqliteBacker(t *testing.T, name string) *WebStreamBacker_Sqlite {
+	backer, err := NewSqliteBacker(filepath.Join(utils.RandomTestFolder(name+"_db", true), "streams.db"))
+	if err != nil {
+		t.Fatalf("Error when creating sqlite backer: %s\n", err)
+	}
+	t.Cleanup(func() { backer.Close() })
+	return backer
+}
+
+func TestWebstreamSqliteSimple(t *testing.T) {
+	config := reasonableConfig("simplesqlite")
+	backer := newTestSqliteBacker(t, "simplesqlite")
+	system, err := NewWebStreamSystem(config, backer)
+	if err != nil {
+		t.Fatalf("Error creating webstream system: %s\n", err)
+	}
+	_ = basicStreamTest(t, "simsqlite", system)
+	// Binary data has to come back out exactly the same
+	binary := []byte{0, 1, 2, 0xff, 0xfe, 0, 'a'}
+	err = backer.Write("binary", binary)
+	if err != nil {
+		t.Fatalf("Error writing binary data: %s", err)
+	}
+	data, exists, err := backer.Read("binary", DefaultCapacity)
+	if err != nil || !exists {
+		t.Fatalf("Error reading binary data: %s (exists: %t)", err, exists)
+	}
+	if !bytes.Equal(data, binary) || cap(data) != DefaultCapacity {
+		t.Fatalf("Binary data not preserved: %v vs %v (cap %d)", data, binary, cap(data))
+	}
+}
+
+func TestMigrateBacker(t *testing.T) {
+	config := reasonableConfig("migratebacker")
+	from, err := NewFileBacker(config.StreamFolder)
+	if err != nil {
+		t.Fatalf("Error when creating file backer: %s\n", err)
+	}
+	for i := range 5 {
+		room := fmt.Sprintf("migrate%d", i)
+		err = from.Write(room, []byte(room+" data"))
+		if err != nil {
+			t.Fatalf("Error writing file room: %s", err)
+		}
+		err = from.WriteMeta(room, &WebStreamMeta{Base: i})
+		if err != nil {
+			t.Fatalf("Error writing file room meta: %s", err)
+		}
+	}
+	to := newTestSqliteBacker(t, "migratebacker")
+	count, err := MigrateBacker(from, to)
+	if err != nil {
+		t.Fatalf("Error migrating: %s", err)
+	}
+	if count != 5 {
+		t.Fatalf("Expected to migrate 5 rooms, got %d", count)
+	}
+	system, err := NewWebStreamSystem(config, to)
+	if err != nil {
+		t.Fatalf("Error creating webstream system: %s\n", err)
+	}
+	if system.RoomCount() != 5 {
+		t.Fatalf("Expected 5 rooms after migration, got %d", system.RoomCount())
+	}
+	for i := range 5 {
+		room := fmt.Sprintf("migrate%d", i)
+		data, err := system.ReadData(room, i, -1, nil)
+		if err != nil {
+			t.Fatalf("Error reading migrated room: %s", err)
+		}
+		if string(data) != room+" data" {
+			t.Fatalf("Migrated data wrong: %s", string(data))
+		}
+	}
+}
+
 func basicReadRoutine(t *testing.T, room string, wsys *WebStreamSystem, count int, offset int) {
 	sendData := []byte("Yes indeed!")
 	threadRead := make([][]byte, count)
 	threadLock := make([]sync.Mutex, count)
 	threadErr := make([]error, count)
+	var wg sync.WaitGroup
 	for i := range count {
+		wg.Add(1)
 		go func(index int) {
+			defer wg.Done()
 			tempRead, err := wsys.ReadData(room, offset, -1, context.Background())
 			threadLock[index].Lock()
 			defer threadLock[index].Unlock()
 			threadRead[index] = tempRead
 			threadErr[index] = err
 		}(i)
-		time.Sleep(GoroutineWait)
 	}
-	// So, after a short bit, the reader should still be sitting around
-	info, err := wsys.RoomInfo(room)
-	if err != nil {
-		t.Fatalf("Error getting room info for %s: %s", room, err)
-	}
-	if info.ListenerCount != count {
-		t.Fatalf("Listeners not registered! Expected %d, got %d\n", count, info.ListenerCount)
+	// So, once they get going, the readers should all be sitting around
+	listenerCount := func() int {
+		info, err := wsys.RoomInfo(room)
+		if err != nil {
+			t.Fatalf("Error getting room info for %s: %s", room, err)
+		}
+		return info.ListenerCount
 	}
+	waitUntil(t, fmt.Sprintf("%d listeners in %s", count, room), func() bool { return listenerCount() == count })
 	for i := range count {
 		threadLock[i].Lock()
 		if threadRead[i] != nil {
@@ -273,18 +380,23 @@ func basicReadRoutine(t *testing.T, room string, wsys *WebStreamSystem, count in
 		threadLock[i].Unlock()
 	}
 	// Now, we send data. The reader should get unblocked
-	err = wsys.AppendData(room, sendData)
+	err := wsys.AppendData(room, sendData)
 	if err != nil {
 		t.Fatalf("Couldn't append data int %s: %s\n", room, err)
 	}
-	time.Sleep(GoroutineWait * time.Duration(count))
 	// It should now be over
-	info, err = wsys.RoomInfo(room)
-	if err != nil {
-		t.Fatalf("Error getting room info for %s after write: %s", room, err)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(WaitDeadline):
+		t.Fatalf("Readers in %s never finished after write", room)
 	}
-	if info.ListenerCount != 0 {
-		t.Fatalf("Listener still registered! Expected 0, got %d\n", info.ListenerCount)
+	if listenerCount() != 0 {
+		t.Fatalf("Listener still registered! Expected 0, got %d\n", listenerCount())
 	}
 	for i := range count {
 		threadLock[i].Lock()
@@ -411,3 +523,960 @@ func TestNoDumpOnReadOnlyRegression(t *testing.T) {
 		}
 	}
 }
+
+func TestRollingRoom(t *testing.T) {
+	config := reasonableConfig("rolling")
+	config.Rolling = true
+	config.StreamDataLimit = 20
+	backer, system := getSystemCustom(t, config)
+	for i := range 3 {
+		err := system.AppendData("rolling", []byte(fmt.Sprintf("chunk%03d", i)))
+		if err != nil {
+			t.Fatalf("Rolling room shouldn't fail on append: %s", err)
+		}
+	}
+	info, err := system.RoomInfo("rolling")
+	if err != nil {
+		t.Fatalf("Couldn't get room info: %s", err)
+	}
+	if info.Length != 24 || info.Base != 4 {
+		t.Fatalf("Expected length 24 and base 4, got %d and %d", info.Length, info.Base)
+	}
+	_, err = system.ReadData("rolling", 0, -1, nil)
+	truncerr, is := err.(*TruncatedError)
+	if !is {
+		t.Fatalf("Expected TruncatedError reading dropped data, got %s", err)
+	}
+	if truncerr.Start != 4 {
+		t.Fatalf("Expected truncated resume at 4, got %d", truncerr.Start)
+	}
+	data, err := system.ReadData("rolling", 10, -1, nil)
+	if err != nil {
+		t.Fatalf("Error reading rolling room: %s", err)
+	}
+	if string(data) != "unk001chunk002" {
+		t.Fatalf("Unexpected rolling data: %s", string(data))
+	}
+	// Writes bigger than the whole room still aren't allowed
+	err = system.AppendData("rolling", make([]byte, 21))
+	_, is = err.(*OverCapacityError)
+	if !is {
+		t.Fatalf("Expected OverCapacityError for giant write, got %s", err)
+	}
+	// The base has to survive a trip through the backer
+	system.DumpStreams(true)
+	if backer.Metas["rolling"].Base != 4 {
+		t.Fatalf("Base not persisted, got %d", backer.Metas["rolling"].Base)
+	}
+	system, err = NewWebStreamSystem(config, backer)
+	if err != nil {
+		t.Fatalf("Error while reinitializing system: %s", err)
+	}
+	data, err = system.ReadData("rolling", 10, -1, nil)
+	if err != nil {
+		t.Fatalf("Error reading reloaded rolling room: %s", err)
+	}
+	if string(data) != "unk001chunk002" {
+		t.Fatalf("Unexpected reloaded rolling data: %s", string(data))
+	}
+	// Non-rolling rooms must still fill up
+	config = reasonableConfig("notrolling")
+	config.StreamDataLimit = 20
+	_, system = getSystemCustom(t, config)
+	err = system.AppendData("notrolling", make([]byte, 20))
+	if err != nil {
+		t.Fatalf("Error filling room: %s", err)
+	}
+	err = system.AppendData("notrolling", []byte("x"))
+	_, is = err.(*OverCapacityError)
+	if !is {
+		t.Fatalf("Expected OverCapacityError on full room, got %s", err)
+	}
+}
+
+func TestAppendOnlyPersistence(t *testing.T) {
+	backer, _, system := getSystem(t, "appendonly")
+	for _, chunk := range []string{"abc", "def", "ghi"} {
+		err := system.AppendData("appendonly", []byte(chunk))
+		if err != nil {
+			t.Fatalf("Error appending: %s", err)
+		}
+		// Every dump should only send the new part, even after a refresh
+		system.DumpStreams(true)
+		last := backer.Events[len(backer.Events)-1]
+		if last.Type != 2 || string(last.Data) != chunk {
+			t.Fatalf("Expected append event with %s, got type %d with %s", chunk, last.Type, string(last.Data))
+		}
+	}
+	if string(backer.Rooms["appendonly"]) != "abcdefghi" {
+		t.Fatalf("Backer has wrong data: %s", string(backer.Rooms["appendonly"]))
+	}
+	// A backer which lost data gets a full write instead
+	err := system.AppendData("appendonly", []byte("jkl"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	backer.Rooms["appendonly"] = []byte("abc")
+	system.DumpStreams(true)
+	if string(backer.Rooms["appendonly"]) != "abcdefghijkl" {
+		t.Fatalf("Backer not repaired with full write: %s", string(backer.Rooms["appendonly"]))
+	}
+}
+
+func testBackerAppend(t *testing.T, backer WebStreamBacker) {
+	err := backer.Append("appender", []byte("hello"), 0)
+	if err != nil {
+		t.Fatalf("Error appending to new backing: %s", err)
+	}
+	err = backer.Append("appender", []byte{0, 0xff, 'x'}, 5)
+	if err != nil {
+		t.Fatalf("Error appending to backing: %s", err)
+	}
+	// Appending at an earlier point throws away everything after it, like
+	// what would be left over from a dump that crashed partway
+	err = backer.Append("appender", []byte("world"), 5)
+	if err != nil {
+		t.Fatalf("Error appending over garbage: %s", err)
+	}
+	data, _, err := backer.Read("appender", DefaultCapacity)
+	if err != nil {
+		t.Fatalf("Error reading backing: %s", err)
+	}
+	if string(data) != "helloworld" {
+		t.Fatalf("Expected helloworld, got %v", data)
+	}
+	// But there has to actually BE that much data
+	err = backer.Append("appender", []byte("nope"), 50)
+	if err == nil {
+		t.Fatalf("Expected error appending past the end of the backing")
+	}
+	err = backer.Append("appender", []byte{0, 0xff, 'x'}, 10)
+	if err != nil {
+		t.Fatalf("Error appending binary: %s", err)
+	}
+	data, _, err = backer.Read("appender", DefaultCapacity)
+	if err != nil {
+		t.Fatalf("Error reading backing: %s", err)
+	}
+	if !bytes.Equal(data, []byte("helloworld\x00\xffx")) {
+		t.Fatalf("Binary append not preserved: %v", data)
+	}
+}
+
+func TestFileBackerAppend(t *testing.T) {
+	backer, err := NewFileBacker(reasonableConfig("fileappend").StreamFolder)
+	if err != nil {
+		t.Fatalf("Error when creating file backer: %s\n", err)
+	}
+	testBackerAppend(t, backer)
+	// Nothing should be left over from the atomic writes
+	err = backer.Write("writer", []byte("whatever"))
+	if err != nil {
+		t.Fatalf("Error writing: %s", err)
+	}
+	temps, err := os.ReadDir(filepath.Join(backer.Folder, TempFolder))
+	if err != nil {
+		t.Fatalf("Error reading temp folder: %s", err)
+	}
+	if len(temps) != 0 {
+		t.Fatalf("Temp files left over after write: %d", len(temps))
+	}
+}
+
+func TestFileBackerCompressed(t *testing.T) {
+	backer, err := NewFileBacker(reasonableConfig("filecompressed").StreamFolder)
+	if err != nil {
+		t.Fatalf("Error when creating file backer: %s\n", err)
+	}
+	// An old uncompressed room from before compression was turned on
+	err = backer.Write("oldroom", []byte("old data"))
+	if err != nil {
+		t.Fatalf("Error writing: %s", err)
+	}
+	backer.Compress = true
+	testBackerAppend(t, backer)
+	repetitive := bytes.Repeat([]byte("the same thing over and over "), 100)
+	err = backer.Write("repetitive", repetitive)
+	if err != nil {
+		t.Fatalf("Error writing: %s", err)
+	}
+	stat, err := os.Stat(filepath.Join(backer.Folder, "repetitive"+CompressedExt))
+	if err != nil {
+		t.Fatalf("Compressed file not written: %s", err)
+	}
+	if stat.Size() >= int64(len(repetitive)) {
+		t.Fatalf("Compressed file isn't smaller: %d", stat.Size())
+	}
+	// Names and lengths are the same no matter how the room is stored
+	lengths := make(map[string]int)
+	err = backer.BackingIterator(func(k string, gl func() int) bool {
+		lengths[k] = gl()
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Error iterating: %s", err)
+	}
+	if len(lengths) != 3 || lengths["oldroom"] != 8 || lengths["appender"] != 13 || lengths["repetitive"] != len(repetitive) {
+		t.Fatalf("Wrong rooms/lengths from iterator: %v", lengths)
+	}
+	data, _, err := backer.Read("oldroom", DefaultCapacity)
+	if err != nil {
+		t.Fatalf("Error reading old room: %s", err)
+	}
+	if string(data) != "old data" {
+		t.Fatalf("Old room not read: %s", data)
+	}
+	// The old room is converted the next time it's written
+	err = backer.Append("oldroom", []byte("!"), 8)
+	if err != nil {
+		t.Fatalf("Error appending to old room: %s", err)
+	}
+	_, err = os.Stat(filepath.Join(backer.Folder, "oldroom"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Uncompressed old room left behind: %v", err)
+	}
+	// Turning compression off still reads compressed rooms, then switches them back
+	backer.Compress = false
+	err = backer.Append("repetitive", []byte("!"), len(repetitive))
+	if err != nil {
+		t.Fatalf("Error appending after turning off compression: %s", err)
+	}
+	data, _, err = backer.Read("repetitive", DefaultCapacity)
+	if err != nil {
+		t.Fatalf("Error reading: %s", err)
+	}
+	if !bytes.Equal(data, append(repetitive, '!')) {
+		t.Fatalf("Data lost switching formats")
+	}
+	_, err = os.Stat(filepath.Join(backer.Folder, "repetitive"+CompressedExt))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Compressed room left behind: %v", err)
+	}
+	err = backer.Delete("oldroom")
+	if err != nil {
+		t.Fatalf("Error deleting: %s", err)
+	}
+	exists, err := Exists(backer, "oldroom")
+	if err != nil || exists {
+		t.Fatalf("Compressed room not deleted: %v", err)
+	}
+}
+
+func TestSqliteBackerAppend(t *testing.T) {
+	testBackerAppend(t, newTestSqliteBacker(t, "sqliteappend"))
+}
+
+func TestCrashedAppend(t *testing.T) {
+	config := reasonableConfig("crashedappend")
+	backer, err := NewFileBacker(config.StreamFolder)
+	if err != nil {
+		t.Fatalf("Error when creating file backer: %s\n", err)
+	}
+	system, err := NewWebStreamSystem(config, backer)
+	if err != nil {
+		t.Fatalf("Error creating webstream system: %s\n", err)
+	}
+	err = system.MakeFramed("framed")
+	if err != nil {
+		t.Fatalf("Error making room framed: %s", err)
+	}
+	for _, room := range []string{"raw", "framed"} {
+		err = system.AppendData(room, []byte("hello"))
+		if err != nil {
+			t.Fatalf("Error appending: %s", err)
+		}
+	}
+	system.DumpStreams(true)
+	// A dump that died after writing part of the data but before the metadata
+	for _, room := range []string{"raw", "framed"} {
+		file, err := os.OpenFile(filepath.Join(config.StreamFolder, room), os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			t.Fatalf("Error opening room file: %s", err)
+		}
+		_, err = file.Write([]byte{0, 0, 0, 50, 'w', 'o'})
+		file.Close()
+		if err != nil {
+			t.Fatalf("Error writing garbage: %s", err)
+		}
+	}
+	system, err = NewWebStreamSystem(config, backer)
+	if err != nil {
+		t.Fatalf("Error reinitializing system: %s\n", err)
+	}
+	if system.TotalData() != 14 {
+		t.Fatalf("Garbage counted in total data: %d", system.TotalData())
+	}
+	data, err := system.ReadData("raw", 0, -1, nil)
+	if err != nil {
+		t.Fatalf("Error reading: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected hello after crash, got %q", data)
+	}
+	result, err := system.ReadMessages("framed", 0, -1, -1, nil)
+	if err != nil {
+		t.Fatalf("Framed room didn't survive crash: %s", err)
+	}
+	if len(result.Messages) != 1 || string(result.Messages[0]) != "hello" {
+		t.Fatalf("Wrong messages after crash: %q", result.Messages)
+	}
+	// The garbage is overwritten by the next real data
+	err = system.AppendData("raw", []byte(" world"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	system.DumpStreams(true)
+	stored, _, err := backer.Read("raw", DefaultCapacity)
+	if err != nil {
+		t.Fatalf("Error reading backing: %s", err)
+	}
+	if string(stored) != "hello world" {
+		t.Fatalf("Garbage left in backing: %q", stored)
+	}
+}
+
+func TestCrashedRewrite(t *testing.T) {
+	config := reasonableConfig("crashedrewrite")
+	backer, err := NewFileBacker(config.StreamFolder)
+	if err != nil {
+		t.Fatalf("Error when creating file backer: %s\n", err)
+	}
+	oldStored, newStored := 5, 3
+	err = backer.WriteWithMeta("room", []byte("hello"), &WebStreamMeta{Stored: &oldStored})
+	if err != nil {
+		t.Fatalf("Error writing room: %s", err)
+	}
+	// A rewrite (say a rolling room dropping data) that died before the metadata
+	// was written never happened
+	_, err = backer.writeTemp("room_*", []byte("llo"))
+	if err != nil {
+		t.Fatalf("Error writing temp: %s", err)
+	}
+	backer, err = NewFileBacker(config.StreamFolder)
+	if err != nil {
+		t.Fatalf("Error recreating file backer: %s\n", err)
+	}
+	data, _, err := backer.Read("room", DefaultCapacity)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Expected old data after crash before metadata, got %q (%v)", data, err)
+	}
+	temps, err := os.ReadDir(filepath.Join(config.StreamFolder, TempFolder))
+	if err != nil || len(temps) != 0 {
+		t.Fatalf("Expected temp folder to be cleared: %v (%v)", temps, err)
+	}
+	// One that died after the metadata was written gets finished on startup
+	temp, err := backer.writeTemp("room_*", []byte("llo"))
+	if err != nil {
+		t.Fatalf("Error writing temp: %s", err)
+	}
+	err = backer.writeMetaNoLock("room", &fileMeta{
+		WebStreamMeta: WebStreamMeta{Base: 2, Stored: &newStored},
+		Pending:       filepath.Base(temp),
+	})
+	if err != nil {
+		t.Fatalf("Error writing meta: %s", err)
+	}
+	backer, err = NewFileBacker(config.StreamFolder)
+	if err != nil {
+		t.Fatalf("Error recreating file backer: %s\n", err)
+	}
+	system, err := NewWebStreamSystem(config, backer)
+	if err != nil {
+		t.Fatalf("Error creating webstream system: %s\n", err)
+	}
+	data, err = system.ReadData("room", 2, -1, nil)
+	if err != nil || string(data) != "llo" {
+		t.Fatalf("Expected new data at the new base after crash, got %q (%v)", data, err)
+	}
+	raw, err := os.ReadFile(filepath.Join(config.StreamFolder, MetaFolder, "room.json"))
+	if err != nil || strings.Contains(string(raw), "pending") {
+		t.Fatalf("Expected pending mark to be cleared: %s (%v)", raw, err)
+	}
+}
+
+func TestTotalDataLimit(t *testing.T) {
+	config := reasonableConfig("totaldatalimit")
+	config.TotalDataLimit = 100
+	backer := NewTestBacker()
+	backer.Rooms["existing"] = make([]byte, 50)
+	system, err := NewWebStreamSystem(config, backer)
+	if err != nil {
+		t.Fatalf("Error while initializing new system: %s", err)
+	}
+	if system.TotalData() != 50 {
+		t.Fatalf("Expected existing rooms to count toward total, got %d", system.TotalData())
+	}
+	err = system.AppendData("newroom", make([]byte, 40))
+	if err != nil {
+		t.Fatalf("Error appending under the limit: %s", err)
+	}
+	err = system.AppendData("existing", make([]byte, 20))
+	limiterr, is := err.(*TotalDataLimitError)
+	if !is {
+		t.Fatalf("Expected TotalDataLimitError, got %s", err)
+	}
+	if limiterr.Current != 90 || limiterr.Limit != 100 {
+		t.Fatalf("Unexpected limit error values: %d / %d", limiterr.Current, limiterr.Limit)
+	}
+	info, err := system.RoomInfo("existing")
+	if err != nil {
+		t.Fatalf("Error getting room info: %s", err)
+	}
+	if info.Length != 50 {
+		t.Fatalf("Rejected write changed the room: %d", info.Length)
+	}
+	err = system.AppendData("existing", make([]byte, 10))
+	if err != nil {
+		t.Fatalf("Error appending exactly to the limit: %s", err)
+	}
+	if system.TotalData() != 100 {
+		t.Fatalf("Expected total 100, got %d", system.TotalData())
+	}
+}
+
+func TestTotalDataLimitRolling(t *testing.T) {
+	config := reasonableConfig("totaldatarolling")
+	config.TotalDataLimit = 30
+	config.StreamDataLimit = 20
+	config.Rolling = true
+	_, system := getSystemCustom(t, config)
+	// Rolling rooms stop growing once full, so they can write forever
+	for range 10 {
+		err := system.AppendData("rolling", make([]byte, 8))
+		if err != nil {
+			t.Fatalf("Error appending to rolling room: %s", err)
+		}
+	}
+	if system.TotalData() != 20 {
+		t.Fatalf("Expected total 20, got %d", system.TotalData())
+	}
+	err := system.AppendData("another", make([]byte, 11))
+	_, is := err.(*TotalDataLimitError)
+	if !is {
+		t.Fatalf("Expected TotalDataLimitError, got %s", err)
+	}
+}
+
+func TestDeleteRoom(t *testing.T) {
+	config := reasonableConfig("deleteroom")
+	config.TotalRoomLimit = 2
+	backer, system := getSystemCustom(t, config)
+	for _, room := range []string{"first", "second"} {
+		err := system.AppendData(room, []byte("data"))
+		if err != nil {
+			t.Fatalf("Error appending to %s: %s", room, err)
+		}
+	}
+	system.DumpStreams(true)
+	if _, ok := backer.Rooms["first"]; !ok {
+		t.Fatalf("Room wasn't dumped before delete")
+	}
+	err := system.AppendData("third", []byte("data"))
+	if _, ok := err.(*RoomLimitError); !ok {
+		t.Fatalf("Expected RoomLimitError, got %s", err)
+	}
+	// Someone waiting on the room should get let go when it's deleted
+	done := make(chan []byte)
+	go func() {
+		data, _ := system.ReadData("first", 4, -1, context.Background())
+		done <- data
+	}()
+	time.Sleep(10 * time.Millisecond) // Give the reader time to start waiting
+	err = system.DeleteRoom("first")
+	if err != nil {
+		t.Fatalf("Error deleting room: %s", err)
+	}
+	select {
+	case data := <-done:
+		if len(data) != 0 {
+			t.Fatalf("Reader of deleted room got data: %s", string(data))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Reader of deleted room never returned")
+	}
+	if _, ok := backer.Rooms["first"]; ok {
+		t.Fatalf("Room wasn't deleted from the backer")
+	}
+	if system.RoomCount() != 1 {
+		t.Fatalf("Expected 1 room after delete, got %d", system.RoomCount())
+	}
+	if system.TotalData() != 4 {
+		t.Fatalf("Deleted room still counts toward total: %d", system.TotalData())
+	}
+	err = system.AppendData("third", []byte("data"))
+	if err != nil {
+		t.Fatalf("Deleting a room didn't free up a slot: %s", err)
+	}
+	err = system.DeleteRoom("nothere")
+	if _, ok := err.(*utils.NotFoundError); !ok {
+		t.Fatalf("Expected NotFoundError, got %s", err)
+	}
+}
+
+func TestResetRoom(t *testing.T) {
+	backer, _, system := getSystem(t, "resetroom")
+	err := system.AppendData("reset", []byte("old data"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	err = system.ResetRoom("reset")
+	if err != nil {
+		t.Fatalf("Error resetting room: %s", err)
+	}
+	if len(backer.Rooms["reset"]) != 0 || backer.Metas["reset"].Base != 8 {
+		t.Fatalf("Reset not persisted: %v, base %d", backer.Rooms["reset"], backer.Metas["reset"].Base)
+	}
+	if system.TotalData() != 0 {
+		t.Fatalf("Reset room still counts toward total: %d", system.TotalData())
+	}
+	// Offsets keep going, the old data is just gone
+	_, err = system.ReadData("reset", 0, -1, nil)
+	truncerr, ok := err.(*TruncatedError)
+	if !ok || truncerr.Start != 8 {
+		t.Fatalf("Expected truncation at 8, got %s", err)
+	}
+	err = system.AppendData("reset", []byte("new"))
+	if err != nil {
+		t.Fatalf("Error appending after reset: %s", err)
+	}
+	data, err := system.ReadData("reset", 8, -1, nil)
+	if err != nil || string(data) != "new" {
+		t.Fatalf("Expected new data after reset, got %s (%s)", string(data), err)
+	}
+	// Make sure it all comes back the same after a restart
+	system.DumpStreams(true)
+	system, err = NewWebStreamSystem(reasonableConfig("resetroom"), backer)
+	if err != nil {
+		t.Fatalf("Error while reinitializing system: %s", err)
+	}
+	data, err = system.ReadData("reset", 8, -1, nil)
+	if err != nil || string(data) != "new" {
+		t.Fatalf("Expected new data after restart, got %s (%s)", string(data), err)
+	}
+	// Data that doesn't go with its metadata (old writes could crash between the two)
+	// is dropped, and offsets still never go backwards
+	stored := 11
+	backer.Rooms["reset"] = []byte{}
+	backer.Metas["reset"] = WebStreamMeta{Stored: &stored}
+	system, err = NewWebStreamSystem(reasonableConfig("resetroom"), backer)
+	if err != nil {
+		t.Fatalf("Error while reinitializing system: %s", err)
+	}
+	info, err := system.RoomInfo("reset")
+	if err != nil || info.Length != 11 || info.Base != 11 {
+		t.Fatalf("Expected room to pick up after its old data: %v (%v)", info, err)
+	}
+	err = system.AppendData("reset", []byte("after"))
+	if err != nil {
+		t.Fatalf("Error appending after mismatch: %s", err)
+	}
+	data, err = system.ReadData("reset", 11, -1, nil)
+	if err != nil || string(data) != "after" {
+		t.Fatalf("Expected new data after mismatch, got %s (%s)", string(data), err)
+	}
+}
+
+func TestExpireStreams(t *testing.T) {
+	backer, _, system := getSystem(t, "expirestreams")
+	for _, room := range []string{"old", "listened", "fresh"} {
+		err := system.AppendData(room, []byte("data"))
+		if err != nil {
+			t.Fatalf("Error appending to %s: %s", room, err)
+		}
+	}
+	removeListener, err := system.AddListener("listened")
+	if err != nil {
+		t.Fatalf("Error adding listener: %s", err)
+	}
+	defer removeListener()
+	time.Sleep(20 * time.Millisecond)
+	err = system.AppendData("fresh", []byte("more"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	system.DumpStreams(true)
+	expired := system.ExpireStreams(10 * time.Millisecond)
+	if len(expired) != 1 || expired[0] != "old" {
+		t.Fatalf("Expected only 'old' to expire, got %v", expired)
+	}
+	if _, ok := backer.Rooms["old"]; ok {
+		t.Fatalf("Expired room wasn't deleted from the backer")
+	}
+	// Last write is persisted, so a restart shouldn't make old rooms look new
+	system, err = NewWebStreamSystem(reasonableConfig("expirestreams"), backer)
+	if err != nil {
+		t.Fatalf("Error while reinitializing system: %s", err)
+	}
+	expired = system.ExpireStreams(10 * time.Millisecond)
+	if len(expired) != 1 || expired[0] != "listened" {
+		t.Fatalf("Expected 'listened' to expire after restart, got %v", expired)
+	}
+	// Rooms that were only just made (with nothing written) aren't expired right away
+	_, err = system.RoomInfo("brandnew")
+	if err != nil {
+		t.Fatalf("Error getting room info: %s", err)
+	}
+	expired = system.ExpireStreams(10 * time.Millisecond)
+	if len(expired) != 0 {
+		t.Fatalf("Expected nothing to expire, got %v", expired)
+	}
+}
+
+func TestClaimRoom(t *testing.T) {
+	backer, config, system := getSystem(t, "claimroom")
+	err := system.AppendDataWithToken("used", []byte("before"), "")
+	if err != nil {
+		t.Fatalf("Unclaimed room should allow any write: %s", err)
+	}
+	// Nobody gets to take over a room that's already being used
+	_, err = system.ClaimRoom("used")
+	if claimErr, ok := err.(*RoomClaimedError); !ok || !claimErr.HasData {
+		t.Fatalf("Expected RoomClaimedError for room with data, got %s", err)
+	}
+	token, err := system.ClaimRoom("claim")
+	if err != nil {
+		t.Fatalf("Error claiming room: %s", err)
+	}
+	if token == "" || backer.Metas["claim"].WriteToken == "" || backer.Metas["claim"].WriteToken == token {
+		t.Fatalf("Claim wasn't persisted as a hash: %s vs %s", backer.Metas["claim"].WriteToken, token)
+	}
+	if _, ok := backer.Rooms["claim"]; !ok {
+		t.Fatalf("Claim didn't persist the room")
+	}
+	_, err = system.ClaimRoom("claim")
+	if _, ok := err.(*RoomClaimedError); !ok {
+		t.Fatalf("Expected RoomClaimedError, got %s", err)
+	}
+	err = system.AppendDataWithToken("claim", []byte("before"), token)
+	if err != nil {
+		t.Fatalf("Error writing with token: %s", err)
+	}
+	for _, bad := range []string{"", "wrong"} {
+		err = system.AppendDataWithToken("claim", []byte("bad"), bad)
+		if _, ok := err.(*WriteTokenError); !ok {
+			t.Fatalf("Expected WriteTokenError for token '%s', got %s", bad, err)
+		}
+	}
+	err = system.AppendDataWithToken("claim", []byte("after"), token)
+	if err != nil {
+		t.Fatalf("Error writing with token: %s", err)
+	}
+	// Brand new rooms can be claimed too, and claims survive a restart
+	newtoken, err := system.ClaimRoom("newclaim")
+	if err != nil {
+		t.Fatalf("Error claiming new room: %s", err)
+	}
+	system.DumpStreams(true)
+	system, err = NewWebStreamSystem(config, backer)
+	if err != nil {
+		t.Fatalf("Error while reinitializing system: %s", err)
+	}
+	err = system.AppendDataWithToken("claim", []byte("bad"), "")
+	if _, ok := err.(*WriteTokenError); !ok {
+		t.Fatalf("Claim didn't survive restart: %s", err)
+	}
+	err = system.AppendDataWithToken("newclaim", []byte("bad"), token)
+	if _, ok := err.(*WriteTokenError); !ok {
+		t.Fatalf("New room claim didn't survive restart: %s", err)
+	}
+	err = system.AppendDataWithToken("newclaim", []byte("good"), newtoken)
+	if err != nil {
+		t.Fatalf("Error writing to new room with token: %s", err)
+	}
+	data, err := system.ReadData("claim", 0, -1, nil)
+	if err != nil || string(data) != "beforeafter" {
+		t.Fatalf("Unexpected data in claimed room: %s (%s)", string(data), err)
+	}
+}
+
+func TestActiveRoomEviction(t *testing.T) {
+	config := reasonableConfig("activeeviction")
+	config.ActiveRoomLimit = 3
+	config.IdleRoomTime = utils.Duration(time.Duration(time.Minute))
+	backer, system := getSystemCustom(t, config)
+	for _, room := range []string{"first", "second", "third"} {
+		err := system.AppendData(room, []byte(room))
+		if err != nil {
+			t.Fatalf("Error appending to %s: %s", room, err)
+		}
+	}
+	// Touch the first room so the second is now the oldest, then put a listener
+	// on the third so it can't go either
+	_, err := system.ReadData("first", 0, -1, nil)
+	if err != nil {
+		t.Fatalf("Error reading first: %s", err)
+	}
+	removeListener, err := system.AddListener("third")
+	if err != nil {
+		t.Fatalf("Error adding listener: %s", err)
+	}
+	defer removeListener()
+	err = system.AppendData("fourth", []byte("fourth"))
+	if err != nil {
+		t.Fatalf("Expected eviction instead of error, got %s", err)
+	}
+	if string(backer.Rooms["second"]) != "second" {
+		t.Fatalf("Evicted room wasn't saved: %s", string(backer.Rooms["second"]))
+	}
+	info, err := system.RoomInfo("second")
+	if err != nil {
+		t.Fatalf("Error getting room info: %s", err)
+	}
+	if info.Capacity != 0 || info.Dirty {
+		t.Fatalf("Second room should've been evicted: %v", info)
+	}
+	if system.ActiveCount() != 3 {
+		t.Fatalf("Expected 3 active rooms, got %d", system.ActiveCount())
+	}
+	// Loading the second room again pushes out the first (now the oldest without listeners)
+	data, err := system.ReadData("second", 0, -1, nil)
+	if err != nil || string(data) != "second" {
+		t.Fatalf("Evicted room didn't come back: %s (%s)", string(data), err)
+	}
+	info, err = system.RoomInfo("first")
+	if err != nil {
+		t.Fatalf("Error getting room info: %s", err)
+	}
+	if info.Capacity != 0 {
+		t.Fatalf("First room should've been evicted: %v", info)
+	}
+	info, err = system.RoomInfo("third")
+	if err != nil {
+		t.Fatalf("Error getting room info: %s", err)
+	}
+	if info.Capacity == 0 {
+		t.Fatalf("Room with a listener was evicted")
+	}
+}
+
+func TestFramedRoom(t *testing.T) {
+	backer, config, system := getSystem(t, "framedroom")
+	err := system.MakeFramed("framed")
+	if err != nil {
+		t.Fatalf("Error making room framed: %s", err)
+	}
+	for _, message := range []string{"a\nb", "c", ""} {
+		err = system.AppendData("framed", []byte(message))
+		if err != nil {
+			t.Fatalf("Error appending message: %s", err)
+		}
+	}
+	checkRead := func(system *WebStreamSystem, start, message, count int, expected []string, first int, expectedStart int) {
+		result, err := system.ReadMessages("framed", start, message, count, nil)
+		if err != nil {
+			t.Fatalf("Error reading messages: %s", err)
+		}
+		if len(result.Messages) != len(expected) {
+			t.Fatalf("Expected %d messages, got %d", len(expected), len(result.Messages))
+		}
+		for i := range expected {
+			if string(result.Messages[i]) != expected[i] {
+				t.Fatalf("Message %d: expected %q, got %q", i, expected[i], string(result.Messages[i]))
+			}
+		}
+		if result.FirstMessage != first || result.Start != expectedStart {
+			t.Fatalf("Expected first message %d at %d, got %d at %d", first, expectedStart, result.FirstMessage, result.Start)
+		}
+	}
+	checkRead(system, 0, -1, -1, []string{"a\nb", "c", ""}, 0, 0)
+	checkRead(system, 0, 1, 1, []string{"c"}, 1, 7)
+	checkRead(system, 7, -1, -1, []string{"c", ""}, 1, 7)
+	checkRead(system, 16, -1, -1, []string{}, 3, 16)
+	_, err = system.ReadMessages("framed", 1, -1, -1, nil)
+	if _, ok := err.(*FramingError); !ok {
+		t.Fatalf("Expected FramingError reading mid-message, got %s", err)
+	}
+	// Framing survives a restart, and the index gets rebuilt
+	system.DumpStreams(true)
+	system, err = NewWebStreamSystem(config, backer)
+	if err != nil {
+		t.Fatalf("Error while reinitializing system: %s", err)
+	}
+	err = system.AppendData("framed", []byte("d"))
+	if err != nil {
+		t.Fatalf("Error appending message after restart: %s", err)
+	}
+	checkRead(system, 0, 2, -1, []string{"", "d"}, 2, 12)
+	// Raw rooms with data can't become framed
+	err = system.AppendData("raw", []byte("data"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	err = system.MakeFramed("raw")
+	if _, ok := err.(*FramingError); !ok {
+		t.Fatalf("Expected FramingError framing a raw room, got %s", err)
+	}
+}
+
+func TestFramedRollingRoom(t *testing.T) {
+	config := reasonableConfig("framedrolling")
+	config.StreamDataLimit = 20
+	config.Rolling = true
+	_, system := getSystemCustom(t, config)
+	err := system.MakeFramed("framed")
+	if err != nil {
+		t.Fatalf("Error making room framed: %s", err)
+	}
+	// Each message is 7 bytes framed, so the fourth has to push out only the first
+	for _, message := range []string{"one", "two", "thr"} {
+		err = system.AppendData("framed", []byte(message))
+		if err != nil {
+			t.Fatalf("Error appending message: %s", err)
+		}
+	}
+	err = system.AppendData("framed", []byte("f"))
+	if err != nil {
+		t.Fatalf("Error appending to full rolling room: %s", err)
+	}
+	_, err = system.ReadMessages("framed", 0, 0, -1, nil)
+	truncerr, ok := err.(*TruncatedError)
+	if !ok || truncerr.Message != 1 || truncerr.Start != 7 {
+		t.Fatalf("Expected truncation at message 1 (7), got %s", err)
+	}
+	result, err := system.ReadMessages("framed", 0, 1, -1, nil)
+	if err != nil {
+		t.Fatalf("Error reading messages: %s", err)
+	}
+	if len(result.Messages) != 3 || string(result.Messages[0]) != "two" || string(result.Messages[2]) != "f" {
+		t.Fatalf("Unexpected messages after roll: %q", result.Messages)
+	}
+	// Resetting keeps the message count going too
+	err = system.ResetRoom("framed")
+	if err != nil {
+		t.Fatalf("Error resetting room: %s", err)
+	}
+	err = system.AppendData("framed", []byte("new"))
+	if err != nil {
+		t.Fatalf("Error appending message: %s", err)
+	}
+	result, err = system.ReadMessages("framed", 0, 4, -1, nil)
+	if err != nil || len(result.Messages) != 1 || string(result.Messages[0]) != "new" {
+		t.Fatalf("Unexpected messages after reset: %v (%s)", result, err)
+	}
+}
+
+func TestExportImportRooms(t *testing.T) {
+	backer, _, system := getSystem(t, "exportrooms")
+	token, err := system.ClaimRoom("saved")
+	if err != nil {
+		t.Fatalf("Error claiming room: %s", err)
+	}
+	err = system.AppendData("saved", []byte("saved data"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	err = system.SetReadonlyKey("saved", "publickey")
+	if err != nil {
+		t.Fatalf("Error setting readonly key: %s", err)
+	}
+	system.DumpStreams(true)
+	// This one is only in memory, it should still come along
+	err = system.AppendData("dirty", []byte("not dumped"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	if _, ok := backer.Rooms["dirty"]; ok {
+		t.Fatalf("Dirty room shouldn't be in the backer yet")
+	}
+	var archive bytes.Buffer
+	err = system.ExportRooms(&archive, nil)
+	if err != nil {
+		t.Fatalf("Error exporting rooms: %s", err)
+	}
+
+	backer2, system2 := getSystemCustom(t, reasonableConfig("importrooms"))
+	err = system2.AppendData("saved", []byte("this gets replaced"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	imported, err := system2.ImportRooms(&archive)
+	if err != nil {
+		t.Fatalf("Error importing rooms: %s", err)
+	}
+	if len(imported) != 2 || imported[0] != "dirty" || imported[1] != "saved" {
+		t.Fatalf("Unexpected imported rooms: %v", imported)
+	}
+	if string(backer2.Rooms["dirty"]) != "not dumped" || backer2.Metas["saved"].ReadonlyKey != "publickey" {
+		t.Fatalf("Import didn't go through the backer: %s, %v", string(backer2.Rooms["dirty"]), backer2.Metas["saved"])
+	}
+	if system2.TotalData() != 20 {
+		t.Fatalf("Expected total data 20 after import, got %d", system2.TotalData())
+	}
+	data, err := system2.ReadData("saved", 0, -1, nil)
+	if err != nil || string(data) != "saved data" {
+		t.Fatalf("Imported room has wrong data: %s (%s)", string(data), err)
+	}
+	// The claim came along too
+	err = system2.AppendDataWithToken("saved", []byte("!"), "")
+	if _, ok := err.(*WriteTokenError); !ok {
+		t.Fatalf("Expected claim to survive import, got %s", err)
+	}
+	err = system2.AppendDataWithToken("saved", []byte("!"), token)
+	if err != nil {
+		t.Fatalf("Error writing with token after import: %s", err)
+	}
+	if system2.ReadonlyKeys()["saved"] != "publickey" {
+		t.Fatalf("Readonly key didn't survive import")
+	}
+}
+
+func TestRoomClasses(t *testing.T) {
+	config := reasonableConfig("roomclasses")
+	config.ReadTimeout = utils.Duration(time.Minute)
+	config.RoomClass = []RoomClass{
+		{Regex: "^big-", StreamDataLimit: 5000, SingleDataLimit: 2000},
+		{Regex: "^tiny-", StreamDataLimit: 10, ReadTimeout: utils.Duration(time.Second)},
+		{Regex: "^big-never", StreamDataLimit: 1}, // First match wins, so this does nothing
+	}
+	_, system := getSystemCustom(t, config)
+	limits := system.RoomLimits("big-nevermind")
+	if limits.StreamDataLimit != 5000 || limits.SingleDataLimit != 2000 || limits.ReadTimeout != time.Minute {
+		t.Fatalf("Wrong limits for big room: %v", limits)
+	}
+	limits = system.RoomLimits("tiny-room")
+	if limits.StreamDataLimit != 10 || limits.SingleDataLimit != 500 || limits.ReadTimeout != time.Second {
+		t.Fatalf("Wrong limits for tiny room: %v", limits)
+	}
+	limits = system.RoomLimits("normal")
+	if limits.StreamDataLimit != 1000 || limits.SingleDataLimit != 500 || limits.ReadTimeout != time.Minute {
+		t.Fatalf("Wrong limits for normal room: %v", limits)
+	}
+	// Rooms are actually given the space from their class
+	for i := range 4 {
+		err := system.AppendData("big-room", make([]byte, 1000))
+		if err != nil {
+			t.Fatalf("Error appending to big room on write %d: %s", i, err)
+		}
+	}
+	info, err := system.RoomInfo("big-room")
+	if err != nil {
+		t.Fatalf("Error getting room info: %s", err)
+	}
+	if info.Capacity != 5000 || info.Length != 4000 {
+		t.Fatalf("Big room got wrong capacity/length: %d/%d", info.Capacity, info.Length)
+	}
+	err = system.AppendData("tiny-room", make([]byte, 11))
+	if _, is := err.(*OverCapacityError); !is {
+		t.Fatalf("Expected OverCapacityError in tiny room, got %s", err)
+	}
+	err = system.AppendData("normal", make([]byte, 1000))
+	if err != nil {
+		t.Fatalf("Error appending to normal room: %s", err)
+	}
+	info, err = system.RoomInfo("normal")
+	if err != nil {
+		t.Fatalf("Error getting room info: %s", err)
+	}
+	if info.Capacity != 1000 {
+		t.Fatalf("Normal room got wrong capacity: %d", info.Capacity)
+	}
+}
+
+func TestBadRoomClass(t *testing.T) {
+	config := reasonableConfig("badroomclass")
+	config.RoomClass = []RoomClass{{Regex: "(unclosed"}}
+	_, err := NewWebStreamSystem(config, NewTestBacker())
+	if err == nil {
+		t.Fatalf("Expected error for bad room class regex")
+	}
+}
@@ -0,0 +1,164 @@
+package webstream
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	SocketWriteWait = 10 * time.Second // How long to wait on a control frame write before giving up
+)
+
+// Origins are already wide open through cors, so the socket is too
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Close the socket with the given code and reason. Safe to call from any goroutine
+func closeSocket(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(SocketWriteWait))
+	conn.Close()
+}
+
+// Send the data as a text frame if it's valid utf8, otherwise binary
+func writeSocketData(conn *websocket.Conn, data []byte) error {
+	messageType := websocket.TextMessage
+	if !utf8.Valid(data) {
+		messageType = websocket.BinaryMessage
+	}
+	return conn.WriteMessage(messageType, data)
+}
+
+// Upgrade to a websocket which both reads and writes the room. Every inbound
+// frame is appended to the room, and everything new in the room (starting at
+// 'start') is sent back out, including data written by this same socket.
+// Outbound data goes out as text frames when it's valid utf8, otherwise binary.
+// Sockets opened with a readonly key (or without the write token for a claimed
+// room) are closed if they try to write. If a rolling room drops data before
+// the socket gets to it, the socket silently skips ahead. In framed rooms, every
+// message goes out as its own frame (without the length prefix), and sockets can
+// start at 'message' rather than 'start'
+func (wc *WebstreamContext) StreamSocket(w http.ResponseWriter, r *http.Request) {
+	room, query, err := wc.parseStreamRequest(w, r)
+	if err != nil {
+		return
+	}
+	readonly := query.Readonlykey
+	token := getWriteToken(r, query)
+	// Like events, catch the simple problems before the upgrade so they're normal errors.
+	// This registers the socket as exactly one listener for its entire lifetime
+	removeListener, err := wc.webstreams.AddListener(room)
+	if err != nil {
+		log.Printf("Error adding socket listener: %s", err)
+		http.Error(w, fmt.Sprintf("Error while opening room: %s", err), http.StatusBadRequest)
+		return
+	}
+	defer removeListener()
+	info, err := wc.webstreams.RoomInfo(room)
+	if err != nil {
+		log.Printf("Error during Roominfo: %s", err)
+		http.Error(w, fmt.Sprintf("Error while opening room: %s", err), http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader already responded to the client
+		log.Printf("Websocket upgrade failed for room %s: %s", room, err)
+		return
+	}
+	defer conn.Close()
+	limits := wc.webstreams.RoomLimits(room)
+	conn.SetReadLimit(int64(limits.SingleDataLimit))
+
+	cancel, cancelfunc := context.WithCancel(context.Background())
+	defer cancelfunc()
+
+	// All data frames are written from this one goroutine (websocket requires one writer)
+	go func() {
+		defer cancelfunc()
+		start := query.Start
+		message := query.Message
+		for {
+			timeout, timeoutfunc := context.WithTimeout(cancel, limits.ReadTimeout)
+			var data []byte
+			var framed *FramedRead
+			if info.Framed {
+				framed, err = wc.webstreams.readMessages(room, start, message, -1, timeout, false)
+				if err == nil {
+					data = framed.Raw
+					start = framed.Start
+				}
+				// Only the first read goes by message, after that we know the offset
+				message = -1
+			} else {
+				data, err = wc.webstreams.readData(room, start, -1, timeout, false)
+			}
+			timeoutfunc()
+			if cancel.Err() != nil {
+				return
+			}
+			if truncerr, ok := err.(*TruncatedError); ok {
+				// Sockets have no way to signal this besides the data, so just skip ahead
+				log.Printf("Socket for room %s skipped truncated data %d-%d", room, start, truncerr.Start)
+				start = truncerr.Start
+				continue
+			}
+			if err != nil {
+				log.Printf("Error during ReadData (socket): %s", err)
+				closeSocket(conn, websocket.CloseInternalServerErr, err.Error())
+				return
+			}
+			if len(data) == 0 {
+				// Nothing happened for a while, make sure the other end is still there
+				// (and keep proxies from timing us out)
+				err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(SocketWriteWait))
+			} else if framed != nil {
+				for _, m := range framed.Messages {
+					start += MessageHeaderSize + len(m)
+					err = writeSocketData(conn, m)
+					if err != nil {
+						break
+					}
+				}
+			} else {
+				start += len(data)
+				err = writeSocketData(conn, data)
+			}
+			if err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		// Frames over the room's SingleDataLimit fail here, which closes the socket
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if readonly {
+			log.Printf("Attempted to write to readonly socket: %s", room)
+			closeSocket(conn, websocket.ClosePolicyViolation, "Attempted to write to readonly room")
+			return
+		}
+		if home := wc.replicator.forwardTo(room); home != "" {
+			// Only the room's home replica writes to it
+			err = wc.replicator.forwardAppend(home, room, data, token)
+		} else {
+			err = wc.webstreams.AppendDataWithToken(room, data, token)
+		}
+		if err != nil {
+			log.Printf("Append error for room %s (socket): %s\n", room, err)
+			closeSocket(conn, websocket.ClosePolicyViolation, fmt.Sprintf("Couldn't append to room: %s", err))
+			return
+		}
+	}
+}
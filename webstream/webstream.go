@@ -2,29 +2,49 @@ package webstream
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/randomouscrap98/goldmonolith/utils"
+	"github.com/randomouscrap98/goldmonolith/webstream/api"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/schema"
 )
 
 const (
-	Version = "2.0.1"
+	Version          = "2.0.1"
+	WriteTokenHeader = api.WriteTokenHeader
+	EncodingText     = api.EncodingText
+	EncodingBase64   = api.EncodingBase64
+	EncodingBinary   = api.EncodingBinary
 )
 
 // Query the user sends in to get parts of a stream or whatever
 type StreamQuery struct {
-	Start       int  `schema:"start"`
-	Count       int  `schema:"count"`
-	Nonblocking bool `schema:"nonblocking"`
-	Readonlykey bool `schema:"readonlykey"`
+	Start       int    `schema:"start"`
+	Count       int    `schema:"count"`
+	Nonblocking bool   `schema:"nonblocking"`
+	Readonlykey bool   `schema:"readonlykey"`
+	Writetoken  string `schema:"writetoken"` // Only for sockets, since browsers can't set headers on them
+	Encoding    string `schema:"encoding"`   // How to send the data back: see Encoding constants
+	Message     int    `schema:"message"`    // Framed rooms only: start at this message instead of 'start'
+}
+
+// Query the user sends in along with a write
+type WriteQuery struct {
+	Claim    bool   `schema:"claim"`    // Claim the room, only writes with the returned token are allowed after
+	Encoding string `schema:"encoding"` // Set to base64 to have the body decoded before it's written
+	Framed   bool   `schema:"framed"`   // Make the (empty) room framed: every write after is one message
 }
 
 func GetDefaultStreamQuery() *StreamQuery {
@@ -33,27 +53,52 @@ func GetDefaultStreamQuery() *StreamQuery {
 		Count:       -1,
 		Nonblocking: false,
 		Readonlykey: false,
+		Message:     -1,
 	}
 }
 
 // Result of a stream completion (often times the user only uses
-// the data portion)
+// the data portion). The json part is shared with clients
 type StreamResult struct {
-	Data        string `json:"data"`
-	Readonlykey string `json:"readonlykey"`
-	Signalled   int    `json:"signalled"`
-	Used        int    `json:"used"`
-	Limit       int    `json:"limit"`
-	NextStart   int    `json:"nextstart"`
-	DataLength  int    `json:"datalength"`
+	api.StreamResult
+	start int // The rest is for the raw (binary) endpoint
+	raw   []byte
+}
+
+type FramedResult = api.FramedResult
+
+// Encode the data as a string for the given encoding (see Encoding constants)
+func encodeData(data []byte, encoding string) string {
+	if encoding == EncodingBase64 {
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return string(data)
 }
 
-// The constants you return from the /constants endpoint,
-// received from the config (don't want to give out the whole config)
-type StreamConstants struct {
-	MaxStreamSize  int    `json:"maxStreamSize"`
-	MaxSingleChunk int    `json:"maxSingleChunk"`
-	Version        string `json:"version"`
+type StreamConstants = api.StreamConstants
+
+// A single room in the admin room listing
+type RoomListing struct {
+	Name      string    `json:"name"`
+	Length    int       `json:"length"`
+	Base      int       `json:"base"`
+	Capacity  int       `json:"capacity"`
+	Active    bool      `json:"active"`
+	Listeners int       `json:"listeners"`
+	LastWrite time.Time `json:"lastWrite"`
+	Dirty     bool      `json:"dirty"`
+	Claimed   bool      `json:"claimed"`
+}
+
+// Everything the admin room listing returns
+type RoomListingResult struct {
+	Rooms           []RoomListing `json:"rooms"`
+	ActiveRooms     int           `json:"activeRooms"`
+	ActiveRoomLimit int           `json:"activeRoomLimit"`
+	TotalRooms      int           `json:"totalRooms"`
+	TotalRoomLimit  int           `json:"totalRoomLimit"`
+	TotalData       int64         `json:"totalData"`
+	TotalDataLimit  int64         `json:"totalDataLimit"`
 }
 
 // All the data held onto for the duration of hosting the webstream
@@ -62,12 +107,13 @@ type WebstreamContext struct {
 	webstreams *WebStreamSystem
 	decoder    *schema.Decoder
 	obfuscator *utils.ObfuscatedKeys
+	replicator *replicator // nil without replication
 	config     *Config
 }
 
 // Produce a new webstream context for hosting webstream
 func NewWebstreamContext(config *Config) (*WebstreamContext, error) {
-	backer, err := NewFileBacker(config.StreamFolder)
+	backer, err := NewConfigBacker(config)
 	if err != nil {
 		return nil, err
 	}
@@ -75,10 +121,23 @@ func NewWebstreamContext(config *Config) (*WebstreamContext, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Readonly keys are persisted with the rooms so links don't break on restart
+	obfuscator := utils.GetDefaultObfuscation()
+	for room, key := range system.ReadonlyKeys() {
+		err = obfuscator.SetObfuscatedKey(room, key)
+		if err != nil {
+			log.Printf("WARN: Couldn't restore readonly key for room %s: %s\n", room, err)
+		}
+	}
+	replicator, err := newReplicator(config, system)
+	if err != nil {
+		return nil, err
+	}
 	return &WebstreamContext{
 		config:     config,
 		decoder:    schema.NewDecoder(),
-		obfuscator: utils.GetDefaultObfuscation(),
+		obfuscator: obfuscator,
+		replicator: replicator,
 		webstreams: system,
 	}, nil
 }
@@ -87,61 +146,399 @@ func (wc *WebstreamContext) GetIdentifier() string {
 	return "Webstream - " + Version
 }
 
-// Taken almost verbatim from the c# program
-func (wc *WebstreamContext) GetStreamResult(w http.ResponseWriter, r *http.Request) (*StreamResult, error) {
+// Parse the stream query out of the request and figure out the real room name
+// (readonly keys are resolved here). Errors are written to the response for you
+func (wc *WebstreamContext) parseStreamRequest(w http.ResponseWriter, r *http.Request) (string, *StreamQuery, error) {
 	room := chi.URLParam(r, "room")
 	query := GetDefaultStreamQuery()
 	err := wc.decoder.Decode(query, r.URL.Query())
 	if err != nil {
 		log.Printf("Bad request: %s", err)
 		http.Error(w, "Couldn't parse request", http.StatusBadRequest)
-		return nil, err
+		return "", nil, err
 	}
 	if query.Readonlykey {
 		room, err = wc.obfuscator.GetFromObfuscatedKey(room)
 		if err != nil {
 			log.Printf("Room not found: %s", err)
 			http.Error(w, "Readonly room not found", http.StatusNotFound)
-			return nil, err
+			return "", nil, err
 		}
 	}
+	if query.Encoding != EncodingText && query.Encoding != EncodingBase64 && query.Encoding != EncodingBinary {
+		err = fmt.Errorf("unknown encoding: %s", query.Encoding)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", nil, err
+	}
+	return room, query, nil
+}
 
-	rname := wc.obfuscator.GetObfuscatedKey(room)
+// Get the readonly key for the room, persisting it if it's brand new. The room
+// should already exist
+func (wc *WebstreamContext) getReadonlyKey(room string) string {
+	// With replicas, the room's home makes the keys so everyone hands out the same one
+	if home := wc.replicator.forwardTo(room); home != "" && wc.obfuscator.FindObfuscatedKey(room) == "" {
+		key, err := wc.replicator.fetchReadonlyKey(home, room)
+		if err == nil {
+			err = wc.obfuscator.SetObfuscatedKey(room, key)
+		}
+		if err == nil {
+			err = wc.webstreams.SetReadonlyKey(room, key)
+			if err != nil {
+				log.Printf("WARN: Couldn't persist readonly key for room %s: %s\n", room, err)
+			}
+			return key
+		}
+		log.Printf("WARN: Couldn't get readonly key for room %s from %s, making our own: %s\n", room, home, err)
+	}
+	key, created := wc.obfuscator.GetOrCreateObfuscatedKey(room)
+	if created {
+		err := wc.webstreams.SetReadonlyKey(room, key)
+		if err != nil {
+			// It still works, it just won't survive a restart
+			log.Printf("WARN: Couldn't persist readonly key for room %s: %s\n", room, err)
+		}
+	}
+	return key
+}
+
+// The token the writer is using, if any. Sockets may also send it in the query
+func getWriteToken(r *http.Request, query *StreamQuery) string {
+	token := r.Header.Get(WriteTokenHeader)
+	if token == "" && query != nil {
+		token = query.Writetoken
+	}
+	return token
+}
+
+// Whether a Range header is one we answer. Other units and multiple ranges are
+// ignored and get the normal full response, as RFC 9110 allows
+func isByteRange(header string) bool {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	return found && !strings.Contains(spec, ",")
+}
 
+// Parse a single range out of a Range header (bytes=a-b, bytes=a- or bytes=-n)
+// against data which ends at the given length. Suffix ranges don't go back past
+// base (rolling rooms). The returned end is exclusive. Multiple ranges aren't
+// supported. Errors mean the range can't be satisfied
+func parseByteRange(header string, base int, length int) (int, int, error) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("only single byte ranges are supported")
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found || (first == "" && last == "") {
+		return 0, 0, fmt.Errorf("bad range: %s", spec)
+	}
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.Atoi(last)
+		if err != nil || n <= 0 || length == base {
+			return 0, 0, fmt.Errorf("bad suffix range: %s", spec)
+		}
+		return max(base, length-n), length, nil
+	}
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 0 || start >= length {
+		return 0, 0, fmt.Errorf("range start not satisfiable: %s", spec)
+	}
+	end := length
+	if last != "" {
+		lastbyte, err := strconv.Atoi(last)
+		if err != nil || lastbyte < start {
+			return 0, 0, fmt.Errorf("bad range end: %s", spec)
+		}
+		end = min(lastbyte+1, length)
+	}
+	return start, end, nil
+}
+
+// Answer a standard Range request with 206 Partial Content. Offsets are the same
+// absolute offsets as 'start'. Range requests never block, and the other query
+// parameters (besides readonlykey) are ignored
+func (wc *WebstreamContext) GetStreamRange(w http.ResponseWriter, r *http.Request) {
+	room, _, err := wc.parseStreamRequest(w, r)
+	if err != nil {
+		return
+	}
+	info, err := wc.webstreams.RoomInfo(room)
+	if err != nil {
+		log.Printf("Error during Roominfo: %s", err)
+		http.Error(w, fmt.Sprintf("Error while reading data: %s", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	start, end, err := parseByteRange(r.Header.Get("Range"), info.Base, info.Length)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Length))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	data, err := wc.webstreams.ReadData(room, start, end-start, nil)
+	if truncerr, ok := err.(*TruncatedError); ok {
+		w.Header().Set(api.ResumeStartHeader, strconv.Itoa(truncerr.Start))
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Printf("Error during ReadData (range): %s", err)
+		http.Error(w, fmt.Sprintf("Error while reading data: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+len(data)-1, info.Length))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(data)
+}
+
+// Taken almost verbatim from the c# program
+func (wc *WebstreamContext) GetStreamResult(w http.ResponseWriter, r *http.Request) (*StreamResult, error) {
+	room, query, err := wc.parseStreamRequest(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	limits := wc.webstreams.RoomLimits(room)
 	var cancel context.Context = nil
 	var cancelfunc context.CancelFunc = func() {}
 	if !query.Nonblocking {
-		cancel, cancelfunc = context.WithTimeout(r.Context(), time.Duration(wc.config.ReadTimeout))
+		cancel, cancelfunc = context.WithTimeout(r.Context(), limits.ReadTimeout)
 	}
 	defer cancelfunc()
 
-	rawdata, err := wc.webstreams.ReadData(room, query.Start, query.Count, cancel)
+	info, err := wc.webstreams.RoomInfo(room)
+	if err != nil {
+		log.Printf("Error during Roominfo: %s", err)
+		http.Error(w, fmt.Sprintf("Error while reading data: %s", err), http.StatusBadRequest)
+		return nil, err
+	}
+	start := query.Start
+	var rawdata []byte
+	var framed *FramedResult
+	if info.Framed {
+		var fr *FramedRead
+		fr, err = wc.webstreams.ReadMessages(room, query.Start, query.Message, query.Count, cancel)
+		if err == nil {
+			start = fr.Start
+			rawdata = fr.Raw
+			framed = &FramedResult{
+				Messages:     make([]string, len(fr.Messages)),
+				FirstMessage: fr.FirstMessage,
+				NextMessage:  fr.NextMessage(),
+			}
+			for i, m := range fr.Messages {
+				framed.Messages[i] = encodeData(m, query.Encoding)
+			}
+		}
+	} else {
+		rawdata, err = wc.webstreams.ReadData(room, query.Start, query.Count, cancel)
+	}
+	if truncerr, ok := err.(*TruncatedError); ok {
+		// Not really an error, a rolling room dropped the data they wanted. Tell them where to go
+		w.Header().Set(api.ResumeStartHeader, strconv.Itoa(truncerr.Start))
+		if info.Framed {
+			w.Header().Set(api.ResumeMessageHeader, strconv.Itoa(truncerr.Message))
+		}
+		http.Error(w, err.Error(), http.StatusGone)
+		return nil, err
+	}
+	if _, ok := err.(*FramingError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
 	if err != nil {
 		log.Printf("Error during ReadData: %s", err)
 		http.Error(w, fmt.Sprintf("Error while reading data: %s", err), http.StatusInternalServerError)
 		return nil, err
 	}
-	info, err := wc.webstreams.RoomInfo(room)
+	info, err = wc.webstreams.RoomInfo(room)
 	if err != nil {
 		log.Printf("Error during Roominfo: %s", err)
 		http.Error(w, fmt.Sprintf("Error while reading data: %s", err), http.StatusInternalServerError)
 		return nil, err
 	}
+	rname := wc.getReadonlyKey(room)
+	data := ""
+	if framed == nil {
+		data = encodeData(rawdata, query.Encoding) // This is expensive I think??
+	}
 
 	// Note: that "Signalled" count is very inaccurate, but it was inaccurate on the old
 	// c# system so I think it's fine
 	return &StreamResult{
-		Limit:       wc.config.StreamDataLimit,
-		Readonlykey: rname,
-		Data:        string(rawdata), // This is expensive I think??
-		Signalled:   max(info.ListenerCount, info.LastWriteListenerCount),
-		Used:        info.Length,
-		NextStart:   query.Start + len(rawdata),
-		DataLength:  len(rawdata),
+		StreamResult: api.StreamResult{
+			Limit:       limits.StreamDataLimit,
+			Readonlykey: rname,
+			Data:        data,
+			Signalled:   max(info.ListenerCount, info.LastWriteListenerCount),
+			Used:        info.Length,
+			NextStart:   start + len(rawdata),
+			DataLength:  len(rawdata),
+			Encoding:    query.Encoding,
+			Framed:      framed,
+		},
+		start: start,
+		raw:   rawdata,
 	}, nil
 }
 
+// Check the request for the admin key (as a bearer token), writing an error to
+// the response if it's missing. Admin endpoints are disabled if there's no AdminKey
+func (wc *WebstreamContext) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !wc.isAdmin(r) {
+		http.Error(w, "Admin key required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Same as requireAdmin, but doesn't write anything
+func (wc *WebstreamContext) isAdmin(r *http.Request) bool {
+	key, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return wc.config.AdminKey != "" && found && subtle.ConstantTimeCompare([]byte(key), []byte(wc.config.AdminKey)) == 1
+}
+
+// Throw away the room's readonly key and make a new one, so leaked readonly
+// links stop working. Only admins or the holder of the room's write token
+// (for claimed rooms) can do this. Responds with the new key
+func (wc *WebstreamContext) RotateReadonlyKey(w http.ResponseWriter, r *http.Request) {
+	room := chi.URLParam(r, "room")
+	if home := wc.replicator.forwardTo(room); home != "" && !wc.replicator.isPeer(r) {
+		wc.replicator.forwardRequest(w, r, home, room, "/readonlykey")
+		return
+	}
+	if !wc.isAdmin(r) {
+		allowed, err := wc.webstreams.CheckWriteToken(room, getWriteToken(r, nil))
+		if _, ok := err.(*utils.NotFoundError); ok {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		if err != nil || !allowed {
+			http.Error(w, "Admin key or write token required", http.StatusUnauthorized)
+			return
+		}
+	}
+	key := wc.obfuscator.RegenerateObfuscatedKey(room)
+	err := wc.webstreams.SetReadonlyKey(room, key)
+	if err != nil {
+		// Don't leave a key around for a room that doesn't exist
+		wc.obfuscator.RemoveObfuscatedKey(room)
+		respondRoomAdmin(w, room, "rotate readonly key for", err)
+		return
+	}
+	log.Printf("Rotated readonly key for room %s\n", room)
+	utils.RespondPlaintext([]byte(key), w)
+}
+
+// Respond to the result of some admin operation on a room
+func respondRoomAdmin(w http.ResponseWriter, room string, action string, err error) {
+	if err != nil {
+		log.Printf("Error during %s for room %s: %s\n", action, room, err)
+		if _, ok := err.(*utils.NotFoundError); ok {
+			http.Error(w, "Room not found", http.StatusNotFound)
+		} else {
+			http.Error(w, fmt.Sprintf("Couldn't %s room: %s", action, err), http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Printf("Admin performed %s on room %s\n", action, room)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// List every room the system knows about, along with system totals. Admin only
+func (wc *WebstreamContext) ListRooms(w http.ResponseWriter, r *http.Request) {
+	if !wc.requireAdmin(w, r) {
+		return
+	}
+	infos := wc.webstreams.AllRoomInfo()
+	result := RoomListingResult{
+		Rooms:           make([]RoomListing, 0, len(infos)),
+		ActiveRooms:     wc.webstreams.ActiveCount(),
+		ActiveRoomLimit: wc.config.ActiveRoomLimit,
+		TotalRooms:      len(infos),
+		TotalRoomLimit:  wc.config.TotalRoomLimit,
+		TotalData:       wc.webstreams.TotalData(),
+		TotalDataLimit:  wc.config.TotalDataLimit,
+	}
+	for name, info := range infos {
+		result.Rooms = append(result.Rooms, RoomListing{
+			Name:      name,
+			Length:    info.Length,
+			Base:      info.Base,
+			Capacity:  info.Capacity,
+			Active:    info.Capacity > 0,
+			Listeners: info.ListenerCount,
+			LastWrite: info.LastWrite,
+			Dirty:     info.Dirty,
+			Claimed:   info.Claimed,
+		})
+	}
+	sort.Slice(result.Rooms, func(i, j int) bool {
+		return result.Rooms[i].Name < result.Rooms[j].Name
+	})
+	utils.RespondJson(result, w, nil)
+}
+
+// Download a tar archive of the given rooms (room=a&room=b...), or every room if
+// none are given. Admin only
+func (wc *WebstreamContext) ExportRooms(w http.ResponseWriter, r *http.Request) {
+	if !wc.requireAdmin(w, r) {
+		return
+	}
+	rooms := r.URL.Query()["room"]
+	// Make sure the rooms are there before we commit to a response
+	for _, room := range rooms {
+		if !wc.webstreams.RoomExists(room) {
+			http.Error(w, fmt.Sprintf("Can't export room %s: not found", room), http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"webstream_%s.tar\"", time.Now().Format("20060102150405")))
+	err := wc.webstreams.ExportRooms(w, rooms)
+	if err != nil {
+		// Too late for a status code, the archive will just be broken
+		log.Printf("Error exporting rooms: %s\n", err)
+	}
+}
+
+// Readonly keys come along with imported rooms, so the mapping needs to match
+func (wc *WebstreamContext) restoreReadonlyKeys(imported []string) {
+	keys := wc.webstreams.ReadonlyKeys()
+	for _, room := range imported {
+		if key, ok := keys[room]; ok {
+			err := wc.obfuscator.SetObfuscatedKey(room, key)
+			if err != nil {
+				log.Printf("WARN: Couldn't restore readonly key for room %s: %s\n", room, err)
+			}
+		} else {
+			wc.obfuscator.RemoveObfuscatedKey(room)
+		}
+	}
+}
+
+// Restore rooms from a tar archive made by ExportRooms. Admin only
+func (wc *WebstreamContext) ImportRooms(w http.ResponseWriter, r *http.Request) {
+	if !wc.requireAdmin(w, r) {
+		return
+	}
+	imported, err := wc.webstreams.ImportRooms(r.Body)
+	wc.restoreReadonlyKeys(imported)
+	if err != nil {
+		log.Printf("Error importing rooms: %s\n", err)
+		http.Error(w, fmt.Sprintf("Error importing rooms (%d imported): %s", len(imported), err), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Admin imported %d rooms\n", len(imported))
+	utils.RespondJson(imported, w, nil)
+}
+
 func (wc *WebstreamContext) RunBackground(cancel context.Context, wg *sync.WaitGroup) {
+	if wc.replicator != nil {
+		wc.replicator.run(cancel, wg)
+	}
 	go func() {
 		defer wg.Done()
 		ticker := time.NewTicker(time.Duration(wc.config.IdleRoomTime))
@@ -155,6 +552,11 @@ func (wc *WebstreamContext) RunBackground(cancel context.Context, wg *sync.WaitG
 				return
 			case <-ticker.C:
 				wc.webstreams.DumpStreams(false)
+				if wc.config.ExpireRoomTime > 0 {
+					for _, room := range wc.webstreams.ExpireStreams(time.Duration(wc.config.ExpireRoomTime)) {
+						wc.obfuscator.RemoveObfuscatedKey(room)
+					}
+				}
 			}
 		}
 	}()
@@ -164,16 +566,66 @@ func (webctx *WebstreamContext) GetHandler() (http.Handler, error) {
 	r := chi.NewRouter()
 
 	r.Get("/constants", func(w http.ResponseWriter, r *http.Request) {
+		// Rooms can have their own limits; ?room= gets the ones for that room
+		room := r.URL.Query().Get("room")
+		if realroom, err := webctx.obfuscator.GetFromObfuscatedKey(room); err == nil {
+			room = realroom
+		}
+		limits := webctx.webstreams.RoomLimits(room)
 		utils.RespondJson(StreamConstants{
-			MaxStreamSize:  webctx.config.StreamDataLimit,
-			MaxSingleChunk: webctx.config.SingleDataLimit,
+			MaxStreamSize:  limits.StreamDataLimit,
+			MaxSingleChunk: limits.SingleDataLimit,
+			Rolling:        webctx.config.Rolling,
+			MaxTotalData:   webctx.config.TotalDataLimit,
+			TotalData:      webctx.webstreams.TotalData(),
 			Version:        Version,
 		}, w, nil)
 	})
 
+	r.Get("/admin/rooms", webctx.ListRooms)
+	r.Get("/admin/export", webctx.ExportRooms)
+	r.Post("/admin/import", webctx.ImportRooms)
+	r.Post("/peer/append/{room}", webctx.PeerAppend)
+	r.Post("/peer/delete/{room}", webctx.PeerDelete)
+	r.Post("/peer/replace/{room}", webctx.PeerReplace)
+	r.Get("/peer/readonlykey/{room}", webctx.PeerReadonlyKey)
+
+	// Room names show up in the metrics, so they're admin only like the room listing
+	// unless the config says otherwise. "metrics" is a reserved room name
+	r.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if !webctx.config.PublicMetrics && !webctx.requireAdmin(w, r) {
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		webctx.webstreams.WriteMetrics(w)
+	})
+
 	r.Get("/{room}", func(w http.ResponseWriter, r *http.Request) {
+		if isByteRange(r.Header.Get("Range")) {
+			webctx.GetStreamRange(w, r)
+			return
+		}
 		result, err := webctx.GetStreamResult(w, r)
-		if err == nil {
+		if err != nil {
+			return
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		if result.Encoding == EncodingBinary || result.Framed != nil {
+			// Raw bytes have nowhere to put the offsets, so they go in headers
+			// (same format as Content-Range). Framed rooms always come out raw,
+			// length prefixes and all
+			streamRange := fmt.Sprintf("bytes */%d", result.Used)
+			if result.DataLength > 0 {
+				streamRange = fmt.Sprintf("bytes %d-%d/%d", result.start, result.NextStart-1, result.Used)
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("X-Stream-Range", streamRange)
+			w.Header().Set("X-Next-Start", strconv.Itoa(result.NextStart))
+			if result.Framed != nil {
+				w.Header().Set("X-Next-Message", strconv.Itoa(result.Framed.NextMessage))
+			}
+			w.Write(result.raw)
+		} else {
 			utils.RespondPlaintext([]byte(result.Data), w)
 		}
 	})
@@ -185,9 +637,12 @@ func (webctx *WebstreamContext) GetHandler() (http.Handler, error) {
 		}
 	})
 
+	r.Get("/{room}/events", webctx.StreamEvents)
+	r.Get("/{room}/ws", webctx.StreamSocket)
+
 	r.Post("/{room}", func(w http.ResponseWriter, r *http.Request) {
-		r.Body = http.MaxBytesReader(w, r.Body, int64(webctx.config.SingleDataLimit))
 		room := chi.URLParam(r, "room")
+		r.Body = http.MaxBytesReader(w, r.Body, int64(webctx.webstreams.RoomLimits(room).SingleDataLimit))
 		// Don't allow posts to readonly rooms
 		_, err := webctx.obfuscator.GetFromObfuscatedKey(room)
 		if err == nil {
@@ -195,6 +650,18 @@ func (webctx *WebstreamContext) GetHandler() (http.Handler, error) {
 			http.Error(w, "Attempted to post to readonly room", http.StatusBadRequest)
 			return
 		}
+		// Only the room's home replica writes to it
+		if home := webctx.replicator.forwardTo(room); home != "" && !webctx.replicator.isPeer(r) {
+			webctx.replicator.forwardRequest(w, r, home, room, "")
+			return
+		}
+		query := WriteQuery{}
+		err = webctx.decoder.Decode(&query, r.URL.Query())
+		if err != nil {
+			log.Printf("Bad request: %s", err)
+			http.Error(w, "Couldn't parse request", http.StatusBadRequest)
+			return
+		}
 		// We're safe to just "read all" since we've limited the body above
 		data, err := io.ReadAll(r.Body)
 		if err != nil {
@@ -202,14 +669,94 @@ func (webctx *WebstreamContext) GetHandler() (http.Handler, error) {
 			http.Error(w, "Can't read post body (maybe it's too long?)", http.StatusBadRequest)
 			return
 		}
-		err = webctx.webstreams.AppendData(room, data)
+		if query.Encoding == EncodingBase64 {
+			data, err = base64.StdEncoding.DecodeString(string(data))
+			if err != nil {
+				http.Error(w, "Couldn't decode base64 body", http.StatusBadRequest)
+				return
+			}
+		} else if query.Encoding != EncodingText {
+			http.Error(w, fmt.Sprintf("unknown encoding: %s", query.Encoding), http.StatusBadRequest)
+			return
+		}
+		if query.Framed {
+			err = webctx.webstreams.MakeFramed(room)
+			if err != nil {
+				log.Printf("Framing error for room %s: %s\n", room, err)
+				http.Error(w, fmt.Sprintf("Couldn't make room framed: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		token := getWriteToken(r, nil)
+		if query.Claim {
+			token, err = webctx.webstreams.ClaimRoom(room)
+			if err != nil {
+				log.Printf("Claim error for room %s: %s\n", room, err)
+				status := http.StatusBadRequest
+				if _, ok := err.(*RoomClaimedError); ok {
+					status = http.StatusConflict
+				}
+				http.Error(w, fmt.Sprintf("Couldn't claim room: %s", err), status)
+				return
+			}
+		}
+		err = webctx.webstreams.AppendDataWithToken(room, data, token)
 		if err != nil {
 			log.Printf("Append error for room %s: %s\n", room, err)
+			if query.Claim {
+				// Nobody would ever get the token, so let someone else have the room
+				uerr := webctx.webstreams.releaseClaim(room, token)
+				if uerr != nil {
+					log.Printf("WARN: Couldn't release claim on room %s: %s\n", room, uerr)
+				}
+			}
+			status := http.StatusBadRequest
+			if _, ok := err.(*WriteTokenError); ok {
+				status = http.StatusForbidden
+			} else if _, ok := err.(*ActiveRoomLimitError); ok {
+				// Rooms go idle all the time, so this one is worth trying again later
+				status = http.StatusServiceUnavailable
+			}
 			// This COULD be because the room is full, we should show the error
 			// (even if it might expose some sensitive info... whatever)
-			http.Error(w, fmt.Sprintf("Couldn't append to room: %s", err), http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("Couldn't append to room: %s", err), status)
+			return
+		}
+		if query.Claim {
+			w.Header().Set(WriteTokenHeader, token)
+			utils.RespondPlaintext([]byte(token), w)
+		}
+	})
+
+	r.Delete("/{room}", func(w http.ResponseWriter, r *http.Request) {
+		if !webctx.requireAdmin(w, r) {
+			return
+		}
+		room := chi.URLParam(r, "room")
+		// Deletes go through the home like writes, so they're ordered with them everywhere
+		if home := webctx.replicator.forwardTo(room); home != "" && !webctx.replicator.isPeer(r) {
+			webctx.replicator.forwardRequest(w, r, home, room, "")
+			return
+		}
+		err := webctx.webstreams.DeleteRoom(room)
+		if err == nil {
+			webctx.obfuscator.RemoveObfuscatedKey(room)
+		}
+		respondRoomAdmin(w, room, "delete", err)
+	})
+
+	r.Post("/{room}/readonlykey", webctx.RotateReadonlyKey)
+
+	r.Post("/{room}/reset", func(w http.ResponseWriter, r *http.Request) {
+		if !webctx.requireAdmin(w, r) {
+			return
+		}
+		room := chi.URLParam(r, "room")
+		if home := webctx.replicator.forwardTo(room); home != "" && !webctx.replicator.isPeer(r) {
+			webctx.replicator.forwardRequest(w, r, home, room, "/reset")
 			return
 		}
+		respondRoomAdmin(w, room, "reset", webctx.webstreams.ResetRoom(room))
 	})
 
 	return r, nil
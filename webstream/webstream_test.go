@@ -0,0 +1,1120 @@
+package webstream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/randomouscrap98/goldmonolith/utils"
+)
+
+func getTestServer(t *testing.T, config *Config) (*WebstreamContext, *httptest.Server) {
+	webctx, err := NewWebstreamContext(config)
+	if err != nil {
+		t.Fatalf("Error creating webstream context: %s", err)
+	}
+	handler, err := webctx.GetHandler()
+	if err != nil {
+		t.Fatalf("Error creating webstream handler: %s", err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return webctx, server
+}
+
+// Read all the events out of an SSE response until the stream ends. Each event is
+// returned as the raw lines it contained
+func readEvents(t *testing.T, response *http.Response) [][]string {
+	events := make([][]string, 0)
+	current := make([]string, 0)
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			events = append(events, current)
+			current = make([]string, 0)
+		} else {
+			current = append(current, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Error reading events: %s", err)
+	}
+	return events
+}
+
+func TestStreamEvents(t *testing.T) {
+	config := reasonableConfig("streamevents")
+	config.ReadTimeout = utils.Duration(50 * time.Millisecond)
+	webctx, server := getTestServer(t, config)
+	err := webctx.webstreams.AppendData("events", []byte("first\nline"))
+	if err != nil {
+		t.Fatalf("Error appending data: %s", err)
+	}
+	// Write a little later so the stream has to wait for it
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		webctx.webstreams.AppendData("events", []byte("second"))
+	}()
+	response, err := http.Get(server.URL + "/events/events")
+	if err != nil {
+		t.Fatalf("Error requesting events: %s", err)
+	}
+	defer response.Body.Close()
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream") {
+		t.Fatalf("Wrong content type: %s", response.Header.Get("Content-Type"))
+	}
+	events := readEvents(t, response)
+	expected := [][]string{
+		{"id: 10", "data: first", "data: line"},
+		{"id: 16", "data: second"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d: %v", len(expected), len(events), events)
+	}
+	for i := range expected {
+		if strings.Join(events[i], "|") != strings.Join(expected[i], "|") {
+			t.Fatalf("Event %d wrong: expected %v, got %v", i, expected[i], events[i])
+		}
+	}
+	// Now resume from the first event; we should only get the second
+	request, err := http.NewRequest("GET", server.URL+"/events/events", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %s", err)
+	}
+	request.Header.Set("Last-Event-ID", "10")
+	response2, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Error requesting resumed events: %s", err)
+	}
+	defer response2.Body.Close()
+	events = readEvents(t, response2)
+	if len(events) != 1 || strings.Join(events[0], "|") != "id: 16|data: second" {
+		t.Fatalf("Resumed events wrong: %v", events)
+	}
+}
+
+func dialTestSocket(t *testing.T, server *httptest.Server, path string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + path
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Error dialing socket %s: %s", url, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestStreamSocket(t *testing.T) {
+	config := reasonableConfig("streamsocket")
+	config.ReadTimeout = utils.Duration(time.Second)
+	webctx, server := getTestServer(t, config)
+	conn := dialTestSocket(t, server, "/sockets/ws")
+	time.Sleep(10 * time.Millisecond) // The socket handler registers as a listener in the background
+	info, err := webctx.webstreams.RoomInfo("sockets")
+	if err != nil {
+		t.Fatalf("Error getting room info: %s", err)
+	}
+	if info.ListenerCount != 1 {
+		t.Fatalf("Expected socket to be exactly 1 listener, got %d", info.ListenerCount)
+	}
+	err = conn.WriteMessage(websocket.TextMessage, []byte("hello"))
+	if err != nil {
+		t.Fatalf("Error writing to socket: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Error reading from socket: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("Expected to read back hello, got %s", string(data))
+	}
+	// Go get the readonly key and make sure we can read but not write with it
+	result, err := webctx.webstreams.ReadData("sockets", 0, -1, nil)
+	if err != nil || string(result) != "hello" {
+		t.Fatalf("Data wasn't appended to the room: %s (%s)", string(result), err)
+	}
+	rokey := webctx.obfuscator.GetObfuscatedKey("sockets")
+	roconn := dialTestSocket(t, server, "/"+rokey+"/ws?readonlykey=true")
+	roconn.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err = roconn.ReadMessage()
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("Readonly socket didn't get data: %s (%s)", string(data), err)
+	}
+	err = roconn.WriteMessage(websocket.TextMessage, []byte("nope"))
+	if err != nil {
+		t.Fatalf("Error writing to readonly socket: %s", err)
+	}
+	_, _, err = roconn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("Expected readonly socket to be closed on write, got %s", err)
+	}
+	// Frames over the limit kill the socket
+	err = conn.WriteMessage(websocket.TextMessage, make([]byte, config.SingleDataLimit+1))
+	if err != nil {
+		t.Fatalf("Error writing big frame to socket: %s", err)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("Expected socket to be closed on big frame, got %s", err)
+	}
+	info, err = webctx.webstreams.RoomInfo("sockets")
+	if err != nil {
+		t.Fatalf("Error getting room info: %s", err)
+	}
+	if info.Length != 5 {
+		t.Fatalf("Expected only the first write to go through, length is %d", info.Length)
+	}
+}
+
+func TestFramedStreams(t *testing.T) {
+	config := reasonableConfig("framedstreams")
+	config.ReadTimeout = utils.Duration(50 * time.Millisecond)
+	webctx, server := getTestServer(t, config)
+	err := webctx.webstreams.MakeFramed("framed")
+	if err != nil {
+		t.Fatalf("Error making room framed: %s", err)
+	}
+	// A message of length 10 has a newline in its length prefix, which mustn't leak out
+	for _, message := range []string{"0123456789", "a\nb"} {
+		err = webctx.webstreams.AppendData("framed", []byte(message))
+		if err != nil {
+			t.Fatalf("Error appending message: %s", err)
+		}
+	}
+	for _, test := range []struct {
+		query    string
+		expected [][]string
+	}{
+		{"", [][]string{{"id: 14", "data: 0123456789"}, {"id: 21", "data: a", "data: b"}}},
+		{"?message=1", [][]string{{"id: 21", "data: a", "data: b"}}},
+		{"?start=14", [][]string{{"id: 21", "data: a", "data: b"}}},
+	} {
+		response, err := http.Get(server.URL + "/framed/events" + test.query)
+		if err != nil {
+			t.Fatalf("Error requesting events: %s", err)
+		}
+		events := readEvents(t, response)
+		response.Body.Close()
+		if len(events) != len(test.expected) {
+			t.Fatalf("Expected %d events for '%s', got %d: %v", len(test.expected), test.query, len(events), events)
+		}
+		for i := range test.expected {
+			if strings.Join(events[i], "|") != strings.Join(test.expected[i], "|") {
+				t.Fatalf("Event %d for '%s' wrong: expected %v, got %v", i, test.query, test.expected[i], events[i])
+			}
+		}
+	}
+	conn := dialTestSocket(t, server, "/framed/ws")
+	err = conn.WriteMessage(websocket.TextMessage, []byte("hi"))
+	if err != nil {
+		t.Fatalf("Error writing to socket: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expected := range []string{"0123456789", "a\nb", "hi"} {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Error reading from socket: %s", err)
+		}
+		if string(data) != expected {
+			t.Fatalf("Expected frame %q, got %q", expected, data)
+		}
+	}
+	read, err := webctx.webstreams.ReadMessages("framed", 0, 0, -1, nil)
+	if err != nil || len(read.Messages) != 3 || string(read.Messages[2]) != "hi" {
+		t.Fatalf("Socket write wasn't stored as one message: %v (%s)", read, err)
+	}
+}
+
+func TestDeleteRoomHttp(t *testing.T) {
+	config := reasonableConfig("deleteroomhttp")
+	config.AdminKey = "secret"
+	webctx, server := getTestServer(t, config)
+	err := webctx.webstreams.AppendData("deleteme", []byte("data"))
+	if err != nil {
+		t.Fatalf("Error appending data: %s", err)
+	}
+	doDelete := func(room string, key string) int {
+		request, err := http.NewRequest("DELETE", server.URL+"/"+room, nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %s", err)
+		}
+		if key != "" {
+			request.Header.Set("Authorization", "Bearer "+key)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error deleting room: %s", err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	if code := doDelete("deleteme", ""); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without key, got %d", code)
+	}
+	if code := doDelete("deleteme", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with wrong key, got %d", code)
+	}
+	if webctx.webstreams.RoomCount() != 1 {
+		t.Fatalf("Room deleted without admin key")
+	}
+	if code := doDelete("deleteme", "secret"); code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on delete, got %d", code)
+	}
+	if webctx.webstreams.RoomCount() != 0 {
+		t.Fatalf("Room not deleted")
+	}
+	if code := doDelete("deleteme", "secret"); code != http.StatusNotFound {
+		t.Fatalf("Expected 404 on missing room, got %d", code)
+	}
+}
+
+func TestClaimRoomHttp(t *testing.T) {
+	_, server := getTestServer(t, reasonableConfig("claimroomhttp"))
+	post := func(query string, token string, data string) *http.Response {
+		request, err := http.NewRequest("POST", server.URL+"/claimed"+query, strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error creating request: %s", err)
+		}
+		if token != "" {
+			request.Header.Set(WriteTokenHeader, token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error posting: %s", err)
+		}
+		t.Cleanup(func() { response.Body.Close() })
+		return response
+	}
+	response := post("?claim=true", "", "first")
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 on claim, got %d", response.StatusCode)
+	}
+	token := response.Header.Get(WriteTokenHeader)
+	body, err := io.ReadAll(response.Body)
+	if err != nil || token == "" || string(body) != token {
+		t.Fatalf("Claim didn't return the token: %s vs %s (%s)", token, string(body), err)
+	}
+	if code := post("?claim=true", token, "again").StatusCode; code != http.StatusConflict {
+		t.Fatalf("Expected 409 on second claim, got %d", code)
+	}
+	for _, query := range []string{"", "?claim=true"} {
+		response, err = http.Post(server.URL+"/unclaimed"+query, "text/plain", strings.NewReader("data"))
+		if err != nil {
+			t.Fatalf("Error posting: %s", err)
+		}
+		response.Body.Close()
+	}
+	if response.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected 409 claiming a room with data, got %d", response.StatusCode)
+	}
+	// A claim whose write fails doesn't hand out a token, so the room stays free
+	response, err = http.Post(server.URL+"/failedclaim?claim=true", "text/plain", strings.NewReader(strings.Repeat("x", 501)))
+	if err != nil {
+		t.Fatalf("Error posting: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest || response.Header.Get(WriteTokenHeader) != "" {
+		t.Fatalf("Expected 400 with no token on failed claim, got %d", response.StatusCode)
+	}
+	response, err = http.Post(server.URL+"/failedclaim?claim=true", "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatalf("Error posting: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get(WriteTokenHeader) == "" {
+		t.Fatalf("Expected room to be claimable after failed claim, got %d", response.StatusCode)
+	}
+	if code := post("", "", "nope").StatusCode; code != http.StatusForbidden {
+		t.Fatalf("Expected 403 without token, got %d", code)
+	}
+	if code := post("", token, "second").StatusCode; code != http.StatusOK {
+		t.Fatalf("Expected 200 with token, got %d", code)
+	}
+	response, err = http.Get(server.URL + "/claimed?nonblocking=true")
+	if err != nil {
+		t.Fatalf("Error reading room: %s", err)
+	}
+	defer response.Body.Close()
+	body, _ = io.ReadAll(response.Body)
+	if string(body) != "firstsecond" {
+		t.Fatalf("Unexpected room data: %s", string(body))
+	}
+}
+
+func TestReadonlyKeyPersistence(t *testing.T) {
+	config := reasonableConfig("readonlykeypersist")
+	config.AdminKey = "secret"
+	webctx, server := getTestServer(t, config)
+	err := webctx.webstreams.AppendData("persisted", []byte("data"))
+	if err != nil {
+		t.Fatalf("Error appending data: %s", err)
+	}
+	getJson := func(server *httptest.Server, path string) (int, *StreamResult) {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Error getting %s: %s", path, err)
+		}
+		defer response.Body.Close()
+		var result StreamResult
+		if response.StatusCode == http.StatusOK {
+			err = json.NewDecoder(response.Body).Decode(&result)
+			if err != nil {
+				t.Fatalf("Error decoding result: %s", err)
+			}
+		}
+		return response.StatusCode, &result
+	}
+	_, result := getJson(server, "/persisted/json?nonblocking=true")
+	rokey := result.Readonlykey
+	// A brand new context over the same folder is the same as a restart
+	_, server2 := getTestServer(t, config)
+	code, result := getJson(server2, "/"+rokey+"/json?nonblocking=true&readonlykey=true")
+	if code != http.StatusOK || result.Data != "data" {
+		t.Fatalf("Readonly key didn't survive restart: %d %s", code, result.Data)
+	}
+	rotate := func(key string) (int, string) {
+		request, err := http.NewRequest("POST", server2.URL+"/persisted/readonlykey", nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %s", err)
+		}
+		if key != "" {
+			request.Header.Set("Authorization", "Bearer "+key)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error rotating key: %s", err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+	if code, _ := rotate(""); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 rotating without auth, got %d", code)
+	}
+	code, newkey := rotate("secret")
+	if code != http.StatusOK || newkey == "" || newkey == rokey {
+		t.Fatalf("Bad rotate: %d %s", code, newkey)
+	}
+	if code, _ := getJson(server2, "/"+rokey+"/json?nonblocking=true&readonlykey=true"); code != http.StatusNotFound {
+		t.Fatalf("Old readonly key still works after rotate: %d", code)
+	}
+	webctx3, server3 := getTestServer(t, config)
+	code, result = getJson(server3, "/"+newkey+"/json?nonblocking=true&readonlykey=true")
+	if code != http.StatusOK || result.Data != "data" {
+		t.Fatalf("Rotated readonly key didn't survive restart: %d %s", code, result.Data)
+	}
+	// Just looking at a room doesn't save it, but its key is kept for when it's written
+	_, result = getJson(server3, "/looked/json?nonblocking=true")
+	lookedkey := result.Readonlykey
+	webctx4, _ := getTestServer(t, config)
+	if webctx4.webstreams.RoomExists("looked") {
+		t.Fatalf("Reading a room saved it to the backer")
+	}
+	err = webctx3.webstreams.AppendData("looked", []byte("written"))
+	if err != nil {
+		t.Fatalf("Error appending data: %s", err)
+	}
+	webctx3.webstreams.DumpStreams(true)
+	_, server5 := getTestServer(t, config)
+	code, result = getJson(server5, "/"+lookedkey+"/json?nonblocking=true&readonlykey=true")
+	if code != http.StatusOK || result.Data != "written" {
+		t.Fatalf("Readonly key from before the first write wasn't saved: %d %s", code, result.Data)
+	}
+}
+
+func TestListRooms(t *testing.T) {
+	config := reasonableConfig("listrooms")
+	config.AdminKey = "secret"
+	webctx, server := getTestServer(t, config)
+	for _, room := range []string{"second", "first", "admin"} {
+		err := webctx.webstreams.AppendData(room, []byte(room))
+		if err != nil {
+			t.Fatalf("Error appending to %s: %s", room, err)
+		}
+	}
+	webctx.webstreams.DumpStreams(true)
+	err := webctx.webstreams.AppendData("first", []byte("more"))
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	list := func(key string) (int, *RoomListingResult) {
+		request, err := http.NewRequest("GET", server.URL+"/admin/rooms", nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %s", err)
+		}
+		request.Header.Set("Authorization", "Bearer "+key)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error listing rooms: %s", err)
+		}
+		defer response.Body.Close()
+		var result RoomListingResult
+		if response.StatusCode == http.StatusOK {
+			err = json.NewDecoder(response.Body).Decode(&result)
+			if err != nil {
+				t.Fatalf("Error decoding listing: %s", err)
+			}
+		}
+		return response.StatusCode, &result
+	}
+	if code, _ := list("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 with wrong key, got %d", code)
+	}
+	code, result := list("secret")
+	if code != http.StatusOK {
+		t.Fatalf("Expected 200 listing rooms, got %d", code)
+	}
+	if result.TotalRooms != 3 || result.TotalRoomLimit != config.TotalRoomLimit ||
+		result.ActiveRooms != 1 || result.ActiveRoomLimit != config.ActiveRoomLimit {
+		t.Fatalf("Unexpected totals: %v", result)
+	}
+	if len(result.Rooms) != 3 || result.Rooms[0].Name != "admin" || result.Rooms[1].Name != "first" {
+		t.Fatalf("Unexpected rooms: %v", result.Rooms)
+	}
+	first := result.Rooms[1]
+	if !first.Active || !first.Dirty || first.Length != 9 || first.Capacity != config.StreamDataLimit || first.LastWrite.IsZero() {
+		t.Fatalf("Unexpected info for active room: %v", first)
+	}
+	if result.Rooms[2].Active || result.Rooms[2].Dirty || result.Rooms[2].Length != 6 {
+		t.Fatalf("Unexpected info for dumped room: %v", result.Rooms[2])
+	}
+	// A room named admin should still work like any other room
+	response, err := http.Get(server.URL + "/admin?nonblocking=true")
+	if err != nil {
+		t.Fatalf("Error reading admin room: %s", err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if string(body) != "admin" {
+		t.Fatalf("Couldn't read room named admin: %s", string(body))
+	}
+}
+
+func TestBinaryData(t *testing.T) {
+	webctx, server := getTestServer(t, reasonableConfig("binarydata"))
+	binary := []byte{0xff, 0x00, 0xfe, '\n', 0x80}
+	// Writes can come in as base64 too, for clients that can't send raw bytes
+	response, err := http.Post(server.URL+"/binary?encoding=base64", "text/plain",
+		strings.NewReader(base64.StdEncoding.EncodeToString([]byte("ab"))))
+	if err != nil {
+		t.Fatalf("Error posting base64: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 on base64 post, got %d", response.StatusCode)
+	}
+	err = webctx.webstreams.AppendData("binary", binary)
+	if err != nil {
+		t.Fatalf("Error appending data: %s", err)
+	}
+	expected := append([]byte("ab"), binary...)
+	// JSON with base64
+	response, err = http.Get(server.URL + "/binary/json?nonblocking=true&encoding=base64&start=1")
+	if err != nil {
+		t.Fatalf("Error reading json: %s", err)
+	}
+	var result StreamResult
+	err = json.NewDecoder(response.Body).Decode(&result)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("Error decoding json: %s", err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(result.Data)
+	if err != nil || !bytes.Equal(decoded, expected[1:]) || result.Encoding != EncodingBase64 || result.NextStart != 7 {
+		t.Fatalf("Bad base64 result: %v (%s) %v", decoded, err, result)
+	}
+	// Raw binary
+	response, err = http.Get(server.URL + "/binary?nonblocking=true&encoding=binary&start=2")
+	if err != nil {
+		t.Fatalf("Error reading binary: %s", err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if !bytes.Equal(body, binary) || response.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Fatalf("Bad binary result: %v (%s)", body, response.Header.Get("Content-Type"))
+	}
+	if response.Header.Get("X-Stream-Range") != "bytes 2-6/7" || response.Header.Get("X-Next-Start") != "7" {
+		t.Fatalf("Bad binary range headers: %s / %s", response.Header.Get("X-Stream-Range"), response.Header.Get("X-Next-Start"))
+	}
+	response, err = http.Get(server.URL + "/binary?nonblocking=true&encoding=nope")
+	if err != nil {
+		t.Fatalf("Error reading with bad encoding: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 on bad encoding, got %d", response.StatusCode)
+	}
+}
+
+func TestRangeRequest(t *testing.T) {
+	webctx, server := getTestServer(t, reasonableConfig("rangerequest"))
+	err := webctx.webstreams.AppendData("ranges", []byte("0123456789"))
+	if err != nil {
+		t.Fatalf("Error appending data: %s", err)
+	}
+	getRange := func(header string) (*http.Response, string) {
+		request, err := http.NewRequest("GET", server.URL+"/ranges", nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %s", err)
+		}
+		request.Header.Set("Range", header)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error requesting range %s: %s", header, err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response, string(body)
+	}
+	for _, test := range []struct {
+		header  string
+		data    string
+		content string
+	}{
+		{"bytes=2-4", "234", "bytes 2-4/10"},
+		{"bytes=7-", "789", "bytes 7-9/10"},
+		{"bytes=-2", "89", "bytes 8-9/10"},
+		{"bytes=5-100", "56789", "bytes 5-9/10"},
+		{"bytes=-100", "0123456789", "bytes 0-9/10"},
+	} {
+		response, data := getRange(test.header)
+		if response.StatusCode != http.StatusPartialContent {
+			t.Fatalf("Expected 206 for %s, got %d", test.header, response.StatusCode)
+		}
+		if data != test.data || response.Header.Get("Content-Range") != test.content {
+			t.Fatalf("Bad range %s: %s (%s)", test.header, data, response.Header.Get("Content-Range"))
+		}
+	}
+	// Past the end never blocks, it's just not satisfiable
+	for _, header := range []string{"bytes=10-", "bytes=4-2", "bytes=-0"} {
+		response, _ := getRange(header)
+		if response.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("Expected 416 for %s, got %d", header, response.StatusCode)
+		}
+		if response.Header.Get("Content-Range") != "bytes */10" {
+			t.Fatalf("Bad unsatisfiable Content-Range for %s: %s", header, response.Header.Get("Content-Range"))
+		}
+	}
+	// Unknown units and multiple ranges are ignored: the full response is served
+	for _, header := range []string{"items=0-1", "bytes=0-1,3-4"} {
+		response, data := getRange(header)
+		if response.StatusCode != http.StatusOK || response.Header.Get("Content-Range") != "" {
+			t.Fatalf("Expected a normal response for %s, got %d (%s)", header, response.StatusCode, response.Header.Get("Content-Range"))
+		}
+		if !strings.Contains(data, "0123456789") {
+			t.Fatalf("Expected full data for %s, got %s", header, data)
+		}
+	}
+	response, err := http.Get(server.URL + "/ranges?nonblocking=true")
+	if err != nil {
+		t.Fatalf("Error reading room: %s", err)
+	}
+	response.Body.Close()
+	if response.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("Ranges not advertised on normal GET")
+	}
+}
+
+func TestFramedRoomHttp(t *testing.T) {
+	_, server := getTestServer(t, reasonableConfig("framedroomhttp"))
+	for i, message := range []string{"line\none", "two", "three"} {
+		query := ""
+		if i == 0 {
+			query = "?framed=true"
+		}
+		response, err := http.Post(server.URL+"/framed"+query, "text/plain", strings.NewReader(message))
+		if err != nil {
+			t.Fatalf("Error posting message: %s", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 posting message, got %d", response.StatusCode)
+		}
+	}
+	response, err := http.Get(server.URL + "/framed/json?nonblocking=true&message=1&count=1")
+	if err != nil {
+		t.Fatalf("Error reading messages: %s", err)
+	}
+	var result StreamResult
+	err = json.NewDecoder(response.Body).Decode(&result)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("Error decoding result: %s", err)
+	}
+	if result.Framed == nil || len(result.Framed.Messages) != 1 || result.Framed.Messages[0] != "two" {
+		t.Fatalf("Unexpected framed result: %v", result.Framed)
+	}
+	if result.Framed.FirstMessage != 1 || result.Framed.NextMessage != 2 || result.NextStart != 19 {
+		t.Fatalf("Unexpected offsets: %d %d %d", result.Framed.FirstMessage, result.Framed.NextMessage, result.NextStart)
+	}
+	// Picking up from nextstart works just like raw rooms
+	response, err = http.Get(server.URL + "/framed/json?nonblocking=true&start=19")
+	if err != nil {
+		t.Fatalf("Error reading messages: %s", err)
+	}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	response.Body.Close()
+	if err != nil || len(result.Framed.Messages) != 1 || result.Framed.Messages[0] != "three" {
+		t.Fatalf("Unexpected result from nextstart: %v (%s)", result.Framed, err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	config := reasonableConfig("metrics")
+	config.AdminKey = "secret"
+	webctx, server := getTestServer(t, config)
+	err := webctx.webstreams.AppendData("measured", []byte("data"))
+	if err != nil {
+		t.Fatalf("Error appending data: %s", err)
+	}
+	err = webctx.webstreams.AppendData("measured", make([]byte, config.StreamDataLimit))
+	if _, ok := err.(*OverCapacityError); !ok {
+		t.Fatalf("Expected OverCapacityError, got %s", err)
+	}
+	_, err = webctx.webstreams.ReadData("measured", 0, -1, nil)
+	if err != nil {
+		t.Fatalf("Error reading data: %s", err)
+	}
+	webctx.webstreams.DumpStreams(false)
+	request, err := http.NewRequest("GET", server.URL+"/metrics", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %s", err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Error getting metrics: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without admin key, got %d", response.StatusCode)
+	}
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Error getting metrics: %s", err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	metrics := string(body)
+	for _, expected := range []string{
+		"webstream_rooms 1\n",
+		"webstream_active_rooms 0\n", // Idle time is 0, so the dump unloads it
+		"webstream_room_bytes{room=\"measured\"} 4\n",
+		"webstream_appends_total 1\n",
+		"webstream_append_bytes_total 4\n",
+		"webstream_reads_total{mode=\"immediate\"} 1\n",
+		"webstream_reads_total{mode=\"blocked\"} 0\n",
+		"webstream_errors_total{type=\"overcapacity\"} 1\n",
+		"webstream_errors_total{type=\"activeroomlimit\"} 0\n",
+		"webstream_dump_duration_seconds_bucket{le=\"+Inf\"} 1\n",
+		"webstream_dump_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Fatalf("Metrics missing %q:\n%s", expected, metrics)
+		}
+	}
+	// Public metrics don't need the admin key at all
+	config = reasonableConfig("publicmetrics")
+	config.PublicMetrics = true
+	_, server = getTestServer(t, config)
+	response, err = http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Error getting public metrics: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 for public metrics, got %d", response.StatusCode)
+	}
+}
+
+func TestExportImportHttp(t *testing.T) {
+	config := reasonableConfig("exportimporthttp")
+	config.AdminKey = "secret"
+	webctx, server := getTestServer(t, config)
+	err := webctx.webstreams.AppendData("exported", []byte("data"))
+	if err != nil {
+		t.Fatalf("Error appending data: %s", err)
+	}
+	rokey := webctx.getReadonlyKey("exported")
+	request, err := http.NewRequest("GET", server.URL+"/admin/export?room=exported", nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %s", err)
+	}
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Error exporting: %s", err)
+	}
+	archive, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("Bad export response: %d %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	// Import into a completely different server; the readonly link should work there
+	config2 := reasonableConfig("exportimporthttp2")
+	config2.AdminKey = "secret"
+	_, server2 := getTestServer(t, config2)
+	request, err = http.NewRequest("POST", server2.URL+"/admin/import", bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("Error creating request: %s", err)
+	}
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Error importing: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 importing without admin key, got %d", response.StatusCode)
+	}
+	request, _ = http.NewRequest("POST", server2.URL+"/admin/import", bytes.NewReader(archive))
+	request.Header.Set("Authorization", "Bearer secret")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Error importing: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 on import, got %d", response.StatusCode)
+	}
+	response, err = http.Get(server2.URL + "/" + rokey + "?readonlykey=true&nonblocking=true")
+	if err != nil {
+		t.Fatalf("Error reading imported room: %s", err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if string(body) != "data" {
+		t.Fatalf("Readonly link didn't work after import: %d %s", response.StatusCode, string(body))
+	}
+}
+
+func TestRoomClassHttp(t *testing.T) {
+	config := reasonableConfig("roomclasshttp")
+	config.RoomClass = []RoomClass{
+		{Regex: "^big-", StreamDataLimit: 5000, SingleDataLimit: 2000},
+	}
+	_, server := getTestServer(t, config)
+	post := func(room string, length int) int {
+		response, err := http.Post(server.URL+"/"+room, "text/plain", strings.NewReader(strings.Repeat("a", length)))
+		if err != nil {
+			t.Fatalf("Error posting data: %s", err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	if code := post("big-room", 1500); code != http.StatusOK {
+		t.Fatalf("Expected big write to big room to work, got %d", code)
+	}
+	if code := post("normal", 1500); code == http.StatusOK {
+		t.Fatalf("Expected big write to normal room to fail")
+	}
+	getConstants := func(query string) StreamConstants {
+		response, err := http.Get(server.URL + "/constants" + query)
+		if err != nil {
+			t.Fatalf("Error getting constants: %s", err)
+		}
+		defer response.Body.Close()
+		var constants StreamConstants
+		err = json.NewDecoder(response.Body).Decode(&constants)
+		if err != nil {
+			t.Fatalf("Error decoding constants: %s", err)
+		}
+		return constants
+	}
+	constants := getConstants("?room=big-room")
+	if constants.MaxStreamSize != 5000 || constants.MaxSingleChunk != 2000 {
+		t.Fatalf("Wrong constants for big room: %v", constants)
+	}
+	constants = getConstants("")
+	if constants.MaxStreamSize != 1000 || constants.MaxSingleChunk != 500 {
+		t.Fatalf("Wrong default constants: %v", constants)
+	}
+	response, err := http.Get(server.URL + "/big-room/json?nonblocking=true")
+	if err != nil {
+		t.Fatalf("Error reading room: %s", err)
+	}
+	defer response.Body.Close()
+	var result StreamResult
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		t.Fatalf("Error decoding result: %s", err)
+	}
+	if result.Limit != 5000 || result.DataLength != 1500 {
+		t.Fatalf("Wrong limit/length for big room: %d/%d", result.Limit, result.DataLength)
+	}
+}
+
+// Two replicas of webstream talking to each other over loopback, with all their
+// background work running
+func getReplicas(t *testing.T, name string) ([]*WebstreamContext, []*httptest.Server) {
+	servers := make([]*httptest.Server, 2)
+	peers := make([]string, 2)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		peers[i] = "http://" + servers[i].Listener.Addr().String()
+	}
+	cancel, cancelfunc := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancelfunc()
+		wg.Wait()
+	})
+	contexts := make([]*WebstreamContext, 2)
+	for i := range servers {
+		config := reasonableConfig(fmt.Sprintf("%s%d", name, i))
+		config.IdleRoomTime = utils.Duration(time.Minute)
+		config.Peers = peers
+		config.PeerSelf = peers[i]
+		config.PeerKey = "peerkey"
+		config.AdminKey = "secret"
+		webctx, err := NewWebstreamContext(config)
+		if err != nil {
+			t.Fatalf("Error creating webstream context: %s", err)
+		}
+		handler, err := webctx.GetHandler()
+		if err != nil {
+			t.Fatalf("Error creating webstream handler: %s", err)
+		}
+		servers[i].Config.Handler = handler
+		servers[i].Start()
+		t.Cleanup(servers[i].Close)
+		wg.Add(1)
+		webctx.RunBackground(cancel, &wg)
+		contexts[i] = webctx
+	}
+	return contexts, servers
+}
+
+// Keep checking until it's true (replication happens in the background)
+func waitFor(t *testing.T, what string, check func() bool) {
+	for range 200 {
+		if check() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func TestReplication(t *testing.T) {
+	contexts, servers := getReplicas(t, "replication")
+	// Find a room that lives on each replica
+	rooms := make([]string, 2)
+	for i := 0; rooms[0] == "" || rooms[1] == ""; i++ {
+		room := fmt.Sprintf("room-%d", i)
+		for j := range servers {
+			if contexts[0].replicator.home(room) == "http://"+servers[j].Listener.Addr().String() {
+				rooms[j] = room
+			}
+		}
+	}
+	post := func(server *httptest.Server, room string, data string) {
+		response, err := http.Post(server.URL+"/"+room, "text/plain", strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error posting data: %s", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 posting to %s, got %d", room, response.StatusCode)
+		}
+	}
+	hasData := func(webctx *WebstreamContext, room string, expected string) func() bool {
+		return func() bool {
+			data, err := webctx.webstreams.ReadData(room, 0, -1, nil)
+			return err == nil && string(data) == expected
+		}
+	}
+	// Writes on either replica end up in the same order everywhere, no matter where they started
+	for i, room := range rooms {
+		post(servers[i], room, "home;")
+		post(servers[1-i], room, "away;")
+		post(servers[i], room, "home again")
+		for j, webctx := range contexts {
+			waitFor(t, fmt.Sprintf("%s on replica %d", room, j), hasData(webctx, room, "home;away;home again"))
+		}
+	}
+	// Out of order appends are refused with where they should've started
+	err := contexts[0].webstreams.ApplyPeerAppend("gapped", 10, []byte("later"), false)
+	offseterr, ok := err.(*PeerOffsetError)
+	if !ok || offseterr.Expected != 0 {
+		t.Fatalf("Expected PeerOffsetError at 0, got %v", err)
+	}
+	// A replica which lost data gets it all back on the next append
+	away := contexts[1].webstreams
+	err = away.DeleteRoom(rooms[0])
+	if err != nil {
+		t.Fatalf("Error deleting room: %s", err)
+	}
+	post(servers[0], rooms[0], "!")
+	waitFor(t, "replica to catch up", hasData(contexts[1], rooms[0], "home;away;home again!"))
+	// Claims are handled by the home, so tokens work from anywhere. Only new rooms can be claimed
+	claimed := ""
+	for i := 0; claimed == ""; i++ {
+		room := fmt.Sprintf("claimed-%d", i)
+		if contexts[0].replicator.home(room) == "http://"+servers[0].Listener.Addr().String() {
+			claimed = room
+		}
+	}
+	response, err := http.Post(servers[1].URL+"/"+claimed+"?claim=true", "text/plain", strings.NewReader("mine"))
+	if err != nil {
+		t.Fatalf("Error claiming room: %s", err)
+	}
+	response.Body.Close()
+	token := response.Header.Get(WriteTokenHeader)
+	if response.StatusCode != http.StatusOK || token == "" {
+		t.Fatalf("Expected token from forwarded claim, got %d", response.StatusCode)
+	}
+	for _, server := range servers {
+		response, err = http.Post(server.URL+"/"+claimed, "text/plain", strings.NewReader("intruder"))
+		if err != nil {
+			t.Fatalf("Error posting data: %s", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusForbidden {
+			t.Fatalf("Expected 403 writing to claimed room without token, got %d", response.StatusCode)
+		}
+	}
+	// Only replicas can send peer appends
+	response, err = http.Post(servers[0].URL+"/peer/append/sneaky?at=0", "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatalf("Error posting peer append: %s", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 on peer append without key, got %d", response.StatusCode)
+	}
+}
+
+func TestReplicationChanges(t *testing.T) {
+	contexts, servers := getReplicas(t, "replicationchanges")
+	homed := make([]string, 0)
+	for i := 0; len(homed) < 2; i++ {
+		room := fmt.Sprintf("room-%d", i)
+		if contexts[0].replicator.home(room) == "http://"+servers[0].Listener.Addr().String() {
+			homed = append(homed, room)
+		}
+	}
+	room, expiring := homed[0], homed[1]
+	// Everything is sent to the replica that isn't the home, it has to go through the home
+	request := func(method string, path string, body string) (int, string) {
+		request, err := http.NewRequest(method, servers[1].URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error creating request: %s", err)
+		}
+		request.Header.Set("Authorization", "Bearer secret")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Error sending %s %s: %s", method, path, err)
+		}
+		defer response.Body.Close()
+		result, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(result)
+	}
+	readonlyKey := func(server *httptest.Server) string {
+		response, err := http.Get(server.URL + "/" + room + "/json?nonblocking=true")
+		if err != nil {
+			t.Fatalf("Error reading room: %s", err)
+		}
+		defer response.Body.Close()
+		var result StreamResult
+		err = json.NewDecoder(response.Body).Decode(&result)
+		if err != nil {
+			t.Fatalf("Error decoding result: %s", err)
+		}
+		return result.Readonlykey
+	}
+	hasData := func(webctx *WebstreamContext, expected string) func() bool {
+		return func() bool {
+			data, err := webctx.webstreams.ReadData(room, 0, -1, nil)
+			return err == nil && string(data) == expected
+		}
+	}
+	for _, r := range homed {
+		if code, _ := request("POST", "/"+r, "data"); code != http.StatusOK {
+			t.Fatalf("Expected 200 posting, got %d", code)
+		}
+	}
+	waitFor(t, "data on replica", hasData(contexts[1], "data"))
+	// Readonly keys come from the home, so they're the same everywhere
+	key := readonlyKey(servers[1])
+	if key == "" || readonlyKey(servers[0]) != key {
+		t.Fatalf("Readonly keys differ between replicas: %s vs %s", key, readonlyKey(servers[0]))
+	}
+	code, newkey := request("POST", "/"+room+"/readonlykey", "")
+	if code != http.StatusOK || newkey == key {
+		t.Fatalf("Bad rotate: %d %s", code, newkey)
+	}
+	waitFor(t, "rotated key on replica", func() bool { return readonlyKey(servers[1]) == newkey })
+	// A replica that doesn't match the home any more gets a fresh copy
+	err := contexts[1].webstreams.ApplyPeerAppend(room, 4, []byte("junk"), false)
+	if err != nil {
+		t.Fatalf("Error appending: %s", err)
+	}
+	if code, _ := request("POST", "/"+room, "more"); code != http.StatusOK {
+		t.Fatalf("Expected 200 posting, got %d", code)
+	}
+	waitFor(t, "drifted replica to be fixed", hasData(contexts[1], "datamore"))
+	if code, _ := request("POST", "/"+room+"/reset", ""); code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on reset, got %d", code)
+	}
+	for i, webctx := range contexts {
+		waitFor(t, fmt.Sprintf("reset on replica %d", i), func() bool {
+			info, err := webctx.webstreams.RoomInfo(room)
+			return err == nil && info.Base == 8 && info.Length == 8
+		})
+	}
+	if code, _ := request("DELETE", "/"+room, ""); code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on delete, got %d", code)
+	}
+	for i, webctx := range contexts {
+		waitFor(t, fmt.Sprintf("delete on replica %d", i), func() bool { return !webctx.webstreams.RoomExists(room) })
+	}
+	// Expiry is decided by the home too
+	if expired := contexts[0].webstreams.ExpireStreams(0); len(expired) != 1 || expired[0] != expiring {
+		t.Fatalf("Expected only %s to expire, got %v", expiring, expired)
+	}
+	waitFor(t, "expiry on replica", func() bool { return !contexts[1].webstreams.RoomExists(expiring) })
+	// Peer changes are only for replicas
+	for _, path := range []string{"/peer/delete/" + expiring, "/peer/replace/" + expiring} {
+		response, err := http.Post(servers[0].URL+path, "text/plain", strings.NewReader(""))
+		if err != nil {
+			t.Fatalf("Error posting: %s", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 on %s without key, got %d", path, response.StatusCode)
+		}
+	}
+}
+
+func TestReplicationFramed(t *testing.T) {
+	contexts, servers := getReplicas(t, "replicationframed")
+	for _, message := range []string{"one", "two"} {
+		response, err := http.Post(servers[1].URL+"/framed-room?framed=true", "text/plain", strings.NewReader(message))
+		if err != nil {
+			t.Fatalf("Error posting data: %s", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Expected 200 posting framed message, got %d", response.StatusCode)
+		}
+	}
+	for i, webctx := range contexts {
+		waitFor(t, fmt.Sprintf("framed messages on replica %d", i), func() bool {
+			read, err := webctx.webstreams.ReadMessages("framed-room", 0, 0, -1, nil)
+			return err == nil && len(read.Messages) == 2 && string(read.Messages[1]) == "two"
+		})
+	}
+}